@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/viper-fetcher"
+)
+
+// Requests received by signal, handled between two cycles.
+type daemonSignals struct {
+	Reload chan struct{}
+	RunNow chan struct{}
+}
+
+// Handle the signals sent to the program:
+//
+// * SIGTERM and SIGINT cancel the context, the running site finishes and no new work is started.
+// A second one stops the program immediately.
+//
+// * SIGHUP reloads the configuration.
+//
+// * SIGUSR1 starts a cycle immediately.
+func listenSignals(cancel context.CancelFunc) daemonSignals {
+	daemonSignals := daemonSignals{
+		Reload: make(chan struct{}, 1),
+		RunNow: make(chan struct{}, 1),
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		stopping := false
+		for sig := range received {
+			switch sig {
+			case syscall.SIGTERM, syscall.SIGINT:
+				if stopping {
+					log.Warn("Second ", sig, ", stop now.")
+					os.Exit(1)
+				}
+				stopping = true
+				log.Info("Received ", sig, ", stop after the running site.")
+				cancel()
+			case syscall.SIGHUP:
+				log.Info("Received ", sig, ", the configuration will be reloaded.")
+				notify(daemonSignals.Reload)
+			case syscall.SIGUSR1:
+				log.Info("Received ", sig, ", a cycle will start now.")
+				notify(daemonSignals.RunNow)
+			}
+		}
+	}()
+	return daemonSignals
+}
+
+func notify(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
+
+// Main loop of the daemon: run a cycle, then wait for the next one, a signal or the shutdown.
+func runDaemon(ctx context.Context, CertManager *manager.CertManager, config *viper_fetcher.Config,
+	confDirPath string, daemonSignals daemonSignals) {
+	for {
+		cycleStart := time.Now()
+		CertManager.ParseSites(ctx)
+		if ctx.Err() != nil {
+			log.Info("Shutdown done.")
+			return
+		}
+		delay, err := config.Schedule.NextDelay(cycleStart, time.Duration(config.RestartMinutes)*time.Minute, time.Now())
+		if err != nil {
+			log.Fatal("While scheduling the next cycle: ", err)
+		}
+		nextCycle := time.Now().Add(delay)
+		log.Info("Next cycle at ", nextCycle.Format("02/01/2006 15:04:05"))
+		timer := time.NewTimer(delay)
+		waiting := true
+		for waiting {
+			windowOpening, stopWindowTimer := pendingDeploymentTimer(CertManager, nextCycle)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				log.Info("Shutdown done.")
+				return
+			case <-daemonSignals.RunNow:
+				timer.Stop()
+				waiting = false
+			case <-daemonSignals.Reload:
+				config = reloadConfiguration(ctx, CertManager, config, confDirPath)
+			case <-timer.C:
+				waiting = false
+			case <-windowOpening:
+				CertManager.DeployPendingCertificates(ctx)
+			}
+			stopWindowTimer()
+		}
+	}
+}
+
+// Return a channel receiving when the deployment window of a pending deployment opens, before the next cycle,
+// so the deployment doesn't wait for a cycle, maybe after the window closed. The channel is nil otherwise.
+func pendingDeploymentTimer(CertManager *manager.CertManager, nextCycle time.Time) (<-chan time.Time, func()) {
+	opening := CertManager.NextPendingDeployment(time.Now())
+	if opening.IsZero() || !opening.Before(nextCycle) {
+		return nil, func() {}
+	}
+	log.Info("A pending deployment will start at ", opening.Format("02/01/2006 15:04:05"))
+	timer := time.NewTimer(time.Until(opening))
+	return timer.C, func() { timer.Stop() }
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/discovery"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+	"github.com/DumesnyJeremy/certificate-manager/manager/updater/local"
+	"github.com/DumesnyJeremy/certificate-manager/viper-fetcher"
+)
+
+// Find the TLS virtual hosts of nginx and Apache, locally or with an updater, and report the sites not managed yet.
+// With -write, these sites are written in a conf.d file, and are loaded with the rest of the configuration.
+func discoverVhostsCommand(confDirPath string, args []string) int {
+	flags := flag.NewFlagSet("discover-vhosts", flag.ExitOnError)
+	updaterName := flags.String("updater", "", "read the web server configuration with this updater, and deploy the sites with it")
+	nginxPatterns := flags.String("nginx", strings.Join(discovery.DefaultNginxPatterns, ","), "nginx configuration files, comma separated")
+	apachePatterns := flags.String("apache", strings.Join(discovery.DefaultApachePatterns, ","), "Apache configuration files, comma separated")
+	write := flags.Bool("write", false, "write the new sites in the conf.d directory")
+	_ = flags.Parse(args)
+
+	// The sites are deployed with the updater, without one they would only be monitored.
+	if *updaterName == "" && *write {
+		fmt.Fprintln(os.Stderr, "-write needs -updater, the updater deploying the sites (a local one for this server)")
+		return 1
+	} else if *updaterName == "" {
+		fmt.Fprintln(os.Stderr, "Warning: without -updater, the sites found have no updater to deploy their certificate")
+	}
+	config, err := viper_fetcher.ParseConfig(confDirPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Fatal error while configuration:", err)
+		return 1
+	}
+	var reader updater.FileReader = &local.Local{}
+	if *updaterName != "" {
+		reader, err = discoveryReader(config, *updaterName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	virtualHosts, err := discovery.Discover(context.Background(), reader, splitPatterns(*nginxPatterns), splitPatterns(*apachePatterns))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	outputName := "local"
+	if *updaterName != "" {
+		outputName = *updaterName
+	}
+	outputFile := filepath.Join(confDirPath, viper_fetcher.ConfDDirName,
+		"discovered-"+strings.NewReplacer(" ", "_", "/", "_").Replace(outputName)+".json")
+	// The sites of the output file are discovered again, they are not considered as managed.
+	managed := make(map[string]bool)
+	written := make(map[string]bool)
+	for i, site := range config.Sites {
+		for _, name := range site.GetNames() {
+			if i < len(config.Sources.Sites) && filepath.Clean(config.Sources.Sites[i].File) == outputFile {
+				written[name] = true
+			} else {
+				managed[name] = true
+			}
+		}
+	}
+
+	newSites := make([]fetcher.CertificateFetchConfig, 0)
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SITE\tPORT\tCERTIFICATE\tSTATUS\tFILE")
+	for _, discovered := range discovery.Sites(virtualHosts, *updaterName) {
+		site := discovered.Site
+		status := "new"
+		switch {
+		case discovered.Skipped != "":
+			site.URL = strings.Join(discovered.VirtualHost.Names, " ")
+			status = "skipped: " + discovered.Skipped
+		case managed[site.URL]:
+			status = "managed"
+		default:
+			if written[site.URL] {
+				status = "written in " + filepath.Base(outputFile)
+			}
+			for _, name := range site.GetNames() {
+				managed[name] = true
+			}
+			newSites = append(newSites, site)
+		}
+		for i, ignored := range discovered.Ignored {
+			if i == 0 {
+				status += ", ignored: "
+			} else {
+				status += ", "
+			}
+			status += ignored.String()
+		}
+		fmt.Fprintln(table, strings.Join(site.GetNames(), " ")+"\t"+strconv.Itoa(discovered.VirtualHost.Port)+"\t"+
+			discovered.VirtualHost.Certificate+"\t"+status+"\t"+discovered.VirtualHost.File)
+	}
+	_ = table.Flush()
+	fmt.Println(len(newSites), "site(s) not managed in the rest of the configuration")
+	if *write && len(newSites) > 0 {
+		if err := viper_fetcher.WriteConfDSites(outputFile, newSites); err != nil {
+			fmt.Fprintln(os.Stderr, "While writing the sites:", err)
+			return 1
+		}
+		fmt.Println("Sites written in", outputFile)
+	}
+	return 0
+}
+
+// Init the updater of the configuration and check it can read the files of its server.
+func discoveryReader(config *viper_fetcher.Config, updaterName string) (updater.FileReader, error) {
+	for _, updaterConfig := range config.Updaters {
+		if updaterConfig.Name != updaterName {
+			continue
+		}
+		CertificateUpdater, err := initCertifUpdater(updaterConfig, config.CertRootPath)
+		if err != nil {
+			return nil, err
+		}
+		reader, ok := CertificateUpdater.(updater.FileReader)
+		if !ok {
+			return nil, errors.New("The updater " + updaterName + " can't read files")
+		}
+		return reader, nil
+	}
+	return nil, errors.New("Unknown updater " + updaterName)
+}
+
+func splitPatterns(patterns string) []string {
+	split := make([]string, 0)
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			split = append(split, pattern)
+		}
+	}
+	return split
+}
+
+// Scan the networks for TLS endpoints and flag the certificates of our domains not checked by any site.
+// The output is a table, JSON, or a conf.d file content with a site per unmanaged certificate.
+func discoverCommand(confDirPath string, args []string) int {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	networks := flags.String("networks", "", "networks to scan, comma separated (default: discovery.networks)")
+	ports := flags.String("ports", "", "ports to scan, comma separated (default: discovery.ports)")
+	output := flags.String("output", "table", "table, json or config")
+	_ = flags.Parse(args)
+
+	config, err := viper_fetcher.ParseConfig(confDirPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Fatal error while configuration:", err)
+		return 1
+	}
+	scanConfig := config.Discovery
+	if *networks != "" {
+		scanConfig.Networks = splitPatterns(*networks)
+	}
+	if *ports != "" {
+		scanConfig.Ports = make([]int, 0)
+		for _, port := range splitPatterns(*ports) {
+			portNumber, err := strconv.Atoi(port)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid port", port)
+				return 1
+			}
+			scanConfig.Ports = append(scanConfig.Ports, portNumber)
+		}
+	}
+	if len(scanConfig.Networks) == 0 {
+		fmt.Fprintln(os.Stderr, "No network to scan, set discovery.networks or -networks")
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenSignals(cancel)
+	endpoints, err := discovery.Scan(ctx, scanConfig, discovery.ProbeWithFetcher)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	siteURLs := make([]string, 0, len(config.Sites))
+	for _, site := range config.Sites {
+		siteURLs = append(siteURLs, site.GetNames()...)
+	}
+	discovery.Classify(endpoints, siteURLs)
+
+	switch *output {
+	case "json":
+		content, err := json.MarshalIndent(endpoints, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(content))
+	case "config":
+		content, err := viper_fetcher.ConfDSites(discovery.UnmanagedSites(endpoints, siteURLs))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Print(string(content))
+	default:
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ADDRESS\tPORT\tNAMES\tISSUER\tEXPIRES\tDAYS LEFT\tSTATE")
+		unmanaged := 0
+		for _, endpoint := range endpoints {
+			if endpoint.State == discovery.EndpointUnmanaged {
+				unmanaged++
+			}
+			fmt.Fprintln(table, endpoint.Address+"\t"+strconv.Itoa(endpoint.Port)+"\t"+strings.Join(endpoint.Names, " ")+"\t"+
+				endpoint.Issuer+"\t"+endpoint.NotAfter.Format("02/01/2006")+"\t"+
+				strconv.FormatInt(endpoint.DaysLeft, 10)+"\t"+endpoint.State)
+		}
+		_ = table.Flush()
+		fmt.Println(len(endpoints), "endpoint(s) found,", unmanaged, "unmanaged")
+	}
+	return 0
+}
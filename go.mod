@@ -5,8 +5,11 @@ go 1.14
 require (
 	github.com/DumesnyJeremy/lets-encrypt v0.0.0-20201116115512-d76f9f412a73
 	github.com/DumesnyJeremy/notification-service v0.0.0-20201116151427-e876fcfb23ee
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-acme/lego/v4 v4.1.0
 	github.com/hnakamur/go-scp v1.0.1
+	github.com/miekg/dns v1.1.31
+	github.com/mitchellh/mapstructure v1.3.3
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.6.1
@@ -27,7 +27,7 @@ function install() {
   fi
 
   # Create default configuration directory
-  mkdir -p /etc/${CONF_DIR_NAME}/letsencrypt/{certificates,account}
+  mkdir -p /etc/${CONF_DIR_NAME}/letsencrypt/{certificates,account} /etc/${CONF_DIR_NAME}/conf.d
   chmod -R 640 /etc/${CONF_DIR_NAME}/letsencrypt/{certificates,account}
   echo "* Certificates and Account directory created in /etc/${CONF_DIR_NAME} ."
 
@@ -50,12 +50,14 @@ After=syslog.target network-online.target
 Environment="HOME=/root"
 Type=simple
 ExecStart=/usr/local/bin/${BINARY_FILE} -d
+ExecReload=/bin/kill -HUP \$MAINPID
 StandardOutput=${LOG_PATH}/${BINARY_FILE}/${BINARY_FILE}.log
 #User=deepak
 #Group=admin
 Restart=on-failure
 RestartSec=10
 KillMode=process
+TimeoutStopSec=180
 [Install]
 WantedBy=multi-user.target
 EOF
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/DumesnyJeremy/lets-encrypt"
 	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
 	"github.com/DumesnyJeremy/lets-encrypt/providers/dns/gandi"
@@ -12,10 +14,14 @@ import (
 	"github.com/DumesnyJeremy/notification-service/rocket"
 	legoLog "github.com/go-acme/lego/v4/log"
 	log "github.com/sirupsen/logrus"
-	"time"
+	"os"
 
 	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/acme"
+	"github.com/DumesnyJeremy/certificate-manager/manager/api"
 	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/metrics"
+	"github.com/DumesnyJeremy/certificate-manager/manager/rfc2136"
 	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
 	"github.com/DumesnyJeremy/certificate-manager/manager/updater/local"
 	"github.com/DumesnyJeremy/certificate-manager/manager/updater/ssh"
@@ -36,13 +42,116 @@ func main() {
 	legoLogger := log.StandardLogger()
 	legoLogger.SetFormatter(formatter)
 	legoLog.Logger = legoLogger
+	// Never write the secrets resolved from the configuration
+	log.AddHook(viper_fetcher.RedactionHook{})
 
-	// Parse config using Viper
-	config, err := viper_fetcher.ParseConfig(*confDirPath)
+	if flag.Arg(0) == "dump" {
+		dump, err := viper_fetcher.DumpConfig(*confDirPath)
+		if err != nil {
+			log.Fatal("Fatal error while configuration: ", err)
+		}
+		fmt.Println(dump)
+		return
+	}
+
+	if flag.Arg(0) == "discover-vhosts" {
+		os.Exit(discoverVhostsCommand(*confDirPath, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "discover" {
+		os.Exit(discoverCommand(*confDirPath, flag.Args()[1:]))
+	}
+
+	// Parse and validate config using Viper
+	config, errs := viper_fetcher.ValidateConfig(*confDirPath)
+	if flag.Arg(0) == "validate" {
+		os.Exit(validateCommand(errs))
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error("Invalid configuration: ", err)
+		}
+		log.Fatal("Fatal error while configuration: ", len(errs), " error(s) found")
+	}
+
+	// Cancelled on SIGTERM: the running site finishes, nothing new is started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := listenSignals(cancel)
+
+	// InitMulti alert manager
+	components := initComponents(ctx, config)
+	CertManager, err := manager.InitCertificateManager(
+		config.CertManager,
+		components.Updaters,
+		components.IndexedSites,
+		components.Notifiers,
+		components.DNSServers,
+		components.LetsEncrypt,
+		components.CAs,
+		*confDirPath)
 	if err != nil {
-		log.Fatal("Fatal error while configuration: ", err)
+		log.Fatal(err.Error())
+	}
+	if flag.Arg(0) == "revoke" {
+		os.Exit(revokeCommand(ctx, CertManager, flag.Args()[1:]))
+	}
+	if *execType == false {
+		CertManager.ParseSites(ctx)
+		return
+	}
+	// Expose the Prometheus metrics while running as a daemon
+	if config.Metrics.Listen != "" {
+		CertManager.Metrics = metrics.NewRegistry()
+		go func() {
+			if err := metrics.ListenAndServe(config.Metrics, CertManager.Metrics); err != nil {
+				log.Error("While serving the metrics: ", err.Error())
+			}
+		}()
+	}
+	// Expose the health and status API while running as a daemon
+	if config.API.Listen != "" {
+		statusAPI := api.InitAPI(config.API, CertManager, config.CertRootPath)
+		go CertManager.RunJobs(ctx)
+		go func() {
+			if err := statusAPI.ListenAndServe(); err != nil {
+				log.Error("While serving the API: ", err.Error())
+			}
+		}()
+	}
+	// Reload the configuration when its file changes, like on SIGHUP
+	if err := viper_fetcher.WatchConfig(ctx, *confDirPath, func() {
+		log.Info("The configuration file changed, it will be reloaded.")
+		notify(signals.Reload)
+	}); err != nil {
+		log.Error("While watching the configuration: ", err.Error())
+	}
+	runDaemon(ctx, CertManager, config, *confDirPath, signals)
+}
+
+// Print the problems found in the configuration and return the exit code of the validate command.
+func validateCommand(errs []error) int {
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
 	}
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, len(errs), "error(s) found in the configuration")
+		return 1
+	}
+	fmt.Println("The configuration is valid")
+	return 0
+}
+
+// Everything built from the configuration file, given to the CertManager.
+type components struct {
+	Notifiers    []notification_service.Notifier
+	DNSServers   []dns.DNSServer
+	Updaters     []updater.CertificateUpdater
+	IndexedSites []fetcher.SitesPerDomain
+	LetsEncrypt  lets_encrypt.LetsEncrypt
+	CAs          []manager.CA
+}
 
+func initComponents(ctx context.Context, config *viper_fetcher.Config) components {
 	// InitMulti Notifiers
 	notifiers := initNotifiers(config.Notifiers)
 
@@ -53,46 +162,62 @@ func main() {
 	servers := initCertUpdaters(config.Updaters, config.CertRootPath)
 
 	// InitMulti certificate analyzers
-	siteCert := fetcher.InitMulti(config.Sites)
+	siteCert := fetcher.InitMulti(ctx, config.Sites)
+
+	// Index Sites per domain
+	indexedSitesPerDomain := fetcher.IndexSitesPerDomains(siteCert)
+
+	return components{
+		Notifiers:    notifiers,
+		DNSServers:   dnsServers,
+		Updaters:     servers,
+		IndexedSites: indexedSitesPerDomain,
+		LetsEncrypt:  initLetsEncrypt(config),
+		CAs:          initCAs(config),
+	}
+}
 
+// The lets_encrypt_user account is optional once acme_accounts are configured.
+func initLetsEncrypt(config *viper_fetcher.Config) lets_encrypt.LetsEncrypt {
+	if config.LetsEncryptUser.Mail == "" && len(config.ACMEAccounts) > 0 {
+		return lets_encrypt.LetsEncrypt{CertificatesRootPath: config.CertRootPath}
+	}
 	// InitMulti let's encrypt user/account
 	letsEncryptCustomUser, err := lets_encrypt.InitLetsEncryptUser(config.LetsEncryptUser)
 	if err != nil {
 		log.Error("While InitMulti Let's User: " + err.Error())
 	}
 
-	// Index Sites per domain
-	indexedSitesPerDomain := fetcher.IndexSitesPerDomains(siteCert)
-
 	// InitMulti let's encrypt
 	letsEncrypt, err := lets_encrypt.InitLetsEncrypt(config.CertRootPath, letsEncryptCustomUser.GetLEUser())
 	if err != nil {
 		log.Error("While InitMulti Let's: " + err.Error())
 	}
-	// InitMulti alert manager
-	CertManager, err := manager.InitCertificateManager(
-		config.CertManager,
-		servers,
-		indexedSitesPerDomain,
-		notifiers,
-		dnsServers,
-		letsEncrypt,
-		*confDirPath)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	//	Main loop
-	for {
-		CertManager.ParseSites()
-		if *execType == true {
-			time.Sleep(time.Duration(config.RestartMinutes) * time.Minute)
-		} else {
-			return
+	return letsEncrypt
+}
+
+// Create the client of every ACME account, a CA that can't be reached is left out.
+func initCAs(config *viper_fetcher.Config) []manager.CA {
+	CAs := make([]manager.CA, 0)
+	for _, account := range config.ACMEAccounts {
+		client, err := acme.NewClient(account, config.CertRootPath)
+		if err != nil {
+			log.Error("While InitCA [", account.Name, "]: ", err.Error())
+			continue
 		}
+		CAs = append(CAs, manager.CA{
+			Name:         account.Name,
+			DirectoryURL: account.Directory(),
+			LetsEncrypt:  client,
+			RateLimit:    account.RateLimit,
+			NoFallback:   account.NoFallback,
+			Staging:      account.Staging,
+		})
 	}
+	return CAs
 }
 
-func initDNSServers(dnsServersConfig []dns.DNSServerConfig) []dns.DNSServer {
+func initDNSServers(dnsServersConfig []viper_fetcher.DNSServerConfig) []dns.DNSServer {
 	dnsServers := make([]dns.DNSServer, 0)
 	for _, DNSServerConfig := range dnsServersConfig {
 		if dnsServer, err := initDNSServer(DNSServerConfig); dnsServer != nil {
@@ -104,12 +229,14 @@ func initDNSServers(dnsServersConfig []dns.DNSServerConfig) []dns.DNSServer {
 	return dnsServers
 }
 
-func initDNSServer(dnsServerConfig dns.DNSServerConfig) (dns.DNSServer, error) {
+func initDNSServer(dnsServerConfig viper_fetcher.DNSServerConfig) (dns.DNSServer, error) {
 	switch dnsServerConfig.Type {
 	case dns.ServerDNSTypeGandy:
-		return gandi.InitDNSServer(dnsServerConfig)
+		return gandi.InitDNSServer(dnsServerConfig.DNSServerConfig)
 	case dns.ServerDNSTypePDNS:
-		return pdns.InitDNSServer(dnsServerConfig)
+		return pdns.InitDNSServer(dnsServerConfig.DNSServerConfig)
+	case rfc2136.ServerDNSTypeRFC2136:
+		return rfc2136.InitDNSServer(dnsServerConfig.DNSServerConfig, dnsServerConfig.Config)
 	default:
 		return nil, errors.New("Didn't found the type")
 	}
@@ -0,0 +1,191 @@
+package acme
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/DumesnyJeremy/lets-encrypt"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// Names of the files of an account, inside its AccountPath.
+const (
+	AccountKeyFileName   = "account.key"
+	RegistrationFileName = "registration.json"
+)
+
+// Key of a new account, and of the certificates without key type.
+const (
+	AccountKeyType            = certcrypto.EC256
+	DefaultCertificateKeyType = certcrypto.RSA2048
+)
+
+// Directories known by their name, usable as directory_url.
+var Directories = map[string]string{
+	"letsencrypt":         lego.LEDirectoryProduction,
+	"letsencrypt-staging": lego.LEDirectoryStaging,
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":      "https://dv.acme-v02.test-api.pki.goog/directory",
+}
+
+// Known directories registering an account only with an External Account Binding.
+var EABDirectories = map[string]bool{
+	"zerossl":        true,
+	"google":         true,
+	"google-staging": true,
+}
+
+// An account on the ACME directory of a CA.
+// RateLimit is the number of certificates per domain every week, the Let's Encrypt one when 0.
+// A CA with NoFallback is only used by the sites choosing it, e.g. a staging directory.
+type AccountConfig struct {
+	Name         string    `mapstructure:"name"`
+	DirectoryURL string    `mapstructure:"directory_url"`
+	Mail         string    `mapstructure:"mail"`
+	AccountPath  string    `mapstructure:"account_path"`
+	RateLimit    int       `mapstructure:"rate_limit"`
+	NoFallback   bool      `mapstructure:"no_fallback"`
+	EAB          EABConfig `mapstructure:"eab"`
+	// Optional, name of the account of the staging directory validating the certificates with staging_first.
+	Staging string `mapstructure:"staging"`
+}
+
+// External Account Binding, the credentials given by the CA to register an account, e.g. ZeroSSL or Google.
+// The HMAC key is base64url encoded, as the CAs give it. Both are only used once, when the account is registered.
+type EABConfig struct {
+	KeyID   string `mapstructure:"key_id"`
+	HMACKey string `mapstructure:"hmac_key"`
+}
+
+// Return true if the account is registered with an External Account Binding.
+func (config AccountConfig) HasEAB() bool {
+	return config.EAB.KeyID != "" || config.EAB.HMACKey != ""
+}
+
+// Return true if the directory, by its name or its URL, only registers an account with an External Account Binding.
+func (config AccountConfig) RequiresEAB() bool {
+	for name := range EABDirectories {
+		if config.DirectoryURL == name || config.Directory() == Directories[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the URL of the directory, resolving the known names.
+func (config AccountConfig) Directory() string {
+	if directoryURL, ok := Directories[config.DirectoryURL]; ok {
+		return directoryURL
+	}
+	return config.DirectoryURL
+}
+
+// The ACME user of an account, see registration.User.
+type Account struct {
+	Email        string
+	Registration *registration.Resource
+	Key          crypto.PrivateKey
+}
+
+func (account *Account) GetEmail() string {
+	return account.Email
+}
+
+func (account *Account) GetRegistration() *registration.Resource {
+	return account.Registration
+}
+
+func (account *Account) GetPrivateKey() crypto.PrivateKey {
+	return account.Key
+}
+
+// Create the ACME client of the account, the certificates are written under certificatesRootPath.
+// The account is read from its AccountPath, or created and registered on the first use.
+func NewClient(config AccountConfig, certificatesRootPath string) (lets_encrypt.LetsEncrypt, error) {
+	account, err := readAccount(config)
+	if err != nil {
+		return lets_encrypt.LetsEncrypt{}, err
+	}
+	legoConfig := lego.NewConfig(account)
+	legoConfig.CADirURL = config.Directory()
+	legoConfig.Certificate.KeyType = DefaultCertificateKeyType
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return lets_encrypt.LetsEncrypt{}, err
+	}
+	if account.Registration == nil {
+		account.Registration, err = register(client, config)
+		if err != nil {
+			return lets_encrypt.LetsEncrypt{}, errors.New("Registration on " + config.Directory() + ": " + err.Error())
+		}
+		if err := writeRegistration(config, account.Registration); err != nil {
+			return lets_encrypt.LetsEncrypt{}, err
+		}
+	}
+	return lets_encrypt.LetsEncrypt{
+		Client:               client,
+		User:                 account,
+		CertificatesRootPath: certificatesRootPath,
+	}, nil
+}
+
+// Register the account on the directory, with its External Account Binding when it has one.
+func register(client *lego.Client, config AccountConfig) (*registration.Resource, error) {
+	if !config.HasEAB() {
+		return client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
+	return client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+		TermsOfServiceAgreed: true,
+		Kid:                  config.EAB.KeyID,
+		HmacEncoded:          config.EAB.HMACKey,
+	})
+}
+
+// Read the key and the registration of the account, the key is created when missing.
+// An account without registration.json isn't registered yet.
+func readAccount(config AccountConfig) (*Account, error) {
+	account := &Account{Email: config.Mail}
+	keyFile := filepath.Join(config.AccountPath, AccountKeyFileName)
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		if account.Key, err = certcrypto.GeneratePrivateKey(AccountKeyType); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(config.AccountPath, 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyFile, certcrypto.PEMEncode(account.Key), 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if account.Key, err = certcrypto.ParsePEMPrivateKey(keyBytes); err != nil {
+		return nil, errors.New(keyFile + ": " + err.Error())
+	}
+	registrationBytes, err := ioutil.ReadFile(filepath.Join(config.AccountPath, RegistrationFileName))
+	if os.IsNotExist(err) {
+		return account, nil
+	} else if err != nil {
+		return nil, err
+	}
+	account.Registration = &registration.Resource{}
+	if err := json.Unmarshal(registrationBytes, account.Registration); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func writeRegistration(config AccountConfig, resource *registration.Resource) error {
+	registrationBytes, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(config.AccountPath, RegistrationFileName), registrationBytes, 0600)
+}
@@ -0,0 +1,261 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestDirectory(t *testing.T) {
+	if directoryURL := (AccountConfig{DirectoryURL: "letsencrypt"}).Directory(); directoryURL != lego.LEDirectoryProduction {
+		t.Error("Expected ", lego.LEDirectoryProduction, " got ", directoryURL)
+	}
+	stepCA := "https://ca.internal:9000/acme/acme/directory"
+	if directoryURL := (AccountConfig{DirectoryURL: stepCA}).Directory(); directoryURL != stepCA {
+		t.Error("Expected ", stepCA, " got ", directoryURL)
+	}
+}
+
+func TestRequiresEAB(t *testing.T) {
+	if !(AccountConfig{DirectoryURL: "zerossl"}).RequiresEAB() || !(AccountConfig{DirectoryURL: Directories["zerossl"]}).RequiresEAB() {
+		t.Error("Expected ZeroSSL, by its name and its URL, to require an External Account Binding")
+	}
+	if (AccountConfig{DirectoryURL: "letsencrypt"}).RequiresEAB() {
+		t.Error("Let's Encrypt doesn't require an External Account Binding")
+	}
+}
+
+func TestAccountKeyIsKept(t *testing.T) {
+	accountPath, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(accountPath)
+	config := AccountConfig{Name: "step-ca", Mail: "example@example.com", AccountPath: accountPath + "/step-ca"}
+	created, err := readAccount(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Registration != nil {
+		t.Error("Expected a new account without registration")
+	}
+	read, err := readAccount(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(created.Key, read.Key) {
+		t.Error("Expected the account key to be read back")
+	}
+}
+
+// A JWS in the flattened JSON serialization, as sent by the ACME clients.
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// A local ACME server registering the accounts only with a valid External Account Binding.
+type eabServer struct {
+	*httptest.Server
+	KeyID         string
+	HMACKey       []byte
+	mutex         sync.Mutex
+	registrations int
+	revocations   []revocation
+}
+
+// A revocation request received by the server.
+type revocation struct {
+	Certificate string `json:"certificate"`
+	Reason      *uint  `json:"reason"`
+}
+
+func newEABServer(keyID string, hmacKey []byte) *eabServer {
+	server := &eabServer{KeyID: keyID, HMACKey: hmacKey}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *eabServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	switch r.URL.Path {
+	case "/directory":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   server.URL + "/new-nonce",
+			"newAccount": server.URL + "/new-account",
+			"newOrder":   server.URL + "/new-order",
+			"revokeCert": server.URL + "/revoke-cert",
+			"keyChange":  server.URL + "/key-change",
+			"meta":       map[string]interface{}{"externalAccountRequired": true},
+		})
+	case "/new-nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/new-account":
+		if err := server.checkBinding(r); err != "" {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"type":   "urn:ietf:params:acme:error:externalAccountRequired",
+				"detail": err,
+				"status": http.StatusUnauthorized,
+			})
+			return
+		}
+		server.mutex.Lock()
+		server.registrations++
+		server.mutex.Unlock()
+		w.Header().Set("Location", server.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid"})
+	case "/revoke-cert":
+		var request jws
+		var revoked revocation
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(request.Payload)
+		if err != nil || json.Unmarshal(payload, &revoked) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.mutex.Lock()
+		server.revocations = append(server.revocations, revoked)
+		server.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Return why the binding of the new account request is refused, empty when it is valid.
+func (server *eabServer) checkBinding(r *http.Request) string {
+	var request jws
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return err.Error()
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(request.Payload)
+	if err != nil {
+		return err.Error()
+	}
+	var account struct {
+		ExternalAccountBinding *jws `json:"externalAccountBinding"`
+	}
+	if err := json.Unmarshal(payload, &account); err != nil {
+		return err.Error()
+	}
+	binding := account.ExternalAccountBinding
+	if binding == nil {
+		return "missing external account binding"
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(binding.Protected)
+	if err != nil {
+		return err.Error()
+	}
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil || header.Kid != server.KeyID {
+		return "unknown key identifier"
+	}
+	mac := hmac.New(sha256.New, server.HMACKey)
+	mac.Write([]byte(binding.Protected + "." + binding.Payload))
+	signature, err := base64.RawURLEncoding.DecodeString(binding.Signature)
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return "invalid binding signature"
+	}
+	return ""
+}
+
+func TestRegisterWithExternalAccountBinding(t *testing.T) {
+	hmacKey := []byte("a secret HMAC key given by the CA")
+	server := newEABServer("kid-1", hmacKey)
+	defer server.Close()
+	accountPath, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(accountPath)
+
+	config := AccountConfig{
+		Name:         "commercial",
+		DirectoryURL: server.URL + "/directory",
+		Mail:         "example@example.com",
+		AccountPath:  accountPath + "/commercial",
+	}
+	if _, err := NewClient(config, "/tmp"); err == nil {
+		t.Error("Expected the registration without binding to be refused")
+	}
+	config.EAB = EABConfig{KeyID: "kid-1", HMACKey: base64.RawURLEncoding.EncodeToString([]byte("another key"))}
+	if _, err := NewClient(config, "/tmp"); err == nil || !strings.Contains(err.Error(), "invalid binding signature") {
+		t.Error("Expected the registration with a wrong HMAC key to be refused, got ", err)
+	}
+	config.EAB.HMACKey = base64.RawURLEncoding.EncodeToString(hmacKey)
+	client, err := NewClient(config, "/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registration := client.User.GetRegistration(); registration == nil || registration.URI != server.URL+"/account/1" {
+		t.Error("Expected the account ", server.URL+"/account/1", " got ", registration)
+	}
+	// The account registered is reused, the binding is not needed anymore.
+	config.EAB = EABConfig{}
+	if _, err := NewClient(config, "/tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if server.registrations != 1 {
+		t.Error("Expected ", 1, " registration got ", server.registrations)
+	}
+}
+
+func TestRevokeWithReason(t *testing.T) {
+	server := newEABServer("kid-1", nil)
+	defer server.Close()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(42), DNSNames: []string{"www.example.com"}}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+	account := &Account{Email: "example@example.com", Key: privateKey}
+	if err := Revoke(server.URL+"/directory", account, certificatePEM, RevocationReasons["keyCompromise"]); err == nil {
+		t.Error("Expected an account without registration to be refused")
+	}
+	account.Registration = &registration.Resource{URI: server.URL + "/account/1"}
+	if err := Revoke(server.URL+"/directory", account, certificatePEM, RevocationReasons["keyCompromise"]); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.revocations) != 1 {
+		t.Fatal("Expected ", 1, " revocation got ", len(server.revocations))
+	}
+	revoked := server.revocations[0]
+	if revoked.Reason == nil || *revoked.Reason != 1 {
+		t.Error("Expected the reason ", 1, " got ", revoked.Reason)
+	}
+	if revoked.Certificate != base64.RawURLEncoding.EncodeToString(certificateDER) {
+		t.Error("Expected the certificate to be sent in base64url DER")
+	}
+}
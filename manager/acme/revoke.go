@@ -0,0 +1,56 @@
+package acme
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+
+	legoACME "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// Revocation reason codes of RFC 5280 accepted by the ACME CAs, by name.
+var RevocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+// Return the accepted revocation reasons, sorted, for the error messages.
+func RevocationReasonNames() []string {
+	names := make([]string, 0, len(RevocationReasons))
+	for name := range RevocationReasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Revoke the first certificate of the PEM bundle with the account, giving the reason code to the CA.
+// The ACME client revokes without reason, the request is sent with its API.
+func Revoke(directoryURL string, user registration.User, certificatePEM []byte, reason uint) error {
+	if user == nil || user.GetRegistration() == nil {
+		return errors.New("The ACME account isn't registered")
+	}
+	bundle, err := certcrypto.ParsePEMBundle(certificatePEM)
+	if err != nil {
+		return err
+	}
+	if bundle[0].IsCA {
+		return errors.New("The bundle starts with a CA certificate")
+	}
+	config := lego.NewConfig(user)
+	core, err := api.New(config.HTTPClient, config.UserAgent, directoryURL, user.GetRegistration().URI, user.GetPrivateKey())
+	if err != nil {
+		return err
+	}
+	return core.Certificates.Revoke(legoACME.RevokeCertMessage{
+		Certificate: base64.RawURLEncoding.EncodeToString(bundle[0].Raw),
+		Reason:      &reason,
+	})
+}
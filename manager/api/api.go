@@ -0,0 +1,213 @@
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+)
+
+type Config struct {
+	Listen string `mapstructure:"listen"`
+	// When set, every request except /healthz and /readyz needs the header "Authorization: Bearer <token>".
+	// The renew, deploy and probe actions are only enabled with a token.
+	Token string `mapstructure:"token"`
+	// URL of a site managed by the program, its certificate is used to serve the API with TLS.
+	TLSSite string `mapstructure:"tls_site"`
+}
+
+// HTTP API exposing the state of the daemon, read-only unless a token is configured.
+type API struct {
+	Config       Config
+	CertManager  *manager.CertManager
+	CertRootPath string
+	mux          *http.ServeMux
+}
+
+// Build the API and register its routes.
+func InitAPI(config Config, certManager *manager.CertManager, certRootPath string) *API {
+	api := &API{
+		Config:       config,
+		CertManager:  certManager,
+		CertRootPath: certRootPath,
+		mux:          http.NewServeMux(),
+	}
+	api.mux.HandleFunc("/healthz", api.healthz)
+	api.mux.HandleFunc("/readyz", api.readyz)
+	api.mux.Handle("/status", api.authenticated(api.status))
+	api.mux.Handle("/sites", api.authenticated(api.sites))
+	api.mux.Handle("/domains", api.authenticated(api.domains))
+	api.mux.Handle("/sites/", api.authenticated(api.siteAction))
+	api.mux.Handle("/domains/", api.authenticated(api.domainAction))
+	api.mux.Handle("/jobs/", api.authenticated(api.job))
+	return api
+}
+
+// Give access to the routes, so other handlers can be registered next to them.
+func (api *API) Handle(pattern string, handler http.Handler) {
+	api.mux.Handle(pattern, handler)
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// Start listening, with TLS if a managed site is given. It blocks like http.ListenAndServe.
+func (api *API) ListenAndServe() error {
+	server := &http.Server{Addr: api.Config.Listen, Handler: api}
+	if api.Config.TLSSite == "" {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: api.getCertificate}
+	return server.ListenAndServeTLS("", "")
+}
+
+// Load the managed certificate on every handshake, so a renewed certificate is used without restart.
+func (api *API) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificateDir := filepath.Join(api.CertRootPath, api.Config.TLSSite)
+	certificate, err := tls.LoadX509KeyPair(
+		filepath.Join(certificateDir, api.Config.TLSSite+".crt"),
+		filepath.Join(certificateDir, api.Config.TLSSite+".key"))
+	if err != nil {
+		return nil, errors.New("Can't load the certificate of [" + api.Config.TLSSite + "]: " + err.Error())
+	}
+	return &certificate, nil
+}
+
+// Reject the requests without the right bearer token, if one is configured.
+func (api *API) authenticated(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.Config.Token != "" {
+			// The scheme is case-insensitive, a bare token is refused.
+			authorization := r.Header.Get("Authorization")
+			if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(authorization[len("Bearer "):]), []byte(api.Config.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		handler(w, r)
+	})
+}
+
+func (api *API) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (api *API) readyz(w http.ResponseWriter, r *http.Request) {
+	if !api.CertManager.IsReady() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (api *API) status(w http.ResponseWriter, r *http.Request) {
+	if !isReadOnlyMethod(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, api.CertManager.Status())
+}
+
+func (api *API) sites(w http.ResponseWriter, r *http.Request) {
+	if !isReadOnlyMethod(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, api.CertManager.SitesStatus())
+}
+
+func (api *API) domains(w http.ResponseWriter, r *http.Request) {
+	if !isReadOnlyMethod(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, api.CertManager.DomainsStatus())
+}
+
+// POST /sites/<url>/renew, /sites/<url>/deploy or /sites/<url>/probe queue a job for the site.
+func (api *API) siteAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sites/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	jobTypes := map[string]string{
+		"renew":  manager.JobForceRenew,
+		"deploy": manager.JobRedeploy,
+		"probe":  manager.JobProbeSite,
+	}
+	jobType, ok := jobTypes[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown action "+parts[1])
+		return
+	}
+	api.submitJob(w, r, jobType, parts[0])
+}
+
+// POST /domains/<name>/probe queues a probe of every site of the domain.
+func (api *API) domainAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/domains/"), "/")
+	if len(parts) != 2 || parts[1] != "probe" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	api.submitJob(w, r, manager.JobProbeDomain, parts[0])
+}
+
+// GET /jobs/<id> returns the state of a job.
+func (api *API) job(w http.ResponseWriter, r *http.Request) {
+	if !isReadOnlyMethod(w, r) {
+		return
+	}
+	job, ok := api.CertManager.GetJob(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// The actions are only available with a token, the API stays read-only otherwise.
+func (api *API) submitJob(w http.ResponseWriter, r *http.Request, jobType string, target string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if api.Config.Token == "" {
+		writeError(w, http.StatusForbidden, "actions need an api token in the configuration")
+		return
+	}
+	job, err := api.CertManager.SubmitJob(jobType, target)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func isReadOnlyMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error("While writing the API response: ", err.Error())
+	}
+}
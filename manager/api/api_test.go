@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DumesnyJeremy/lets-encrypt"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+type fakeSite struct{}
+
+func (site *fakeSite) DaysLeft() int                                                { return 42 }
+func (site *fakeSite) RefreshCertifAndGetDaysLeft(ctx context.Context) (int, error) { return 42, nil }
+func (site *fakeSite) IsSiteValid() bool                                            { return true }
+func (site *fakeSite) Refresh(ctx context.Context) error                            { return nil }
+func (site *fakeSite) GetDomain() string                                            { return "serv.io" }
+func (site *fakeSite) GetCertificate() *x509.Certificate                            { return nil }
+func (site *fakeSite) GetConfig() fetcher.CertificateFetchConfig {
+	return fetcher.CertificateFetchConfig{URL: "1.serv.io", Port: 443}
+}
+
+func request(api *API, method string, path string, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	api.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestReadyAfterFirstCycle(t *testing.T) {
+	certManager := &manager.CertManager{}
+	api := InitAPI(Config{}, certManager, "")
+	if code := request(api, http.MethodGet, "/readyz", "").Code; code != http.StatusServiceUnavailable {
+		t.Error("Expected not ready before the first cycle, got: ", code)
+	}
+	certManager.ParseSites(context.Background())
+	if code := request(api, http.MethodGet, "/readyz", "").Code; code != http.StatusOK {
+		t.Error("Expected ready after the first cycle, got: ", code)
+	}
+	if code := request(api, http.MethodGet, "/healthz", "").Code; code != http.StatusOK {
+		t.Error("Expected healthy, got: ", code)
+	}
+}
+
+func TestTokenIsRequired(t *testing.T) {
+	api := InitAPI(Config{Token: "secret"}, &manager.CertManager{}, "")
+	if code := request(api, http.MethodGet, "/status", "").Code; code != http.StatusUnauthorized {
+		t.Error("Expected unauthorized without token, got: ", code)
+	}
+	if code := request(api, http.MethodGet, "/sites", "wrong").Code; code != http.StatusUnauthorized {
+		t.Error("Expected unauthorized with a wrong token, got: ", code)
+	}
+	bare := httptest.NewRecorder()
+	bareRequest := httptest.NewRequest(http.MethodGet, "/sites", nil)
+	bareRequest.Header.Set("Authorization", "secret")
+	api.ServeHTTP(bare, bareRequest)
+	if bare.Code != http.StatusUnauthorized {
+		t.Error("Expected unauthorized without the Bearer scheme, got: ", bare.Code)
+	}
+	if code := request(api, http.MethodGet, "/domains", "secret").Code; code != http.StatusOK {
+		t.Error("Expected success with the token, got: ", code)
+	}
+	if code := request(api, http.MethodPost, "/status", "secret").Code; code != http.StatusMethodNotAllowed {
+		t.Error("Expected the API to be read-only, got: ", code)
+	}
+}
+
+func TestProbeJobIsQueuedAndPolled(t *testing.T) {
+	certManager, _ := manager.InitCertificateManager(manager.CertManagerConfig{}, nil,
+		fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{&fakeSite{}}), nil, nil, lets_encrypt.LetsEncrypt{}, nil, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certManager.RunJobs(ctx)
+
+	if code := request(InitAPI(Config{}, certManager, ""), http.MethodPost, "/sites/1.serv.io/probe", "").Code; code != http.StatusForbidden {
+		t.Error("Expected the actions to be disabled without token, got: ", code)
+	}
+	api := InitAPI(Config{Token: "secret"}, certManager, "")
+	if code := request(api, http.MethodPost, "/sites/unknown.serv.io/probe", "secret").Code; code != http.StatusBadRequest {
+		t.Error("Expected an unknown site to be rejected, got: ", code)
+	}
+	recorder := request(api, http.MethodPost, "/sites/1.serv.io/probe", "secret")
+	if recorder.Code != http.StatusAccepted {
+		t.Fatal("Expected the job to be accepted, got: ", recorder.Code)
+	}
+	var job manager.Job
+	if err := json.Unmarshal(recorder.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && job.Status != manager.JobSucceeded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_ = json.Unmarshal(request(api, http.MethodGet, "/jobs/"+job.ID, "secret").Body.Bytes(), &job)
+	}
+	if job.Status != manager.JobSucceeded || job.DaysLeft["1.serv.io"] != 42 {
+		t.Error("Expected a succeeded probe, got: ", job)
+	}
+}
@@ -0,0 +1,135 @@
+package ari
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum time of a request to the ACME server.
+const RequestTimeout = 10 * time.Second
+
+// ACME Renewal Information, see RFC 9773. Enabled by default, with the directory of the Let's Encrypt client.
+type Config struct {
+	Disabled     bool   `mapstructure:"disabled"`
+	DirectoryURL string `mapstructure:"directory_url"`
+}
+
+// Renewal window suggested by the CA for a certificate.
+// A window ending before the usual renewal time is an early renewal asked by the CA, e.g. before a revocation.
+type Window struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	ExplanationURL string    `json:"-"`
+}
+
+// Return a random time inside the window, to spread the renewals asked at the same time.
+func (window Window) RandomTime() time.Time {
+	length := window.End.Sub(window.Start)
+	if length <= 0 {
+		return window.Start
+	}
+	return window.Start.Add(time.Duration(rand.Int63n(int64(length))))
+}
+
+// Query the renewal information of the certificates to an ACME server.
+type Client struct {
+	DirectoryURL   string
+	HTTPClient     *http.Client
+	mutex          sync.Mutex
+	renewalInfoURL string
+}
+
+func NewClient(directoryURL string) *Client {
+	return &Client{
+		DirectoryURL: directoryURL,
+		HTTPClient:   &http.Client{Timeout: RequestTimeout},
+	}
+}
+
+// Return the window suggested by the CA for the certificate.
+func (client *Client) RenewalInfo(ctx context.Context, certificate *x509.Certificate) (*Window, error) {
+	certID, err := CertID(certificate)
+	if err != nil {
+		return nil, err
+	}
+	renewalInfoURL, err := client.getRenewalInfoURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var renewalInfo struct {
+		SuggestedWindow Window `json:"suggestedWindow"`
+		ExplanationURL  string `json:"explanationURL"`
+	}
+	if err := client.getJSON(ctx, strings.TrimSuffix(renewalInfoURL, "/")+"/"+certID, &renewalInfo); err != nil {
+		return nil, err
+	}
+	window := renewalInfo.SuggestedWindow
+	if window.Start.IsZero() || window.End.Before(window.Start) {
+		return nil, errors.New("Invalid renewal window for " + certID)
+	}
+	window.ExplanationURL = renewalInfo.ExplanationURL
+	return &window, nil
+}
+
+// Return the ARI identifier of the certificate: the key identifier of its issuer and its serial number,
+// both base64url encoded.
+func CertID(certificate *x509.Certificate) (string, error) {
+	if len(certificate.AuthorityKeyId) == 0 {
+		return "", errors.New("The certificate has no authority key identifier")
+	}
+	if certificate.SerialNumber == nil || certificate.SerialNumber.Sign() <= 0 {
+		return "", errors.New("The certificate has no serial number")
+	}
+	// DER encoding of the positive integer, without tag and length.
+	serial := certificate.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(certificate.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// Read the renewalInfo URL from the directory, once.
+func (client *Client) getRenewalInfoURL(ctx context.Context) (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.renewalInfoURL != "" {
+		return client.renewalInfoURL, nil
+	}
+	var directory struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := client.getJSON(ctx, client.DirectoryURL, &directory); err != nil {
+		return "", err
+	}
+	if directory.RenewalInfo == "" {
+		return "", errors.New("The ACME server " + client.DirectoryURL + " doesn't support ARI")
+	}
+	client.renewalInfoURL = directory.RenewalInfo
+	return client.renewalInfoURL, nil
+}
+
+func (client *Client) getJSON(ctx context.Context, url string, value interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.HTTPClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("GET " + url + ": status " + strconv.Itoa(response.StatusCode))
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
@@ -0,0 +1,53 @@
+package ari_test
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari/aritest"
+)
+
+func TestCertID(t *testing.T) {
+	// Example of RFC 9773.
+	certificate := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3, 0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4},
+		SerialNumber:   new(big.Int).SetBytes([]byte{0x00, 0x87, 0x65, 0x43, 0x21}),
+	}
+	certID, err := ari.CertID(certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certID != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Error("Expected ", "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", " got ", certID)
+	}
+	if _, err := ari.CertID(&x509.Certificate{SerialNumber: big.NewInt(1)}); err == nil {
+		t.Error("Expected an error without authority key identifier")
+	}
+}
+
+func TestRenewalInfo(t *testing.T) {
+	certificate := &x509.Certificate{AuthorityKeyId: []byte{1, 2, 3}, SerialNumber: big.NewInt(42)}
+	certID, _ := ari.CertID(certificate)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	server := aritest.NewServer(map[string]ari.Window{certID: {Start: start, End: start.Add(2 * time.Hour)}})
+	defer server.Close()
+
+	window, err := ari.NewClient(server.URL+"/directory").RenewalInfo(context.Background(), certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !window.Start.Equal(start) || window.ExplanationURL != aritest.ExplanationURL {
+		t.Error("Unexpected window: ", window)
+	}
+	if random := window.RandomTime(); random.Before(window.Start) || random.After(window.End) {
+		t.Error("Expected a time inside the window, got ", random)
+	}
+	unknown := &x509.Certificate{AuthorityKeyId: []byte{1, 2, 3}, SerialNumber: big.NewInt(43)}
+	if _, err := ari.NewClient(server.URL+"/directory").RenewalInfo(context.Background(), unknown); err == nil {
+		t.Error("Expected an error for a certificate unknown by the CA")
+	}
+}
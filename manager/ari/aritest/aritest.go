@@ -0,0 +1,37 @@
+// Package aritest serves the renewal information of an ACME CA, for the tests.
+package aritest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+)
+
+// Explanation given with every window.
+const ExplanationURL = "https://example.com/incident"
+
+// Return a local ACME stand-in serving its directory at /directory and the windows by ARI identifier,
+// a certificate it doesn't know is not found.
+func NewServer(windows map[string]ari.Window) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"renewalInfo": server.URL + "/renewal-info/"})
+	})
+	mux.HandleFunc("/renewal-info/", func(w http.ResponseWriter, r *http.Request) {
+		window, ok := windows[strings.TrimPrefix(r.URL.Path, "/renewal-info/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"suggestedWindow": window,
+			"explanationURL":  ExplanationURL,
+		})
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
@@ -0,0 +1,248 @@
+package manager
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/lets-encrypt"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Name of the CA of the lets_encrypt_user account, used when no acme_accounts are configured.
+const DefaultCA = "default"
+
+// Name of the file, inside the configuration directory, keeping the orders passed to every CA.
+const OrdersFileName = "orders.json"
+
+// How long the orders are kept in the ledger, longer than the rate limits, or until their certificate expires.
+const OrdersRetention = 30 * 24 * time.Hour
+
+// A CA the certificates are ordered from, with its own account and rate limit ledger.
+type CA struct {
+	Name         string
+	DirectoryURL string
+	LetsEncrypt  lets_encrypt.LetsEncrypt
+	ARI          *ari.Client // Optional, asks the CA its renewal windows.
+	RateLimit    int         // Certificates per domain every week, MaxRenewPerDomainPerWeek when 0.
+	NoFallback   bool        // Only used by the certificates choosing it.
+	Staging      string      // Optional, name of the CA validating the certificates with staging_first.
+}
+
+func (ca CA) rateLimit() int {
+	if ca.RateLimit > 0 {
+		return ca.RateLimit
+	}
+	return MaxRenewPerDomainPerWeek
+}
+
+// A certificate issued by a CA, it counts in the rate limit of its domain at this CA.
+type Order struct {
+	CA          string    `json:"ca"`
+	Domain      string    `json:"domain"`
+	Certificate string    `json:"certificate"`
+	Serial      string    `json:"serial"`
+	Issued      time.Time `json:"issued"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Return every CA: the one of the lets_encrypt_user account, when it is configured or alone, then the acme_accounts.
+func (CertManager *CertManager) authorities() []CA {
+	authorities := make([]CA, 0, len(CertManager.CAs)+1)
+	if CertManager.LetsEncrypt.Client != nil || len(CertManager.CAs) == 0 {
+		authorities = append(authorities, CA{
+			Name:         DefaultCA,
+			DirectoryURL: lets_encrypt.CADirURL,
+			LetsEncrypt:  CertManager.LetsEncrypt,
+			ARI:          CertManager.ARI,
+		})
+	}
+	return append(authorities, CertManager.CAs...)
+}
+
+// Set the ARI client of every CA, unless ARI is disabled.
+func withARIClients(authorities []CA, config ari.Config) []CA {
+	withARI := make([]CA, 0, len(authorities))
+	for _, ca := range authorities {
+		ca.ARI = nil
+		if !config.Disabled {
+			ca.ARI = ari.NewClient(ca.DirectoryURL)
+		}
+		withARI = append(withARI, ca)
+	}
+	return withARI
+}
+
+// Return the CAs to order the certificate from: the one it chooses, the first one by default,
+// then the others allowing a fallback, in the order of the configuration.
+// The staging CA of another one is only used when chosen: its certificates aren't trusted.
+func (CertManager *CertManager) caOrder(config certificates.Config) []CA {
+	authorities := CertManager.authorities()
+	primary := config.CA
+	order := make([]CA, 0, len(authorities))
+	for _, ca := range authorities {
+		if primary == "" && !CertManager.isStagingCA(ca) {
+			primary = ca.Name
+		}
+		if ca.Name == primary {
+			order = append(order, ca)
+		}
+	}
+	for _, ca := range authorities {
+		if ca.Name != primary && !ca.NoFallback && !CertManager.isStagingCA(ca) {
+			order = append(order, ca)
+		}
+	}
+	return order
+}
+
+// Return true if the CA is the staging CA of another one.
+func (CertManager *CertManager) isStagingCA(ca CA) bool {
+	for _, production := range CertManager.authorities() {
+		if production.Staging == ca.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the CAs the managed certificates of the domain are ordered from, in the order of the configuration.
+func (CertManager *CertManager) domainAuthorities(domain fetcher.SitesPerDomain) []CA {
+	used := make(map[string]bool)
+	for _, site := range domain.Sites {
+		if !site.GetConfig().IsManaged() {
+			continue
+		}
+		config, _ := site.GetConfig().GetCertificateConfig()
+		for _, ca := range CertManager.caOrder(config) {
+			used[ca.Name] = true
+		}
+	}
+	authorities := make([]CA, 0, len(used))
+	for _, ca := range CertManager.authorities() {
+		if used[ca.Name] {
+			authorities = append(authorities, ca)
+		}
+	}
+	return authorities
+}
+
+// Return the orders the CA still accepts for the domain during the next given day's.
+// The certificates served but issued before the ledger count for the CA of their configuration.
+func (CertManager *CertManager) remainingOrders(ca CA, days int, domain fetcher.SitesPerDomain) int {
+	since := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	known := make(map[string]bool)
+	orders := 0
+	for _, order := range CertManager.getOrders() {
+		if !order.Issued.After(since) {
+			continue
+		}
+		known[order.Serial] = true
+		if order.CA == ca.Name && order.Domain == domain.Name {
+			orders++
+		}
+	}
+	served := make(map[string]bool)
+	for _, site := range domain.Sites {
+		certificate := site.GetCertificate()
+		if !site.GetConfig().IsManaged() || certificate == nil || !certificate.NotBefore.After(since) || known[serialOf(certificate)] {
+			continue
+		}
+		config, _ := site.GetConfig().GetCertificateConfig()
+		if order := CertManager.caOrder(config); len(order) > 0 && order[0].Name == ca.Name {
+			served[orderKey(site)] = true
+		}
+	}
+	return ca.rateLimit() - orders - len(served)
+}
+
+func serialOf(certificate *x509.Certificate) string {
+	if certificate.SerialNumber == nil {
+		return ""
+	}
+	return certificate.SerialNumber.String()
+}
+
+// Write the certificate issued by the CA in the ledger.
+// An order is kept while its certificate is valid, so the CA to revoke it at is known.
+func (CertManager *CertManager) recordOrder(ca CA, domain string, name string, issued *x509.Certificate) {
+	unlock := lockLedger(CertManager.ordersPath())
+	defer unlock()
+	if CertManager.ordersPath() != "" {
+		// Another process may have written the ledger since it was read.
+		CertManager.ordersLoaded = false
+	}
+	orders := make([]Order, 0)
+	for _, order := range CertManager.getOrders() {
+		if time.Since(order.Issued) < OrdersRetention || time.Now().Before(order.Expires) {
+			orders = append(orders, order)
+		}
+	}
+	CertManager.orders = append(orders, Order{
+		CA:          ca.Name,
+		Domain:      domain,
+		Certificate: name,
+		Serial:      serialOf(issued),
+		Issued:      time.Now(),
+		Expires:     issued.NotAfter,
+	})
+	CertManager.writeOrders()
+}
+
+func (CertManager *CertManager) getOrders() []Order {
+	if !CertManager.ordersLoaded {
+		CertManager.orders = CertManager.readOrders()
+		CertManager.ordersLoaded = true
+	}
+	return CertManager.orders
+}
+
+// The ledger is kept on disk, so a run started by the timer knows about the previous orders.
+func (CertManager *CertManager) ordersPath() string {
+	if CertManager.ConfDirPath == "" {
+		return ""
+	}
+	return filepath.Join(CertManager.ConfDirPath, OrdersFileName)
+}
+
+func (CertManager *CertManager) readOrders() []Order {
+	orders := make([]Order, 0)
+	path := CertManager.ordersPath()
+	if path == "" {
+		return orders
+	}
+	ordersBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("While reading the orders: ", err.Error())
+		}
+		return orders
+	}
+	if err := json.Unmarshal(ordersBytes, &orders); err != nil {
+		log.Error("While reading the orders: ", err.Error())
+	}
+	return orders
+}
+
+func (CertManager *CertManager) writeOrders() {
+	path := CertManager.ordersPath()
+	if path == "" {
+		return
+	}
+	ordersBytes, err := json.Marshal(CertManager.orders)
+	if err != nil {
+		log.Error("While saving the orders: ", err.Error())
+		return
+	}
+	if err := writeLedger(path, ordersBytes); err != nil {
+		log.Error("While saving the orders: ", err.Error())
+	}
+}
@@ -1,15 +1,22 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	log "github.com/sirupsen/logrus"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/DumesnyJeremy/lets-encrypt"
 	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
 	"github.com/DumesnyJeremy/notification-service"
 
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
 	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/metrics"
 	"github.com/DumesnyJeremy/certificate-manager/manager/updater"
 )
 
@@ -17,13 +24,38 @@ import (
 // https://letsencrypt.org/docs/rate-limits/ .
 const (
 	MaxSitesPerDomain        = 200
-	DaysAfterRenew           = 90
 	MaxRenewPerDomainPerWeek = 50
-	DaysLimitToRenew         = 30
+	RateLimitDays            = 7 // The rate limits count the certificates issued during the last week.
 )
 
+// Days left under which a site only monitored is alerted on, at every cycle.
+const DaysLimitToAlert = 30
+
+// Categories of notifications a recipient can subscribe to.
+// EXPIRING alerts on the sites only monitored, whose certificates the manager doesn't renew.
+const (
+	CategoryRenew    = "RENEW"
+	CategoryError    = "ERROR"
+	CategoryExpiring = "EXPIRING"
+)
+
+var Categories = []string{CategoryRenew, CategoryError, CategoryExpiring}
+
 type CertManagerConfig struct {
-	Recipients []RecipientConfig `mapstructure:"recipients"`
+	Recipients   []RecipientConfig  `mapstructure:"recipients"`
+	Notification NotificationConfig `mapstructure:"notification"`
+	// Policy of every site without its own, certificates.DefaultRenewAt of the lifetime when empty.
+	Renewal certificates.RenewalPolicy `mapstructure:"renewal"`
+	ARI     ari.Config                 `mapstructure:"ari"`
+}
+
+// Delivery settings shared by every notifier.
+// A message that still fails after all the retries is written in the spool
+// and will be sent again at the beginning of the next ParseSites.
+type NotificationConfig struct {
+	Retries       int    `mapstructure:"retries"`
+	RetryDelaySec int    `mapstructure:"retry_delay_sec"`
+	SpoolPath     string `mapstructure:"spool_path"`
 }
 
 type RecipientConfig struct {
@@ -32,6 +64,15 @@ type RecipientConfig struct {
 	Dest       []string `mapstructure:"dest"`
 }
 
+func (recipient RecipientConfig) hasCategory(category string) bool {
+	for _, recipientCategory := range recipient.Categories {
+		if recipientCategory == category {
+			return true
+		}
+	}
+	return false
+}
+
 // Interface with 3 methods used to detect if all the sites in one domain
 // respect the limits that Let's Encrypt has established.
 type SitesLimitInfo interface {
@@ -64,79 +105,134 @@ type CertManager struct {
 	Notifiers           []notification_service.Notifier          // Methods used to send notification.
 	DNSServers          []dns.DNSServer                          // Methods used to accomplish DNS Challenges.
 	LetsEncrypt         lets_encrypt.LetsEncrypt                 // Used to communicate with Let's Encrypt.
+	CAs                 []CA                                     // CAs of the acme_accounts.
+	Metrics             *metrics.Registry                        // Optional, exposes the state to Prometheus.
+	status              managerStatus                            // Last cycle state, read by the API.
+	jobs                jobQueue                                 // Jobs asked on demand.
+	cycleMutex          sync.Mutex                               // Prevents a job from running during a cycle.
+	pendingDeployments  []PendingDeployment                      // Certificates waiting for a deployment window.
+	pendingLoaded       bool
+	ARI                 *ari.Client              // Optional, asks the CA its renewal windows.
+	renewalWindows      map[string]renewalWindow // Windows suggested by the CA, by ARI identifier.
+	orders              []Order                  // Ledger of the certificates issued by every CA.
+	ordersLoaded        bool
+	stagingValidations  []StagingValidation // Certificates whose DNS-01 flow succeeded on staging.
+	stagingLoaded       bool
+	revocations         []Revocation // History of the certificates revoked.
+	revocationsLoaded   bool
+	alerted             map[string]bool // Alerts already sent, see firstAlert.
 }
 
-//Initialization of the Certificate Manager structure.
+// Initialization of the Certificate Manager structure.
 func InitCertificateManager(CertificateManager CertManagerConfig,
 	certificateUpdaters []certificate_updater.CertificateUpdater,
 	sitesPerDomain []fetcher.SitesPerDomain,
 	notifiers []notification_service.Notifier,
 	dnsServers []dns.DNSServer,
 	LetsEncrypt lets_encrypt.LetsEncrypt,
+	CAs []CA,
 	confDirPath string) (*CertManager, error) {
-	return &CertManager{
+	certManager := &CertManager{
 		Config:              CertificateManager,
 		IndexedSites:        sitesPerDomain,
 		CertificateUpdaters: certificateUpdaters,
 		Notifiers:           notifiers,
 		DNSServers:          dnsServers,
 		LetsEncrypt:         LetsEncrypt,
+		CAs:                 withARIClients(CAs, CertificateManager.ARI),
 		ConfDirPath:         confDirPath,
-	}, nil
+		ARI:                 newARIClient(CertificateManager.ARI),
+	}
+	certManager.snapshotStatus()
+	return certManager, nil
+}
+
+// Replace every component built from the configuration, it waits for the running cycle or job to end.
+func (CertManager *CertManager) Reload(CertificateManager CertManagerConfig,
+	certificateUpdaters []certificate_updater.CertificateUpdater,
+	sitesPerDomain []fetcher.SitesPerDomain,
+	notifiers []notification_service.Notifier,
+	dnsServers []dns.DNSServer,
+	LetsEncrypt lets_encrypt.LetsEncrypt,
+	CAs []CA) {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	CertManager.Config = CertificateManager
+	CertManager.CertificateUpdaters = certificateUpdaters
+	CertManager.IndexedSites = sitesPerDomain
+	CertManager.Notifiers = notifiers
+	CertManager.DNSServers = dnsServers
+	CertManager.LetsEncrypt = LetsEncrypt
+	CertManager.CAs = withARIClients(CAs, CertificateManager.ARI)
+	CertManager.ARI = newARIClient(CertificateManager.ARI)
+	CertManager.snapshotStatus()
 }
 
-// Use an array of site that need a renew this between this week and this month,
-// it will only take 50 sites per domain every week to do respect the Let's Encrypt rate limits.
+// Use an array of certificates that need a renew this between this week and this month,
+// it will only take 50 certificates per domain every week to do respect the Let's Encrypt rate limits.
 //
 // If an error occurs during the renew, it will send to the recipients who have the ERROR categories
 // in the configuration file.
-func (CertManager *CertManager) ParseSites() {
-	sitesToRenew := CertManager.GetSitesToRenew()
-	for _, site := range sitesToRenew {
-		err := CertManager.Renew(site)
+//
+// Once the context is cancelled, no new certificate is started.
+func (CertManager *CertManager) ParseSites(ctx context.Context) {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	CertManager.reloadLedgers()
+	CertManager.startCycleStatus()
+	defer CertManager.endCycleStatus()
+	CertManager.FlushSpool(ctx)
+	CertManager.deployPendingCertificates(ctx)
+	CertManager.refreshSitesMetrics(ctx)
+	CertManager.snapshotStatus()
+	CertManager.alertExpiringSites(ctx)
+	CertManager.alertOCSPStatus(ctx)
+	CertManager.alertWrongDeployments(ctx)
+	CertManager.refreshRenewalWindows(ctx)
+	certificatesToRenew := CertManager.GetCertificatesToRenew()
+	for _, certificate := range certificatesToRenew {
+		if ctx.Err() != nil {
+			log.Warn("Shutdown asked, the cycle stops before [", certificate.Config.Name, "].")
+			return
+		}
+		err := CertManager.renewCertificate(ctx, certificate, certificate.isRevoked())
+		CertManager.recordRenewal(certificate.Probes, err)
+		CertManager.recordRenewalStatus(certificate.Probes, err)
 		if err != nil {
-			if err := CertManager.sendToRecipientsByCategories(
-				"["+site.GetConfig().URL+"] "+"Error: "+err.Error()+";",
-				"ERROR"); err != nil {
-				log.Error(err.Error())
-			}
+			CertManager.sendToRecipientsByCategories(ctx,
+				"["+certificate.Config.Name+"] "+"Error: "+err.Error()+";",
+				CategoryError)
 		}
 	}
 }
 
-// Method who receive a site in parameter and set the DNS Provider to accomplish the
-// Let's Encrypt challenge receive the new Certificate.
-// After that, we will update the certificate and reload it by SSH.
-func (CertManager *CertManager) Renew(site fetcher.SiteCertProber) error {
-	// Find the DNS Server of the site given.
-	DNSServer, err := CertManager.GetDNSProviderForSite(site.GetConfig().URL)
-	if err != nil {
+// Renew the certificate probed by the site, with every other site probing it.
+// A site only monitored has no certificate to renew.
+func (CertManager *CertManager) Renew(ctx context.Context, site fetcher.SiteCertProber) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	// Set the DNS Provider, let's encrypt challenge.
-	if err := CertManager.LetsEncrypt.SetDNSProvider(dns.DNSProvider{DNSServer: DNSServer}); err != nil {
-		return err
-	}
-	if err := CertManager.LetsEncrypt.AskCertificate(site.GetConfig().URL); err != nil {
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
 		return err
 	}
-	// Use the certificate for the correct server.
-	for _, CertificateUpdater := range CertManager.CertificateUpdaters {
-		if CertificateUpdater.GetName() == site.GetConfig().Server {
-			if err := CertificateUpdater.UpdateCertificate(site); err != nil {
-				return err
-			}
-			if err := CertificateUpdater.ReloadHTTPServer(); err != nil {
-				return err
+	return CertManager.RenewCertificate(ctx, certificate)
+}
+
+// Alert on the sites only monitored whose certificate expires soon, nobody else renews it here.
+// A site that can't be probed has no certificate to alert on, its probe metric is failing.
+func (CertManager *CertManager) alertExpiringSites(ctx context.Context) {
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			if site.GetConfig().IsManaged() || site.GetCertificate() == nil || site.DaysLeft() > DaysLimitToAlert {
+				continue
 			}
+			CertManager.sendToRecipientsByCategories(ctx,
+				"["+site.GetConfig().URL+"] "+"Certificate issued by "+site.GetCertificate().Issuer.CommonName+
+					" expires in "+strconv.Itoa(site.DaysLeft())+" days, it isn't renewed by the manager;",
+				CategoryExpiring)
 		}
 	}
-	if err := CertManager.sendToRecipientsByCategories(
-		"["+site.GetConfig().URL+"] "+"New certificate upload;",
-		"RENEW"); err != nil {
-		return err
-	}
-	return nil
 }
 
 // Find the authoritative DNS Server for the given site.
@@ -149,116 +245,198 @@ func (CertManager *CertManager) GetDNSProviderForSite(siteURL string) (dns.DNSSe
 	return nil, errors.New("Didn't found it's DNS server")
 }
 
-func (CertManager *CertManager) sendToRecipientsByCategories(msg string, renewOrError string) error {
+// Send the message to every recipient registered for the category.
+// A failing notifier never stops the others, undelivered messages are spooled.
+func (CertManager *CertManager) sendToRecipientsByCategories(ctx context.Context, msg string, renewOrError string) {
 	// Parse recipients of the configuration file
 	for _, recipient := range CertManager.Config.Recipients {
 		for _, recipientCategories := range recipient.Categories {
 			// Find the recipients categories match
 			if renewOrError == recipientCategories {
 				// Retrieve the notifier
-				if err := CertManager.parseAllNotifiers(recipient, msg, renewOrError); err != nil {
-					return err
-				}
+				CertManager.parseAllNotifiers(ctx, recipient, msg, renewOrError)
+			}
+		}
+	}
+}
+
+// Send the message once to every recipient subscribed to one of the categories,
+// with the first of them it is subscribed to.
+func (CertManager *CertManager) sendToRecipientsOfCategories(ctx context.Context, msg string, categories ...string) {
+	for _, recipient := range CertManager.Config.Recipients {
+		for _, category := range categories {
+			if recipient.hasCategory(category) {
+				CertManager.parseAllNotifiers(ctx, recipient, msg, category)
+				break
 			}
 		}
 	}
-	return nil
 }
 
 // Receives recipients with the message.
 // Parse all of them and check with one is corresponding.
-func (CertManager *CertManager) parseAllNotifiers(recipient RecipientConfig, msg string, renewOrError string) error {
+func (CertManager *CertManager) parseAllNotifiers(ctx context.Context, recipient RecipientConfig, msg string, renewOrError string) {
 	for _, notifier := range CertManager.Notifiers {
 		// If the recipient match with the current notifier
 		if strings.EqualFold(notifier.GetName(), recipient.Notifier) {
-			if err := sendToAllRecipients(recipient, notifier, msg, renewOrError); err != nil {
-				return err
-			}
+			CertManager.sendToAllRecipients(ctx, recipient, notifier, msg, renewOrError)
 		}
 	}
-	return nil
 }
 
 // Receives recipients, the type of notification with the message and it type.
 // With all these information, the methods will parse every recipient and Send the message.
-func sendToAllRecipients(recipient RecipientConfig, notifier notification_service.Notifier, msg string, renewOrError string) error {
+// Each destination is tried on its own, if it still fails after the retries the message is spooled.
+func (CertManager *CertManager) sendToAllRecipients(ctx context.Context, recipient RecipientConfig, notifier notification_service.Notifier, msg string, renewOrError string) {
 	// Parse all the recipients to send the message.
 	for _, dest := range recipient.Dest {
-		typeOfSend, err := notifier.SendMessage(msg, dest)
-		if err != nil {
-			return err
+		if err := CertManager.sendWithRetries(ctx, notifier, msg, dest, renewOrError); err != nil {
+			log.Error("[", notifier.GetName(), "] Can't send the message to ", dest, ": ", err.Error())
+			CertManager.recordNotificationFailure(notifier.GetName())
+			CertManager.spoolMessage(SpooledMessage{
+				Notifier: notifier.GetName(),
+				Dest:     dest,
+				Msg:      msg,
+				Category: renewOrError,
+			})
 		}
-		// Log what's going on
-		if renewOrError == "ERROR" {
-			log.Error(msg, " ", typeOfSend+" to ", dest)
-		} else {
-			log.Info(msg, " ", typeOfSend+" to ", dest)
+	}
+}
+
+// Try to send the message, and retry as many times as the configuration allows it.
+// Once the context is cancelled there is no more retry, the message goes to the spool.
+func (CertManager *CertManager) sendWithRetries(ctx context.Context, notifier notification_service.Notifier, msg string, dest string, renewOrError string) error {
+	var err error
+	for attempt := 0; attempt <= CertManager.Config.Notification.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(CertManager.Config.Notification.RetryDelaySec) * time.Second):
+			}
+		}
+		var typeOfSend string
+		typeOfSend, err = notifier.SendMessage(msg, dest)
+		if err == nil {
+			// Log what's going on
+			if renewOrError == CategoryError {
+				log.Error(msg, " ", typeOfSend+" to ", dest)
+			} else if renewOrError == CategoryExpiring {
+				log.Warn(msg, " ", typeOfSend+" to ", dest)
+			} else {
+				log.Info(msg, " ", typeOfSend+" to ", dest)
+			}
+			return nil
 		}
 	}
-	return nil
+	return err
+}
+
+// Return the renewal policy of the site: its own, or the global one.
+func (CertManager *CertManager) renewalPolicy(site fetcher.SiteCertProber) certificates.RenewalPolicy {
+	return CertManager.Config.Renewal.Merge(site.GetConfig().Renewal)
+}
+
+// Return true if the policy of the site renews its certificate before the given time.
+func (CertManager *CertManager) isDueBefore(site fetcher.SiteCertProber, before time.Time) bool {
+	return CertManager.renewalPolicy(site).IsDueBefore(site.GetCertificate(), before)
+}
+
+// Return true if the certificate must be renewed now for one of its probes,
+// if the CA asks for it, if it is revoked, or if the certificate issued misses a name.
+func (CertManager *CertManager) isCertificateDue(certificate *ManagedCertificate) bool {
+	if CertManager.isDueByCA(certificate) || certificate.isRevoked() {
+		return true
+	}
+	for _, probe := range certificate.Probes {
+		if CertManager.isDueBefore(probe, time.Now()) {
+			return true
+		}
+	}
+	return CertManager.lacksName(certificate)
 }
 
 // Get a domain and a number of days,
-// and return the amount of certificates that need to be renewed before the given day's.
+// and return the amount of certificates that need to be renewed before the given day's, 0 for the ones due now.
+// The sites of a shared certificate count once, the sites only monitored don't count.
 func (CertManager *CertManager) GetSitesQtyToRenewBefore(days int, domain fetcher.SitesPerDomain) int {
-	var SitesToRenewThisWeek int
+	orders := make(map[string]bool)
+	before := time.Now().Add(time.Duration(days) * 24 * time.Hour)
 	for _, site := range domain.Sites {
-		if site.DaysLeft() <= days {
-			SitesToRenewThisWeek += 1
+		if site.GetConfig().IsManaged() && CertManager.isDueBefore(site, before) {
+			orders[orderKey(site)] = true
 		}
 	}
-	return SitesToRenewThisWeek
+	return len(orders)
 }
 
 // Get a domain and a number of day's,
-// and return the amount of remaining queries in the next given day's.
+// and return the amount of remaining queries in the next given day's, at the CAs its certificates are ordered from:
+// the certificates issued during the last given day's, whatever their lifetime, used one at their CA.
 func (CertManager *CertManager) GetRemainingLEQueriesUntil(days int, domain fetcher.SitesPerDomain) int {
-	QueriesMAXForNexWeek := MaxRenewPerDomainPerWeek
-	for _, site := range domain.Sites {
-		if site.DaysLeft() > DaysAfterRenew-days {
-			QueriesMAXForNexWeek -= 1
+	remaining := 0
+	for _, ca := range CertManager.domainAuthorities(domain) {
+		if orders := CertManager.remainingOrders(ca, days, domain); orders > 0 {
+			remaining += orders
 		}
 	}
-	return QueriesMAXForNexWeek
+	return remaining
 }
 
-// Get an indexed list of sites for a specific domain and return only the sites to renew.
-// Only the sites that can be renewed in one shot (LE limit requests) will be returned.
-func (CertManager *CertManager) tookOfSitesToRenew(domain fetcher.SitesPerDomain) []fetcher.SiteCertProber {
-	siteToRenew := make([]fetcher.SiteCertProber, 0)
-	sitesUnder30DaysLeft := CertManager.GetSitesQtyToRenewBefore(30, domain)
-	availableQueries := CertManager.GetRemainingLEQueriesUntil(7, domain)
-	if sitesUnder30DaysLeft > CertManager.GetSitesQtyToRenewBefore(7, domain) {
+// Get an indexed list of sites for a specific domain and return only the certificates to renew,
+// decided with the worst of their probes.
+// Only the certificates that one of their CAs can still issue this week (rate limits) will be returned.
+func (CertManager *CertManager) tookOfCertificatesToRenew(domain fetcher.SitesPerDomain, managed map[string]*ManagedCertificate, orders map[string]bool) []*ManagedCertificate {
+	certificatesToRenew := make([]*ManagedCertificate, 0)
+	availableQueries := make(map[string]int)
+	for _, ca := range CertManager.authorities() {
+		availableQueries[ca.Name] = CertManager.remainingOrders(ca, RateLimitDays, domain)
+	}
+	if CertManager.GetSitesQtyToRenewBefore(0, domain) > CertManager.GetRemainingLEQueriesUntil(RateLimitDays, domain) {
 		log.Warn("For [", domain.Name, "]; only the most dangerous sites will be renew.")
 	}
-	queriesToPerform := 0
-	for _, site := range domain.Sites {
-		if queriesToPerform >= availableQueries {
-			return siteToRenew
+	for _, site := range revokedFirst(domain.Sites) {
+		certificate, ok := managed[orderKey(site)]
+		if !ok || orders[orderKey(site)] {
+			continue
 		}
-		if site.DaysLeft() <= DaysLimitToRenew {
-			siteToRenew = append(siteToRenew, site)
-			queriesToPerform += 1
+		// A certificate waiting for its deployment window is already renewed.
+		// A certificate missing a name of one of its sites is issued again with every name.
+		// The queries of the first CA with enough left are taken, one for each variant,
+		// the renewal may still fall back to another one.
+		if CertManager.isCertificateDue(certificate) && !CertManager.hasPendingDeployment(certificate.Config.Name) {
+			variants := len(certificate.Config.Variants())
+			for _, ca := range CertManager.caOrder(certificate.Config) {
+				if availableQueries[ca.Name] >= variants {
+					availableQueries[ca.Name] -= variants
+					orders[orderKey(site)] = true
+					certificatesToRenew = append(certificatesToRenew, certificate)
+					break
+				}
+			}
+			if !orders[orderKey(site)] {
+				log.Warn("[", certificate.Config.Name, "] No CA can issue it this week for [", domain.Name, "].")
+			}
 		}
 	}
-	return siteToRenew
+	return certificatesToRenew
 }
 
 // Discard a domain if it doesn't respect the Let's Encrypt rate limits.
 //
-// No more than 200 sites per domain.
-// No more than 50 site with a certificate days left less than 7.
+// No more than 200 sites due per domain.
+// No more than 50 sites to renew this week, decided with the renewal policies.
 // No more site to renew this week than queries left for this domain.
 func (CertManager *CertManager) discardNonRenewableDomains() {
 	indexedSitesCopies := CertManager.IndexedSites
 	for index, domain := range indexedSitesCopies {
-		if CertManager.GetSitesQtyToRenewBefore(30, domain) > MaxSitesPerDomain {
+		if CertManager.GetSitesQtyToRenewBefore(0, domain) > MaxSitesPerDomain {
 			indexedSitesCopies = append(indexedSitesCopies[:index], indexedSitesCopies[index+1:]...)
 			log.Error("Discard [", domain.Name, "]; Number of site for this domains > 200: 'https://letsencrypt.org/docs/rate-limits/'")
-		} else if CertManager.GetSitesQtyToRenewBefore(7, domain) > MaxRenewPerDomainPerWeek {
+		} else if CertManager.GetSitesQtyToRenewBefore(RateLimitDays, domain) > MaxRenewPerDomainPerWeek {
 			indexedSitesCopies = append(indexedSitesCopies[:index], indexedSitesCopies[index+1:]...)
 			log.Error("Discard [", domain.Name, "]; Number of site to renew in a week for this domains > 50: 'https://letsencrypt.org/docs/rate-limits/' ")
-		} else if CertManager.GetRemainingLEQueriesUntil(7, domain) < CertManager.GetSitesQtyToRenewBefore(7, domain) {
+		} else if CertManager.GetRemainingLEQueriesUntil(RateLimitDays, domain) < CertManager.GetSitesQtyToRenewBefore(RateLimitDays, domain) {
 			indexedSitesCopies = append(indexedSitesCopies[:index], indexedSitesCopies[index+1:]...)
 			log.Error("Discard [", domain.Name, "]; Number of site to renew in a week for this domains > queries week left: 'https://letsencrypt.org/docs/rate-limits/'")
 		}
@@ -266,24 +444,36 @@ func (CertManager *CertManager) discardNonRenewableDomains() {
 	CertManager.IndexedSites = indexedSitesCopies
 }
 
-// Receives the indexed domains and return an array with only the sites which need to be renew.
-func (CertManager *CertManager) GetSitesToRenew() []fetcher.SiteCertProber {
-	siteToRenew := make([]fetcher.SiteCertProber, 0)
+// Receives the indexed domains and return an array with only the certificates which need to be renew.
+func (CertManager *CertManager) GetCertificatesToRenew() []*ManagedCertificate {
+	certificatesToRenew := make([]*ManagedCertificate, 0)
 	CertManager.discardNonRenewableDomains()
+	managed := make(map[string]*ManagedCertificate)
+	for _, certificate := range CertManager.managedCertificates() {
+		managed[orderKey(certificate.Probes[0])] = certificate
+	}
+	orders := make(map[string]bool)
 	for _, domain := range CertManager.IndexedSites {
-		siteToRenew = append(siteToRenew, CertManager.tookOfSitesToRenew(domain)...)
+		certificatesToRenew = append(certificatesToRenew, CertManager.tookOfCertificatesToRenew(domain, managed, orders)...)
+	}
+	return certificatesToRenew
+}
+
+// Return the first site probing each certificate to renew.
+func (CertManager *CertManager) GetSitesToRenew() []fetcher.SiteCertProber {
+	siteToRenew := make([]fetcher.SiteCertProber, 0)
+	for _, certificate := range CertManager.GetCertificatesToRenew() {
+		siteToRenew = append(siteToRenew, certificate.Probes[0])
 	}
 	return siteToRenew
 }
 
 // Force a renew for a specific site_cert_prober.SiteCertProber (regardless of its actual day's left)
 // and send a message by rocket or mail concerning the result of the renewal.
-func (CertManager *CertManager) ForceRenewForSite(siteCertificate fetcher.SiteCertProber) error {
-	if err := CertManager.Renew(siteCertificate); err != nil {
-		return err
-	}
-	if err := CertManager.sendToRecipientsByCategories("["+siteCertificate.GetConfig().URL+"] "+"Force Renew;", "RENEW"); err != nil {
+func (CertManager *CertManager) ForceRenewForSite(ctx context.Context, siteCertificate fetcher.SiteCertProber) error {
+	if err := CertManager.Renew(ctx, siteCertificate); err != nil {
 		return err
 	}
+	CertManager.sendToRecipientsByCategories(ctx, "["+siteCertificate.GetConfig().URL+"] "+"Force Renew;", CategoryRenew)
 	return nil
 }
@@ -1,14 +1,36 @@
 package manager
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"github.com/DumesnyJeremy/lets-encrypt"
 	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
 	"github.com/DumesnyJeremy/notification-service"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/registration"
 	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari/aritest"
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
 	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/metrics"
 	"github.com/DumesnyJeremy/certificate-manager/manager/updater"
 )
 
@@ -30,13 +52,16 @@ func (_m *ClientMock) GetConfig() fetcher.CertificateFetchConfig {
 func (_m *ClientMock) IsSiteValid() bool {
 	return true
 }
-func (_m *ClientMock) Refresh() error {
+func (_m *ClientMock) Refresh(ctx context.Context) error {
 	return nil
 }
 func (_m *ClientMock) GetDomain() string {
 	return ""
 }
-func (_m *ClientMock) RefreshCertifAndGetDaysLeft() (int, error) {
+func (_m *ClientMock) GetCertificate() *x509.Certificate {
+	return &x509.Certificate{NotBefore: time.Now().Add(-61 * 24 * time.Hour), NotAfter: time.Now().Add(30 * 24 * time.Hour)}
+}
+func (_m *ClientMock) RefreshCertifAndGetDaysLeft(ctx context.Context) (int, error) {
 	return RefreshCertifAndSendDayLeftMocked()
 }
 
@@ -74,6 +99,7 @@ func TestInitCertManager(t *testing.T) {
 		[]notification_service.Notifier{},
 		[]dns.DNSServer{},
 		lets_encrypt.LetsEncrypt{},
+		[]CA{},
 		"test")
 }
 
@@ -97,7 +123,7 @@ func TestSuccessForceRenew(t *testing.T) {
 	RefreshCertifAndSendDayLeftMocked = func() (int, error) {
 		return 50, nil
 	}
-	if err := CertManager.ForceRenewForSite(sitesToRenew[0]); err == nil {
+	if err := CertManager.ForceRenewForSite(context.Background(), sitesToRenew[0]); err == nil {
 		t.Error("Error: ", err)
 	}
 }
@@ -122,7 +148,7 @@ func TestSendMessageErrorTriggerAlertForSite(t *testing.T) {
 	RefreshCertifAndSendDayLeftMocked = func() (int, error) {
 		return 50, nil
 	}
-	if err := CertManager.ForceRenewForSite(sitesToRenew[0]); err == nil {
+	if err := CertManager.ForceRenewForSite(context.Background(), sitesToRenew[0]); err == nil {
 		t.Error("Error: ", err)
 	}
 }
@@ -136,7 +162,7 @@ func TestSuccessFailTriggerAlertForSite(t *testing.T) {
 	RefreshCertifAndSendDayLeftMocked = func() (int, error) {
 		return 50, errors.New("Forced error")
 	}
-	if err := CertManager.ForceRenewForSite(sitesToRenew[0]); err == nil {
+	if err := CertManager.ForceRenewForSite(context.Background(), sitesToRenew[0]); err == nil {
 		t.Error("Error: ", err)
 	}
 }
@@ -150,7 +176,7 @@ func TestFailTriggerAlertForSite(t *testing.T) {
 		return 50, errors.New("Forced error")
 	}
 	sitesToRenew := CertManager.GetSitesToRenew()
-	if err := CertManager.ForceRenewForSite(sitesToRenew[0]); err == nil {
+	if err := CertManager.ForceRenewForSite(context.Background(), sitesToRenew[0]); err == nil {
 		t.Error("Error: ", err)
 	}
 }
@@ -174,7 +200,7 @@ func TestCheckRenewReturnRenew(t *testing.T) {
 
 		CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
 		sitesToRenew := CertManager.GetSitesToRenew()
-		if err := CertManager.Renew(sitesToRenew[0]); err == nil {
+		if err := CertManager.Renew(context.Background(), sitesToRenew[0]); err == nil {
 			t.Error("Error: ", err)
 		}
 	}
@@ -199,7 +225,7 @@ func TestCheckRenewReturnHigh(t *testing.T) {
 
 		CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
 		sitesToRenew := CertManager.GetSitesToRenew()
-		if err := CertManager.Renew(sitesToRenew[0]); err == nil {
+		if err := CertManager.Renew(context.Background(), sitesToRenew[0]); err == nil {
 			t.Error("Error: ", err)
 		}
 	}
@@ -224,7 +250,7 @@ func TestSuccessCheckRenew(t *testing.T) {
 
 		CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
 		sitesToRenew := CertManager.GetSitesToRenew()
-		if err := CertManager.Renew(sitesToRenew[0]); err == nil {
+		if err := CertManager.Renew(context.Background(), sitesToRenew[0]); err == nil {
 			t.Error("Error: ", err)
 		}
 	}
@@ -248,5 +274,804 @@ func TestParseSites(t *testing.T) {
 	},
 		Notifiers: []notification_service.Notifier{tmp}}
 	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
-	CertManager.ParseSites()
+	CertManager.ParseSites(context.Background())
+}
+
+func TestNotifierFailureIsSpooledAndFlushed(t *testing.T) {
+	SendMessageMocked = func() (string, error) {
+		return "", errors.New("Fake error.")
+	}
+	spoolPath, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolPath)
+	tmp := new(Notif)
+	CertManager := CertManager{Config: CertManagerConfig{
+		Recipients: []RecipientConfig{{
+			Notifier:   "Rocket",
+			Categories: []string{"RENEW"},
+			Dest:       []string{"toto", "titi"},
+		}},
+		Notification: NotificationConfig{Retries: 1, SpoolPath: spoolPath},
+	},
+		Notifiers: []notification_service.Notifier{tmp}}
+	CertManager.sendToRecipientsByCategories(context.Background(), "[1.serv.io] New certificate upload;", "RENEW")
+	spooled, _ := ioutil.ReadDir(CertManager.Config.Notification.SpoolPath)
+	if len(spooled) != 2 {
+		t.Fatal("Expected one spooled message per recipient, got: ", len(spooled))
+	}
+
+	SendMessageMocked = func() (string, error) {
+		return "Rocket", nil
+	}
+	CertManager.FlushSpool(context.Background())
+	spooled, _ = ioutil.ReadDir(CertManager.Config.Notification.SpoolPath)
+	if len(spooled) != 0 {
+		t.Error("Expected an empty spool, got: ", len(spooled))
+	}
+}
+
+func TestParseSitesRecordsMetrics(t *testing.T) {
+	CertManager := CertManager{Metrics: metrics.NewRegistry()}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(FakeSitesCertificates(1, 20))
+	CertManager.ParseSites(context.Background())
+	if value, ok := CertManager.Metrics.Value(MetricSiteProbeSuccess, metrics.Labels{"site": "1.serv.io", "domain": ""}); !ok || value != 1 {
+		t.Error("Expected a successful probe, got: ", value)
+	}
+	if value, ok := CertManager.Metrics.Value(MetricDomainRenewalFailures, metrics.Labels{"domain": ""}); !ok || value != 1 {
+		t.Error("Expected one renewal failure, got: ", value)
+	}
+	if !bytes.Contains(CertManager.Metrics.Expose(), []byte("# TYPE "+MetricDomainRemainingLE+" gauge")) {
+		t.Error("Remaining Let's Encrypt queries not exposed.")
+	}
+}
+
+type UpdaterMock struct {
+	Name    string // "Test server" when empty.
+	Windows []string
+	Updated int
+	Err     error
+}
+
+func (updater *UpdaterMock) UpdateCertificate(ctx context.Context, deployment certificate_updater.Deployment) error {
+	updater.Updated += 1
+	return updater.Err
+}
+func (updater *UpdaterMock) ReloadHTTPServer(ctx context.Context) error {
+	return nil
+}
+func (updater *UpdaterMock) GetName() string {
+	if updater.Name != "" {
+		return updater.Name
+	}
+	return "Test server"
+}
+func (updater *UpdaterMock) GetConfig() certificate_updater.CertificateUpdateConfig {
+	return certificate_updater.CertificateUpdateConfig{Name: updater.GetName(), Windows: updater.Windows}
+}
+
+func TestDeployGoesOnAfterAFailingUpdater(t *testing.T) {
+	shared := &certificates.Config{
+		Name:   "wildcard",
+		Names:  []string{"*.serv.io"},
+		Deploy: []certificates.Target{{Server: "Test server"}, {Server: "Backup server"}},
+	}
+	site := &SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Certificate: "wildcard", Shared: shared}}
+	failing := &UpdaterMock{Err: errors.New("connection refused")}
+	backup := &UpdaterMock{Name: "Backup server"}
+	CertManager := CertManager{CertificateUpdaters: []certificate_updater.CertificateUpdater{failing, backup}}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CertManager.Deploy(context.Background(), certificate)
+	if err == nil || !strings.Contains(err.Error(), "Test server: connection refused") {
+		t.Error("Expected the failure of the first updater, got ", err)
+	}
+	if backup.Updated != 1 {
+		t.Error("Expected the second updater to be deployed, got ", backup.Updated, " deployment")
+	}
+}
+
+func TestDeployOutsideOfWindowIsDeferred(t *testing.T) {
+	// A window that is never open: the 31st of February.
+	updater := &UpdaterMock{Windows: []string{"* * 31 2 *"}}
+	CertManager := CertManager{CertificateUpdaters: []certificate_updater.CertificateUpdater{updater}}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(FakeSitesCertificates(1, 20))
+	certificate, err := CertManager.certificateOf(CertManager.FindSite("1.serv.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CertManager.Deploy(context.Background(), certificate); err != nil {
+		t.Fatal(err)
+	}
+	if updater.Updated != 0 || !CertManager.hasPendingDeployment("1.serv.io") {
+		t.Fatal("Expected the deployment to wait for the window.")
+	}
+	if len(CertManager.GetSitesToRenew()) != 0 {
+		t.Error("A site waiting for its deployment shouldn't be renewed again.")
+	}
+	job := &Job{Type: JobRedeploy, Target: "1.serv.io"}
+	CertManager.runJob(context.Background(), job)
+	if job.Status != JobDeferred {
+		t.Error("Expected ", JobDeferred, " got ", job.Status)
+	}
+
+	updater.Windows = []string{"* 3-5 * * *"}
+	now := time.Now()
+	opening := CertManager.NextPendingDeployment(now)
+	if opening.Hour() != 3 || opening.Minute() != 0 || !opening.After(now) {
+		t.Error("Expected the daemon to wake up at the next opening, 03:00, got ", opening)
+	}
+
+	updater.Windows = nil
+	CertManager.deployPendingCertificates(context.Background())
+	if updater.Updated != 1 || CertManager.hasPendingDeployment("1.serv.io") {
+		t.Error("Expected the pending deployment to be done once the window is open.")
+	}
+}
+
+func TestNothingStartsAfterShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	CertManager := CertManager{}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(FakeSitesCertificates(1, 20))
+	if err := CertManager.Renew(ctx, CertManager.FindSite("1.serv.io")); err != context.Canceled {
+		t.Error("Expected the renewal to be cancelled, got: ", err)
+	}
+	CertManager.ParseSites(ctx)
+	if status := CertManager.Status(); status.Failed != 0 || status.Renewed != 0 {
+		t.Error("Expected no renewal once the shutdown is asked, got: ", status)
+	}
+}
+
+type DNSServerMock struct {
+	Zone    string
+	Records []string
+}
+
+func (server *DNSServerMock) IsAuthoritativeForDomain(domain string) bool {
+	return domain == server.Zone || strings.HasSuffix(domain, "."+server.Zone)
+}
+func (server *DNSServerMock) GetConfig() dns.DNSServerConfig {
+	return dns.DNSServerConfig{Name: server.Zone}
+}
+func (server *DNSServerMock) AddTXTRecord(domain, name, value string) error {
+	server.Records = append(server.Records, name)
+	return nil
+}
+func (server *DNSServerMock) CleanTXTRecord(domain, name string) error {
+	return nil
+}
+
+func TestChallengesOfEveryNameGoToTheirDNSServer(t *testing.T) {
+	exampleCom := &DNSServerMock{Zone: "example.com"}
+	exampleOrg := &DNSServerMock{Zone: "example.org"}
+	CertManager := CertManager{DNSServers: []dns.DNSServer{exampleCom, exampleOrg}}
+	DNSServer, err := CertManager.dnsServerForNames([]string{"www.example.com", "example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = DNSServer.AddTXTRecord("www.example.com", "_acme-challenge.www.example.com.", "a")
+	_ = DNSServer.AddTXTRecord("example.org", "_acme-challenge.example.org.", "b")
+	if len(exampleCom.Records) != 1 || len(exampleOrg.Records) != 1 {
+		t.Error("Each record must go to its zone: ", exampleCom.Records, exampleOrg.Records)
+	}
+	if _, err := CertManager.dnsServerForNames([]string{"www.example.com", "example.net"}); err == nil {
+		t.Error("Expected an error for a name without DNS server")
+	}
+}
+
+type SharedClientMock struct {
+	ClientMock
+	Config fetcher.CertificateFetchConfig
+	Days   int
+}
+
+func (_m *SharedClientMock) GetConfig() fetcher.CertificateFetchConfig {
+	return _m.Config
+}
+func (_m *SharedClientMock) DaysLeft() int {
+	return _m.Days
+}
+
+// A 90 days certificate with Days left.
+func (_m *SharedClientMock) GetCertificate() *x509.Certificate {
+	notAfter := time.Now().Add(time.Duration(_m.Days)*24*time.Hour - time.Minute)
+	return &x509.Certificate{NotBefore: notAfter.Add(-90 * 24 * time.Hour), NotAfter: notAfter}
+}
+
+func TestSharedCertificateIsRenewedOnce(t *testing.T) {
+	shared := &certificates.Config{Name: "wildcard", Names: []string{"*.serv.io"}}
+	sites := make([]fetcher.SiteCertProber, 0)
+	for _, URL := range []string{"1.serv.io", "2.serv.io", "3.serv.io"} {
+		sites = append(sites, &SharedClientMock{Days: 30, Config: fetcher.CertificateFetchConfig{
+			Server: "Test server", URL: URL, Port: 443, Certificate: "wildcard", Shared: shared,
+		}})
+	}
+	sites = append(sites, &SharedClientMock{Days: 30, Config: fetcher.CertificateFetchConfig{URL: "4.serv.io", Port: 443}})
+	sites = append(sites, FakeSiteCertificate())
+	CertManager := CertManager{}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	if toRenew := CertManager.GetSitesToRenew(); len(toRenew) != 2 {
+		t.Error("Expected one renewal for the shared certificate and one for the site, got ", len(toRenew))
+	}
+	certificate, err := CertManager.certificateOf(sites[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificate.Probes) != 3 || len(certificate.Targets) != 1 {
+		t.Error("Expected ", 3, " probes and ", 1, " target got ", len(certificate.Probes), " and ", len(certificate.Targets))
+	}
+	if _, err := CertManager.certificateOf(sites[3]); err == nil {
+		t.Error("Expected no certificate for a site only monitored")
+	}
+	if remaining := CertManager.GetRemainingLEQueriesUntil(RateLimitDays, CertManager.IndexedSites[0]); remaining != MaxRenewPerDomainPerWeek {
+		t.Error("Expected ", MaxRenewPerDomainPerWeek, " got ", remaining)
+	}
+}
+
+func TestCertificateIsRenewedForItsWorstProbe(t *testing.T) {
+	shared := &certificates.Config{
+		Name:   "wildcard",
+		Names:  []string{"*.serv.io"},
+		Deploy: []certificates.Target{{Server: "Test server"}},
+	}
+	sites := []fetcher.SiteCertProber{
+		&SharedClientMock{Days: 80, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Certificate: "wildcard", Shared: shared}},
+		&SharedClientMock{Days: 80, Config: fetcher.CertificateFetchConfig{URL: "2.serv.io", Certificate: "wildcard", Shared: shared}},
+	}
+	CertManager := CertManager{}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 0 {
+		t.Error("Expected ", 0, " got ", len(toRenew))
+	}
+	// One server still serves the previous certificate.
+	sites[1].(*SharedClientMock).Days = 10
+	toRenew := CertManager.GetCertificatesToRenew()
+	if len(toRenew) != 1 || toRenew[0].DaysLeft() != 10 {
+		t.Fatal("Expected the certificate to be renewed for its worst probe, got ", toRenew)
+	}
+
+	updater := &UpdaterMock{}
+	CertManager.CertificateUpdaters = []certificate_updater.CertificateUpdater{updater}
+	if err := CertManager.Deploy(context.Background(), toRenew[0]); err != nil {
+		t.Fatal(err)
+	}
+	if updater.Updated != 1 {
+		t.Error("Expected ", 1, " deployment got ", updater.Updated)
+	}
+}
+
+type RecorderNotifier struct {
+	Messages []string
+}
+
+func (notifier *RecorderNotifier) SendMessage(msg string, dest string) (string, error) {
+	notifier.Messages = append(notifier.Messages, msg)
+	return "Recorder", nil
+}
+func (notifier *RecorderNotifier) GetName() string {
+	return "Recorder"
+}
+
+func TestMonitoredSitesAreAlertedNotRenewed(t *testing.T) {
+	sites := []fetcher.SiteCertProber{
+		&SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "vendor.serv.io", Mode: fetcher.ModeMonitor}},
+		&SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}},
+	}
+	recorder := &RecorderNotifier{}
+	CertManager := CertManager{
+		Config: CertManagerConfig{Recipients: []RecipientConfig{{
+			Notifier:   "Recorder",
+			Categories: []string{CategoryExpiring},
+			Dest:       []string{"@user"},
+		}}},
+		Notifiers: []notification_service.Notifier{recorder},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	toRenew := CertManager.GetSitesToRenew()
+	if len(toRenew) != 1 || toRenew[0].GetConfig().URL != "1.serv.io" {
+		t.Error("Expected only the managed site to be renewed, got ", toRenew)
+	}
+	if remaining := CertManager.GetRemainingLEQueriesUntil(RateLimitDays, CertManager.IndexedSites[0]); remaining != MaxRenewPerDomainPerWeek {
+		t.Error("Expected ", MaxRenewPerDomainPerWeek, " got ", remaining)
+	}
+	if err := CertManager.Renew(context.Background(), sites[0]); err == nil {
+		t.Error("Expected an error when renewing a site only monitored")
+	}
+	CertManager.alertExpiringSites(context.Background())
+	if len(recorder.Messages) != 1 || !strings.HasPrefix(recorder.Messages[0], "[vendor.serv.io]") {
+		t.Error("Expected one EXPIRING alert for the monitored site, got ", recorder.Messages)
+	}
+}
+
+func TestRenewalPolicyOverrides(t *testing.T) {
+	sites := []fetcher.SiteCertProber{
+		&SharedClientMock{Days: 50, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}},
+		&SharedClientMock{Days: 50, Config: fetcher.CertificateFetchConfig{URL: "2.serv.io", Server: "Test server",
+			Renewal: certificates.RenewalPolicy{DaysBefore: 60}}},
+	}
+	CertManager := CertManager{}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	if toRenew := CertManager.GetSitesToRenew(); len(toRenew) != 1 || toRenew[0].GetConfig().URL != "2.serv.io" {
+		t.Error("Expected only the site with its own policy to be renewed, got ", toRenew)
+	}
+	// Renewed after 40% of its lifetime, 54 days before its expiry.
+	CertManager.Config.Renewal = certificates.RenewalPolicy{RenewAt: 0.4}
+	if toRenew := CertManager.GetSitesToRenew(); len(toRenew) != 2 {
+		t.Error("Expected ", 2, " got ", len(toRenew))
+	}
+}
+
+type ServedCertificateMock struct {
+	SharedClientMock
+	Certificate *x509.Certificate
+}
+
+func (_m *ServedCertificateMock) GetCertificate() *x509.Certificate {
+	return _m.Certificate
+}
+
+func TestEarlyRenewalAskedByTheCA(t *testing.T) {
+	// 60 days left on a 90 days certificate, not due for the renewal policy.
+	notAfter := time.Now().Add(60 * 24 * time.Hour)
+	served := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			AuthorityKeyId: []byte{1, 2, 3},
+			SerialNumber:   big.NewInt(serial),
+			NotBefore:      notAfter.Add(-90 * 24 * time.Hour),
+			NotAfter:       notAfter,
+		}
+	}
+	sites := []fetcher.SiteCertProber{
+		&ServedCertificateMock{Certificate: served(1), SharedClientMock: SharedClientMock{Days: 60,
+			Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}}},
+		&ServedCertificateMock{Certificate: served(2), SharedClientMock: SharedClientMock{Days: 60,
+			Config: fetcher.CertificateFetchConfig{URL: "2.serv.io", Server: "Test server"}}},
+	}
+	revoked, _ := ari.CertID(sites[0].GetCertificate())
+	later, _ := ari.CertID(sites[1].GetCertificate())
+	windows := map[string]ari.Window{
+		revoked: {Start: time.Now().Add(-2 * time.Hour), End: time.Now().Add(-time.Hour)},
+		later:   {Start: notAfter.Add(-30 * 24 * time.Hour), End: notAfter.Add(-28 * 24 * time.Hour)},
+	}
+	server := aritest.NewServer(windows)
+	defer server.Close()
+
+	CertManager := CertManager{ARI: ari.NewClient(server.URL + "/directory")}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	if toRenew := CertManager.GetSitesToRenew(); len(toRenew) != 0 {
+		t.Error("Expected ", 0, " got ", len(toRenew))
+	}
+	CertManager.refreshRenewalWindows(context.Background())
+	toRenew := CertManager.GetSitesToRenew()
+	if len(toRenew) != 1 || toRenew[0].GetConfig().URL != "1.serv.io" {
+		t.Error("Expected the early renewal asked by the CA, got ", toRenew)
+	}
+}
+
+func TestRenewalFallsBackToAnotherCA(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	site := &SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}}
+	CertManager := CertManager{
+		ConfDirPath: confDir,
+		DNSServers:  []dns.DNSServer{&DNSServerMock{Zone: "serv.io"}},
+		CAs: []CA{
+			{Name: "primary", RateLimit: 1},
+			{Name: "staging", NoFallback: true},
+			{Name: "backup"},
+		},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	order := CertManager.caOrder(certificates.Config{CA: "backup"})
+	if len(order) != 2 || order[0].Name != "backup" || order[1].Name != "primary" {
+		t.Error("Expected the chosen CA, then the fallbacks, got ", order)
+	}
+	// The only order of the week at the primary CA is used, the backup one takes the renewal.
+	CertManager.recordOrder(CertManager.CAs[0], CertManager.IndexedSites[0].Name, "other", &x509.Certificate{SerialNumber: big.NewInt(1)})
+	if remaining := CertManager.remainingOrders(CertManager.CAs[0], RateLimitDays, CertManager.IndexedSites[0]); remaining != 0 {
+		t.Error("Expected ", 0, " got ", remaining)
+	}
+	// The CA without fallback isn't in the budget of the domain.
+	if remaining := CertManager.GetRemainingLEQueriesUntil(RateLimitDays, CertManager.IndexedSites[0]); remaining != MaxRenewPerDomainPerWeek {
+		t.Error("Expected ", MaxRenewPerDomainPerWeek, " got ", remaining)
+	}
+	toRenew := CertManager.GetCertificatesToRenew()
+	if len(toRenew) != 1 {
+		t.Fatal("Expected ", 1, " got ", len(toRenew))
+	}
+	err = CertManager.RenewCertificate(context.Background(), toRenew[0])
+	if err == nil || !strings.Contains(err.Error(), "primary: no orders left") || !strings.Contains(err.Error(), "[backup] isn't initialized") {
+		t.Error("Expected the failure of every CA, got ", err)
+	}
+	if strings.Contains(err.Error(), "staging") {
+		t.Error("A CA without fallback must only be used when chosen: ", err)
+	}
+	// The ledger is kept on disk.
+	CertManager.ordersLoaded = false
+	CertManager.orders = nil
+	if remaining := CertManager.remainingOrders(CertManager.CAs[0], RateLimitDays, CertManager.IndexedSites[0]); remaining != 0 {
+		t.Error("Expected ", 0, " got ", remaining)
+	}
+}
+
+type DomainClientMock struct {
+	SharedClientMock
+	Domain string
+}
+
+func (_m *DomainClientMock) GetDomain() string {
+	return _m.Domain
+}
+
+func TestDualCertificateTakesAnOrderPerVariant(t *testing.T) {
+	shared := &certificates.Config{Name: "dual", Names: []string{"www.serv.io"}, KeyType: "rsa2048", DualKeyType: "ec256"}
+	site := &SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "www.serv.io", Certificate: "dual", Shared: shared}}
+	CertManager := CertManager{CAs: []CA{{Name: "primary", RateLimit: 1}, {Name: "backup", RateLimit: 2}}}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 1 {
+		t.Fatal("Expected ", 1, " got ", len(toRenew))
+	}
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := CertManager.registeredDomains(certificate)
+	if exhausted := CertManager.exhaustedDomains(CertManager.CAs[0], domains, 2); len(exhausted) != len(domains) {
+		t.Error("Expected the primary CA without the ", 2, " orders of the variants, got ", exhausted)
+	}
+	if exhausted := CertManager.exhaustedDomains(CertManager.CAs[1], domains, 2); len(exhausted) != 0 {
+		t.Error("Expected the backup CA to take both variants, got ", exhausted)
+	}
+	// Without a CA taking both variants, it waits for the next week.
+	CertManager.CAs[1].RateLimit = 1
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 0 {
+		t.Error("Expected ", 0, " got ", len(toRenew))
+	}
+}
+
+func TestOrdersCountForEveryRegisteredDomain(t *testing.T) {
+	shared := &certificates.Config{Name: "multi", Names: []string{"www.serv.io", "*.example.com", "example.com"}}
+	site := &DomainClientMock{Domain: "serv.io", SharedClientMock: SharedClientMock{Days: 10,
+		Config: fetcher.CertificateFetchConfig{URL: "www.serv.io", Certificate: "multi", Shared: shared}}}
+	CertManager := CertManager{CAs: []CA{{Name: "primary", RateLimit: 1}}}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := CertManager.registeredDomains(certificate)
+	if len(domains) != 2 || domains[0].Name != "serv.io" || domains[1].Name != "example.com" {
+		t.Fatal("Expected serv.io and example.com, got ", domains)
+	}
+	CertManager.recordOrder(CertManager.CAs[0], "example.com", "multi", &x509.Certificate{SerialNumber: big.NewInt(1)})
+	if exhausted := CertManager.exhaustedDomains(CertManager.CAs[0], domains, 1); len(exhausted) != 1 || exhausted[0] != "example.com" {
+		t.Error("Expected ", []string{"example.com"}, " got ", exhausted)
+	}
+}
+
+func TestStagingFirstValidatesOnce(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	site := &SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{
+		URL: "1.serv.io", Server: "Test server", StagingFirst: true,
+	}}
+	CertManager := CertManager{
+		ConfDirPath: confDir,
+		DNSServers:  []dns.DNSServer{&DNSServerMock{Zone: "serv.io"}},
+		CAs: []CA{
+			{Name: "letsencrypt-staging"},
+			{Name: "letsencrypt", Staging: "letsencrypt-staging"},
+		},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	// The staging CA is neither the default one nor a fallback, even without no_fallback.
+	if order := CertManager.caOrder(certificates.Config{}); len(order) != 1 || order[0].Name != "letsencrypt" {
+		t.Error("Expected only the production CA, got ", order)
+	}
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is ordered in production while the staging validation fails.
+	err = CertManager.RenewCertificate(context.Background(), certificate)
+	if err == nil || !strings.Contains(err.Error(), "Validation on the staging CA [letsencrypt-staging] failed") {
+		t.Error("Expected the staging validation to fail, got ", err)
+	}
+	fingerprint, err := CertManager.stagingFingerprint(certificate.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CertManager.addStagingValidation(StagingValidation{Certificate: certificate.Config.Name, Fingerprint: fingerprint})
+	// Once validated, the renewals go to production directly, even after a restart.
+	CertManager.stagingLoaded = false
+	err = CertManager.RenewCertificate(context.Background(), certificate)
+	if err == nil || !strings.Contains(err.Error(), "No CA issued the certificate: letsencrypt:") || strings.Contains(err.Error(), "letsencrypt-staging:") {
+		t.Error("Expected the order in production only, got ", err)
+	}
+	// A new name is validated on staging again.
+	changed := certificate.Config
+	changed.Names = append([]string{"www.serv.io"}, changed.Names...)
+	if changedFingerprint, _ := CertManager.stagingFingerprint(changed); CertManager.isValidatedOnStaging(changed.Name, changedFingerprint) {
+		t.Error("Expected a new validation on staging after a change of the names")
+	}
+}
+
+func TestRevokeWithReasonAndReplacement(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	// A local ACME server only revoking the certificates.
+	reasons := make([]uint, 0)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"newNonce": server.URL + "/new-nonce", "newAccount": server.URL + "/new-account",
+				"newOrder": server.URL + "/new-order", "revokeCert": server.URL + "/revoke-cert",
+			})
+		case "/revoke-cert":
+			var request struct{ Payload string }
+			var revocation struct{ Reason uint }
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			payload, _ := base64.RawURLEncoding.DecodeString(request.Payload)
+			_ = json.Unmarshal(payload, &revocation)
+			reasons = append(reasons, revocation.Reason)
+		}
+	}))
+	defer server.Close()
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &SharedClientMock{Days: 60, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}}
+	recorder := &RecorderNotifier{}
+	CertManager := CertManager{
+		Config: CertManagerConfig{Recipients: []RecipientConfig{{
+			Notifier:   "Recorder",
+			Categories: []string{CategoryRenew},
+			Dest:       []string{"@user"},
+		}}},
+		Notifiers:   []notification_service.Notifier{recorder},
+		ConfDirPath: confDir,
+		DNSServers:  []dns.DNSServer{&DNSServerMock{Zone: "serv.io"}},
+		LetsEncrypt: lets_encrypt.LetsEncrypt{CertificatesRootPath: confDir},
+		CAs: []CA{{Name: "primary", DirectoryURL: server.URL + "/directory", LetsEncrypt: lets_encrypt.LetsEncrypt{
+			User: &lets_encrypt.LetsEncryptUser{
+				Email:        "example@example.com",
+				Registration: &registration.Resource{URI: server.URL + "/account/1"},
+				KeyPair:      accountKey,
+			},
+		}}},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	// The certificate issued, with its key, in the storage.
+	template := &x509.Certificate{SerialNumber: big.NewInt(0x3a17f), DNSNames: []string{"1.serv.io"}}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &accountKey.PublicKey, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateFile, privateKeyFile := certificates.Config{Name: "1.serv.io"}.Files(confDir)
+	if err := writeCertificateFiles(certificateFile, privateKeyFile, &certificate.Resource{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}),
+		PrivateKey:  []byte("compromised key"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CertManager.Revoke(context.Background(), "1.serv.io", "compromised", false); err == nil {
+		t.Error("Expected an unknown reason to be refused")
+	}
+	if err := CertManager.Revoke(context.Background(), "03:a1:80", "keyCompromise", false); err == nil {
+		t.Error("Expected an unknown serial to be refused")
+	}
+	if err := CertManager.Revoke(context.Background(), "03:a1:7f", "keyCompromise", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 1 || reasons[0] != 1 {
+		t.Error("Expected the reason ", 1, " got ", reasons)
+	}
+	if _, err := os.Stat(privateKeyFile); !os.IsNotExist(err) {
+		t.Error("Expected the compromised private key to be removed, got ", err)
+	}
+	if len(recorder.Messages) != 1 || !strings.Contains(recorder.Messages[0], "revoked (keyCompromise)") {
+		t.Error("Expected the revocation to be announced to the RENEW recipients, got ", recorder.Messages)
+	}
+	// The history is kept on disk.
+	CertManager.revocationsLoaded = false
+	revocations := CertManager.Revocations()
+	if len(revocations) != 1 || revocations[0].Serial != "237951" || revocations[0].CA != "primary" || revocations[0].Replaced {
+		t.Error("Expected the revocation of 237951 by primary got ", revocations)
+	}
+	// The replacement is ordered straight away.
+	err = CertManager.Revoke(context.Background(), "1.serv.io", "superseded", true)
+	if err == nil || !strings.Contains(err.Error(), "[primary] isn't initialized") {
+		t.Error("Expected the replacement to be ordered, got ", err)
+	}
+	if len(reasons) != 2 || reasons[1] != 4 {
+		t.Error("Expected the reason ", 4, " got ", reasons)
+	}
+}
+
+func TestLedgersAreMergedBetweenProcesses(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	// The daemon and a revoke command, each with the ledger it read.
+	daemon := CertManager{ConfDirPath: confDir, CAs: []CA{{Name: "primary"}, {Name: "backup"}}}
+	command := CertManager{ConfDirPath: confDir, CAs: []CA{{Name: "primary"}, {Name: "backup"}}}
+	daemon.getOrders()
+	daemon.getPendingDeployments()
+	// Issued before the retention of the rate limits, but still valid.
+	issued := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(50 * 24 * time.Hour)}
+	command.recordOrder(command.CAs[1], "serv.io", "1.serv.io", issued)
+	command.orders[0].Issued = time.Now().Add(-2 * OrdersRetention)
+	command.writeOrders()
+	command.addPendingDeployment(PendingDeployment{Certificate: "1.serv.io", Updater: "Test server", Issued: time.Now()})
+
+	daemon.recordOrder(daemon.CAs[0], "serv.io", "2.serv.io", &x509.Certificate{SerialNumber: big.NewInt(2)})
+	daemon.addPendingDeployment(PendingDeployment{Certificate: "2.serv.io", Updater: "Test server", Issued: time.Now()})
+	reader := CertManager{ConfDirPath: confDir}
+	if orders := reader.getOrders(); len(orders) != 2 {
+		t.Error("Expected the orders of both processes, got ", orders)
+	}
+	if pending := reader.getPendingDeployments(); len(pending) != 2 {
+		t.Error("Expected the pending deployments of both processes, got ", pending)
+	}
+	// The certificate is revoked at the CA which issued it, even after the retention.
+	daemon.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{
+		&SharedClientMock{Days: 50, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}},
+	})
+	if ca, err := daemon.issuerOf("1.serv.io", issued); err != nil || ca.Name != "backup" {
+		t.Error("Expected ", "backup", " got ", ca.Name, " ", err)
+	}
+}
+
+// A site whose certificate has an OCSP status.
+type OCSPClientMock struct {
+	SharedClientMock
+	OCSP fetcher.OCSPStatus
+}
+
+func (_m *OCSPClientMock) GetOCSPStatus() fetcher.OCSPStatus {
+	return _m.OCSP
+}
+
+func TestRevokedCertificateIsRenewedFirst(t *testing.T) {
+	sites := []fetcher.SiteCertProber{
+		&OCSPClientMock{
+			SharedClientMock: SharedClientMock{Days: 10, Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}},
+			OCSP:             fetcher.OCSPStatus{Status: fetcher.OCSPGood, Staple: fetcher.StapleMissing},
+		},
+		&OCSPClientMock{
+			SharedClientMock: SharedClientMock{Days: 60, Config: fetcher.CertificateFetchConfig{URL: "2.serv.io", Server: "Test server"}},
+			OCSP:             fetcher.OCSPStatus{Status: fetcher.OCSPRevoked, RevocationReason: 1, Staple: fetcher.StapleValid},
+		},
+	}
+	recorder := &RecorderNotifier{}
+	CertManager := CertManager{
+		Config: CertManagerConfig{Recipients: []RecipientConfig{{
+			Notifier:   "Recorder",
+			Categories: []string{CategoryError},
+			Dest:       []string{"@user"},
+		}}},
+		Notifiers: []notification_service.Notifier{recorder},
+		CAs:       []CA{{Name: "primary", RateLimit: 1}},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains(sites)
+	// The only order left goes to the revoked certificate, even far from its expiry.
+	toRenew := CertManager.GetSitesToRenew()
+	if len(toRenew) != 1 || toRenew[0].GetConfig().URL != "2.serv.io" {
+		t.Error("Expected the revoked site to be renewed first, got ", toRenew)
+	}
+	CertManager.alertOCSPStatus(context.Background())
+	if len(recorder.Messages) != 1 || !strings.HasPrefix(recorder.Messages[0], "[2.serv.io] Critical:") {
+		t.Error("Expected one critical alert for the revoked site, got ", recorder.Messages)
+	}
+	// The next cycles don't alert on it again.
+	CertManager.alertOCSPStatus(context.Background())
+	if len(recorder.Messages) != 1 {
+		t.Error("Expected ", 1, " alert got ", len(recorder.Messages))
+	}
+	if status := buildSiteStatus(sites[0]); status.OCSP == nil || status.OCSP.Staple != fetcher.StapleMissing {
+		t.Error("Expected the staple status in the site status, got ", status.OCSP)
+	}
+}
+
+// Write a certificate issued for the names in the storage of the certificate, and return it.
+func storeCertificate(t *testing.T, rootPath string, config certificates.Config, variant certificates.Variant, serial int64, names ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), DNSNames: names,
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour)}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateFile, privateKeyFile := config.VariantFiles(rootPath, variant)
+	if err := writeCertificateFiles(certificateFile, privateKeyFile, &certificate.Resource{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}),
+		PrivateKey:  []byte("key"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	issued, err := x509.ParseCertificate(certificateDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued
+}
+
+// A site checking the names of the certificate it serves.
+type CheckedClientMock struct {
+	ServedCertificateMock
+}
+
+func (_m *CheckedClientMock) IsSiteValid() bool {
+	return len(fetcher.MissingNames(_m.Certificate, _m.Config.GetNames())) == 0
+}
+
+func TestWrongDeploymentIsNotIssuedAgain(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+	// The server serves the certificate of another site, 60 days before its expiry.
+	other := &x509.Certificate{SerialNumber: big.NewInt(7), DNSNames: []string{"other.serv.io"},
+		NotBefore: time.Now().Add(-30 * 24 * time.Hour), NotAfter: time.Now().Add(60 * 24 * time.Hour)}
+	site := &CheckedClientMock{ServedCertificateMock{Certificate: other, SharedClientMock: SharedClientMock{Days: 60,
+		Config: fetcher.CertificateFetchConfig{URL: "1.serv.io", Server: "Test server"}}}}
+	recorder := &RecorderNotifier{}
+	CertManager := CertManager{
+		Config: CertManagerConfig{Recipients: []RecipientConfig{{
+			Notifier:   "Recorder",
+			Categories: []string{CategoryError},
+			Dest:       []string{"@user"},
+		}}},
+		Notifiers:   []notification_service.Notifier{recorder},
+		LetsEncrypt: lets_encrypt.LetsEncrypt{CertificatesRootPath: rootPath},
+	}
+	CertManager.IndexedSites = fetcher.IndexSitesPerDomains([]fetcher.SiteCertProber{site})
+	certificate, err := CertManager.certificateOf(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing issued yet: the certificate is issued for its names.
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 1 {
+		t.Error("Expected ", 1, " got ", len(toRenew))
+	}
+	// Once issued with every name, the wrong certificate served is a deployment error, alerted once.
+	storeCertificate(t, rootPath, certificate.Config, certificate.Config.Variants()[0], 1, "1.serv.io")
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 0 {
+		t.Error("Expected ", 0, " got ", len(toRenew))
+	}
+	CertManager.alertWrongDeployments(context.Background())
+	CertManager.alertWrongDeployments(context.Background())
+	if len(recorder.Messages) != 1 || !strings.Contains(recorder.Messages[0], "Deployment error: 1.serv.io") {
+		t.Error("Expected one deployment error, got ", recorder.Messages)
+	}
+	// A certificate issued without a name of the configuration is issued again.
+	storeCertificate(t, rootPath, certificate.Config, certificate.Config.Variants()[0], 2, "www.serv.io")
+	if toRenew := CertManager.GetCertificatesToRenew(); len(toRenew) != 1 {
+		t.Error("Expected ", 1, " got ", len(toRenew))
+	}
 }
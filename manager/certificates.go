@@ -0,0 +1,260 @@
+package manager
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// A certificate issued by the manager, with the sites probing it and the targets it is deployed to.
+// It is renewed as a whole, when the worst of its probes needs it.
+type ManagedCertificate struct {
+	Config  certificates.Config
+	Probes  []fetcher.SiteCertProber
+	Targets []certificates.Target
+}
+
+// Return the lowest days left of the probes.
+func (certificate *ManagedCertificate) DaysLeft() int {
+	daysLeft := 0
+	for i, probe := range certificate.Probes {
+		if i == 0 || probe.DaysLeft() < daysLeft {
+			daysLeft = probe.DaysLeft()
+		}
+	}
+	return daysLeft
+}
+
+// Return true if every probe is covered by the certificate it serves.
+func (certificate *ManagedCertificate) IsValid() bool {
+	for _, probe := range certificate.Probes {
+		if !probe.IsSiteValid() {
+			return false
+		}
+	}
+	return true
+}
+
+// Return true if a certificate issued lacks a name of the configuration, it must be issued again.
+// Before the first issuance, the certificates served by the probes are checked instead.
+// A probe serving a wrong certificate while the one issued is complete is a deployment error,
+// issuing it again wouldn't change anything: see alertWrongDeployments.
+func (CertManager *CertManager) lacksName(certificate *ManagedCertificate) bool {
+	for _, variant := range certificate.Config.Variants() {
+		certificateFile, _ := certificate.Config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+		_, issued, err := readIssued(certificateFile)
+		if err != nil {
+			return !certificate.IsValid()
+		}
+		if len(fetcher.MissingNames(issued, certificate.Config.Names)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert the ERROR recipients, once per certificate served, on the probes serving a certificate missing one of their
+// names while the one issued has all of them: its deployment failed, or a target is wrong.
+func (CertManager *CertManager) alertWrongDeployments(ctx context.Context) {
+	for _, certificate := range CertManager.managedCertificates() {
+		if CertManager.hasPendingDeployment(certificate.Config.Name) || CertManager.lacksName(certificate) {
+			continue
+		}
+		for _, probe := range certificate.Probes {
+			served := probe.GetCertificate()
+			if served == nil || probe.IsSiteValid() || !CertManager.firstAlert("deployment:"+probe.GetConfig().URL+":"+serialOf(served)) {
+				continue
+			}
+			CertManager.sendToRecipientsByCategories(ctx,
+				"["+certificate.Config.Name+"] "+"Deployment error: "+probe.GetConfig().URL+" serves the certificate "+
+					serialOf(served)+" missing some of its names, not the one issued;",
+				CategoryError)
+		}
+	}
+}
+
+// Return true the first time an alert is asked for the key, so it is only sent once while the daemon runs.
+func (CertManager *CertManager) firstAlert(key string) bool {
+	if CertManager.alerted == nil {
+		CertManager.alerted = make(map[string]bool)
+	}
+	if CertManager.alerted[key] {
+		return false
+	}
+	CertManager.alerted[key] = true
+	return true
+}
+
+// Return the targets deployed with the updater.
+func (certificate *ManagedCertificate) targetsOf(updaterName string) []certificates.Target {
+	targets := make([]certificates.Target, 0)
+	for _, target := range certificate.Targets {
+		if target.Server == updaterName {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+func (certificate *ManagedCertificate) addTarget(target certificates.Target) {
+	for _, existing := range certificate.Targets {
+		if existing == target {
+			return
+		}
+	}
+	certificate.Targets = append(certificate.Targets, target)
+}
+
+// Group the managed sites by the certificate they probe, in the order of the indexed sites.
+// A site of a shared certificate with its own updater adds a target to it.
+func (CertManager *CertManager) managedCertificates() []*ManagedCertificate {
+	managed := make([]*ManagedCertificate, 0)
+	byKey := make(map[string]*ManagedCertificate)
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			config, ok := site.GetConfig().GetCertificateConfig()
+			if !ok {
+				continue
+			}
+			certificate, ok := byKey[orderKey(site)]
+			if !ok {
+				certificate = &ManagedCertificate{Config: config}
+				for _, target := range config.Deploy {
+					certificate.addTarget(target)
+				}
+				byKey[orderKey(site)] = certificate
+				managed = append(managed, certificate)
+			}
+			certificate.Probes = append(certificate.Probes, site)
+			if site.GetConfig().Shared != nil && site.GetConfig().Server != "" {
+				certificate.addTarget(certificates.Target{Server: site.GetConfig().Server, Location: site.GetConfig().Location})
+			}
+		}
+	}
+	return managed
+}
+
+// Return the certificate probed by the site.
+func (CertManager *CertManager) certificateOf(site fetcher.SiteCertProber) (*ManagedCertificate, error) {
+	if !site.GetConfig().IsManaged() {
+		return nil, errors.New("[" + site.GetConfig().URL + "] is only monitored, no certificate is issued for it")
+	}
+	for _, certificate := range CertManager.managedCertificates() {
+		for _, probe := range certificate.Probes {
+			if probe.GetConfig().URL == site.GetConfig().URL {
+				return certificate, nil
+			}
+		}
+	}
+	return nil, errors.New("No certificate found for [" + site.GetConfig().URL + "]")
+}
+
+// Return the certificate with the given name.
+func (CertManager *CertManager) findCertificate(name string) *ManagedCertificate {
+	for _, certificate := range CertManager.managedCertificates() {
+		if certificate.Config.Name == name {
+			return certificate
+		}
+	}
+	return nil
+}
+
+// Return the probes sharing the certificate of the site, the site alone if it is only monitored.
+func (CertManager *CertManager) probesOf(site fetcher.SiteCertProber) []fetcher.SiteCertProber {
+	if certificate, err := CertManager.certificateOf(site); err == nil {
+		return certificate.Probes
+	}
+	return []fetcher.SiteCertProber{site}
+}
+
+// Issue the certificate once, for all its names, deploy it to every target and probe each site.
+// A target failing doesn't stop the others, the error lists every failure.
+//
+// Nothing is started once the context is cancelled, but a certificate already issued
+// is still deployed during the ShutdownGracePeriod.
+func (CertManager *CertManager) RenewCertificate(ctx context.Context, certificate *ManagedCertificate) error {
+	return CertManager.renewCertificate(ctx, certificate, false)
+}
+
+// Renew the certificate, with immediate it is deployed outside of the deployment windows, e.g. after a revocation.
+func (CertManager *CertManager) renewCertificate(ctx context.Context, certificate *ManagedCertificate, immediate bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Find the DNS Server of every name of the certificate.
+	DNSServer, err := CertManager.dnsServerForNames(certificate.Config.Names)
+	if err != nil {
+		return err
+	}
+	// One certificate, and one order, for all the names, from the first CA able to issue it.
+	issued, err := CertManager.orderCertificate(ctx, certificate, DNSServer)
+	if err != nil {
+		return err
+	}
+	deployCtx, cancel := withGracePeriod(ctx)
+	defer cancel()
+	if err := CertManager.deploy(deployCtx, certificate, immediate); err != nil {
+		return err
+	}
+	if CertManager.hasPendingDeployment(certificate.Config.Name) {
+		CertManager.sendToRecipientsByCategories(ctx,
+			"["+certificate.Config.Name+"] "+"New certificate issued, the upload waits for the deployment window;",
+			CategoryRenew)
+		return nil
+	}
+	failures := make([]string, 0)
+	for _, probe := range certificate.Probes {
+		if err := verifyDeployment(deployCtx, probe, issued...); err != nil {
+			failures = append(failures, probe.GetConfig().URL+": "+err.Error())
+		}
+	}
+	CertManager.sendToRecipientsByCategories(ctx,
+		"["+certificate.Config.Name+"] "+"New certificate upload;",
+		CategoryRenew)
+	if len(failures) > 0 {
+		return errors.New("Certificate [" + certificate.Config.Name + "] deployed, but " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Probe the site, it must serve one of the certificates just issued, RSA or ECDSA.
+func verifyDeployment(ctx context.Context, site fetcher.SiteCertProber, issued ...*x509.Certificate) error {
+	if err := site.Refresh(ctx); err != nil {
+		return errors.New("Probe after the deployment failed: " + err.Error())
+	}
+	served := site.GetCertificate()
+	if !isIssued(served, issued) {
+		return errors.New("The site still serves the previous certificate after the deployment")
+	}
+	if missing := fetcher.MissingNames(served, []string{site.GetConfig().URL}); len(missing) > 0 {
+		return errors.New("The certificate doesn't cover " + strings.Join(missing, ", "))
+	}
+	log.Info("[", site.GetConfig().URL, "] Serves the new certificate ", served.SerialNumber.String())
+	return nil
+}
+
+func isIssued(served *x509.Certificate, issued []*x509.Certificate) bool {
+	if served == nil || served.SerialNumber == nil {
+		return false
+	}
+	for _, certificate := range issued {
+		if served.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Identify the Let's Encrypt order of the site: the sites of a shared certificate have a single order.
+func orderKey(site fetcher.SiteCertProber) string {
+	if site.GetConfig().Shared != nil {
+		return "certificate:" + site.GetConfig().Certificate
+	}
+	return "site:" + site.GetConfig().URL
+}
@@ -0,0 +1,154 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// Key type of the certificates without key_type, the one generated by the ACME client.
+const DefaultKeyType = "rsa2048"
+
+// RSA 3072 bits, the ACME client doesn't generate it, see GeneratePrivateKey.
+const RSA3072 = certcrypto.KeyType("3072")
+
+// Key types accepted in the configuration.
+var KeyTypes = map[string]certcrypto.KeyType{
+	"rsa2048": certcrypto.RSA2048,
+	"rsa3072": RSA3072,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+}
+
+// A certificate issued by the manager, e.g. for "*.example.com", and deployed to its targets.
+// The sites probing it decide when it is renewed.
+type Config struct {
+	Name  string   `mapstructure:"name"`
+	Names []string `mapstructure:"names"`
+	// One of KeyTypes, the key type of the Let's Encrypt client when empty.
+	KeyType string `mapstructure:"key_type"`
+	// Directory of the certificate and key files, <certificates root>/<name> when empty.
+	Storage string   `mapstructure:"storage"`
+	Deploy  []Target `mapstructure:"deploy"`
+	// Name of the CA tried first, the first one configured when empty.
+	CA string `mapstructure:"ca"`
+	// Validate the first order, and the first one after a change, on the staging directory of the CA.
+	StagingFirst bool `mapstructure:"staging_first"`
+	// Second key type issued for the same names, e.g. ec256 with an rsa2048 key_type, so the servers can serve both.
+	DualKeyType string `mapstructure:"dual_key_type"`
+	// Keep the private key of the previous certificate, e.g. for a pinned key or a DANE TLSA record.
+	KeyReuse bool `mapstructure:"key_reuse"`
+	// Path of a PEM CSR ordered instead of a new key, its private key stays with its owner.
+	CSR string `mapstructure:"csr"`
+}
+
+// A certificate issued for the names: the main one, or the one of the DualKeyType.
+type Variant struct {
+	KeyType string
+	Suffix  string // Inserted before the extension of the files, empty for the main certificate.
+}
+
+// Where a certificate is deployed: the updater, and the paths where its server reads the files.
+type Target struct {
+	Server   string         `mapstructure:"server"`
+	Location LocationConfig `mapstructure:"location"`
+}
+
+type LocationConfig struct {
+	PrivateKey  string `mapstructure:"private_key"`
+	Certificate string `mapstructure:"certificate"`
+}
+
+// Return the paths of the certificate and the private key files.
+func (config Config) Files(rootPath string) (string, string) {
+	directory := config.Storage
+	if directory == "" {
+		directory = filepath.Join(rootPath, config.Name)
+	}
+	return filepath.Join(directory, config.Name+".crt"), filepath.Join(directory, config.Name+".key")
+}
+
+// Return the certificates to issue for the names, the main one first.
+func (config Config) Variants() []Variant {
+	variants := []Variant{{KeyType: config.KeyType}}
+	if config.DualKeyType != "" {
+		variants = append(variants, Variant{KeyType: config.DualKeyType, Suffix: config.DualKeyType})
+	}
+	return variants
+}
+
+// Return the paths of the certificate and the private key files of the variant.
+func (config Config) VariantFiles(rootPath string, variant Variant) (string, string) {
+	certificateFile, privateKeyFile := config.Files(rootPath)
+	return withSuffix(certificateFile, variant.Suffix), withSuffix(privateKeyFile, variant.Suffix)
+}
+
+// Return where the server reads the files of the variant, next to the main ones: e.g. fullchain.ec256.pem.
+func (location LocationConfig) Variant(variant Variant) LocationConfig {
+	return LocationConfig{
+		PrivateKey:  withSuffix(location.PrivateKey, variant.Suffix),
+		Certificate: withSuffix(location.Certificate, variant.Suffix),
+	}
+}
+
+func withSuffix(path string, suffix string) string {
+	if suffix == "" || path == "" {
+		return path
+	}
+	extension := filepath.Ext(path)
+	return strings.TrimSuffix(path, extension) + "." + suffix + extension
+}
+
+// Generate a private key of one of KeyTypes.
+func GeneratePrivateKey(keyType certcrypto.KeyType) (crypto.PrivateKey, error) {
+	if keyType == RSA3072 {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return certcrypto.GeneratePrivateKey(keyType)
+}
+
+// Return true if the private key is of the key type, e.g. before it is reused.
+func IsKeyType(privateKey crypto.PrivateKey, keyType certcrypto.KeyType) bool {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return strconv.Itoa(key.N.BitLen()) == string(keyType)
+	case *ecdsa.PrivateKey:
+		return strings.Replace(key.Curve.Params().Name, "-", "", 1) == string(keyType)
+	}
+	return false
+}
+
+// Read a PEM CSR.
+func ReadCSR(path string) (*x509.CertificateRequest, error) {
+	csrBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := certcrypto.PemDecodeTox509CSR(csrBytes)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return csr, csr.CheckSignature()
+}
+
+// Return the accepted key types, sorted, for the error messages.
+func KeyTypeNames() []string {
+	names := make([]string, 0, len(KeyTypes))
+	for name := range KeyTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
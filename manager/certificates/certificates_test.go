@@ -0,0 +1,44 @@
+package certificates
+
+import (
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+func TestVariants(t *testing.T) {
+	config := Config{Name: "shop", KeyType: "rsa2048", DualKeyType: "ec256"}
+	variants := config.Variants()
+	if len(variants) != 2 || variants[0].Suffix != "" || variants[1].Suffix != "ec256" {
+		t.Fatal("Expected the main and the ec256 variants got ", variants)
+	}
+	certificateFile, privateKeyFile := config.VariantFiles("/etc/certificate-manager", variants[1])
+	if certificateFile != "/etc/certificate-manager/shop/shop.ec256.crt" {
+		t.Error("Expected ", "/etc/certificate-manager/shop/shop.ec256.crt", " got ", certificateFile)
+	}
+	if privateKeyFile != "/etc/certificate-manager/shop/shop.ec256.key" {
+		t.Error("Expected ", "/etc/certificate-manager/shop/shop.ec256.key", " got ", privateKeyFile)
+	}
+	location := LocationConfig{Certificate: "/etc/nginx/ssl/fullchain.pem"}.Variant(variants[1])
+	if location.Certificate != "/etc/nginx/ssl/fullchain.ec256.pem" || location.PrivateKey != "" {
+		t.Error("Expected ", "/etc/nginx/ssl/fullchain.ec256.pem", " got ", location)
+	}
+	if location := (LocationConfig{Certificate: "/etc/ssl/shop.crt"}).Variant(variants[0]); location.Certificate != "/etc/ssl/shop.crt" {
+		t.Error("Expected ", "/etc/ssl/shop.crt", " got ", location.Certificate)
+	}
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	for _, keyType := range []certcrypto.KeyType{RSA3072, certcrypto.EC384} {
+		privateKey, err := GeneratePrivateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsKeyType(privateKey, keyType) {
+			t.Error("Expected a key of type ", keyType)
+		}
+		if IsKeyType(privateKey, certcrypto.RSA2048) {
+			t.Error("Expected a key of type ", keyType, " not ", certcrypto.RSA2048)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// Part of the lifetime after which a certificate is renewed when no policy is given:
+// a 90 days certificate is renewed 30 days before its expiry.
+const DefaultRenewAt = 2.0 / 3
+
+// When a certificate is renewed: once RenewAt of its lifetime (NotBefore to NotAfter) has elapsed,
+// or DaysBefore its expiry when it is set and shorter than the lifetime.
+type RenewalPolicy struct {
+	RenewAt    float64 `mapstructure:"renew_at"`
+	DaysBefore int     `mapstructure:"days_before"`
+}
+
+// Return the override if it sets anything, the policy otherwise.
+func (policy RenewalPolicy) Merge(override RenewalPolicy) RenewalPolicy {
+	if override.RenewAt != 0 || override.DaysBefore != 0 {
+		return override
+	}
+	return policy
+}
+
+// Return the time the certificate must be renewed at.
+// DaysBefore longer than the lifetime would make the certificate always due, RenewAt is used instead.
+func (policy RenewalPolicy) RenewalTime(certificate *x509.Certificate) time.Time {
+	lifetime := certificate.NotAfter.Sub(certificate.NotBefore)
+	if daysBefore := time.Duration(policy.DaysBefore) * 24 * time.Hour; daysBefore > 0 && daysBefore < lifetime {
+		return certificate.NotAfter.Add(-daysBefore)
+	}
+	renewAt := policy.RenewAt
+	if renewAt <= 0 || renewAt > 1 {
+		renewAt = DefaultRenewAt
+	}
+	return certificate.NotBefore.Add(time.Duration(float64(lifetime) * renewAt))
+}
+
+// Return true if the certificate must be renewed before the given time.
+// Without certificate, there is nothing to wait for.
+func (policy RenewalPolicy) IsDueBefore(certificate *x509.Certificate, before time.Time) bool {
+	if certificate == nil {
+		return true
+	}
+	return !policy.RenewalTime(certificate).After(before)
+}
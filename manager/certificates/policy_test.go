@@ -0,0 +1,39 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// A short lived certificate, valid 6 days.
+	certificate := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(6 * 24 * time.Hour)}
+	if renewal := (RenewalPolicy{}).RenewalTime(certificate); !renewal.Equal(notBefore.Add(4 * 24 * time.Hour)) {
+		t.Error("Expected ", notBefore.Add(4*24*time.Hour), " got ", renewal)
+	}
+	if renewal := (RenewalPolicy{RenewAt: 0.5}).RenewalTime(certificate); !renewal.Equal(notBefore.Add(3 * 24 * time.Hour)) {
+		t.Error("Expected ", notBefore.Add(3*24*time.Hour), " got ", renewal)
+	}
+	if renewal := (RenewalPolicy{RenewAt: 0.5, DaysBefore: 1}).RenewalTime(certificate); !renewal.Equal(notBefore.Add(5 * 24 * time.Hour)) {
+		t.Error("Expected ", notBefore.Add(5*24*time.Hour), " got ", renewal)
+	}
+	// Days before longer than the lifetime.
+	if renewal := (RenewalPolicy{RenewAt: 0.5, DaysBefore: 30}).RenewalTime(certificate); !renewal.Equal(notBefore.Add(3 * 24 * time.Hour)) {
+		t.Error("Expected ", notBefore.Add(3*24*time.Hour), " got ", renewal)
+	}
+	if !(RenewalPolicy{}).IsDueBefore(nil, notBefore) {
+		t.Error("A site without certificate must be renewed")
+	}
+}
+
+func TestMergeRenewalPolicy(t *testing.T) {
+	global := RenewalPolicy{RenewAt: 0.75}
+	if policy := global.Merge(RenewalPolicy{}); policy != global {
+		t.Error("Expected ", global, " got ", policy)
+	}
+	if policy := global.Merge(RenewalPolicy{DaysBefore: 10}); policy != (RenewalPolicy{DaysBefore: 10}) {
+		t.Error("Expected ", RenewalPolicy{DaysBefore: 10}, " got ", policy)
+	}
+}
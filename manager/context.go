@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+)
+
+// Time left to a started deployment to finish once the shutdown is asked.
+const ShutdownGracePeriod = 2 * time.Minute
+
+// Wrap a DNS server so no TXT record is created once the context is cancelled.
+// The records already created are always cleaned.
+type contextDNSServer struct {
+	dns.DNSServer
+	ctx context.Context
+}
+
+func (server contextDNSServer) AddTXTRecord(domain, name, value string) error {
+	if err := server.ctx.Err(); err != nil {
+		return err
+	}
+	return server.DNSServer.AddTXTRecord(domain, name, value)
+}
+
+// Return a context cancelled ShutdownGracePeriod after the parent,
+// so a site whose certificate is already issued can still be deployed.
+func withGracePeriod(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+			select {
+			case <-time.After(ShutdownGracePeriod):
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,273 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/schedule"
+	"github.com/DumesnyJeremy/certificate-manager/manager/updater"
+)
+
+// Name of the file, inside the configuration directory, keeping the deployments waiting for a window.
+const PendingDeploymentsFileName = "pending-deployments.json"
+
+// A certificate issued outside of the deployment windows of an updater.
+// Site is the certificate of the files written before the certificates section, named after its site.
+type PendingDeployment struct {
+	Certificate string    `json:"certificate"`
+	Site        string    `json:"site,omitempty"`
+	Updater     string    `json:"updater"`
+	Issued      time.Time `json:"issued"`
+}
+
+// Upload the current certificate to every target with its updater, and reload the HTTP servers.
+// If an updater is outside of its deployment windows, its deployment waits for the next one.
+func (CertManager *CertManager) Deploy(ctx context.Context, certificate *ManagedCertificate) error {
+	return CertManager.deploy(ctx, certificate, false)
+}
+
+// Deploy the certificate, straight away with immediate, whatever the deployment windows.
+// An updater failing doesn't stop the others, the error lists every failure.
+func (CertManager *CertManager) deploy(ctx context.Context, certificate *ManagedCertificate, immediate bool) error {
+	failures := make([]string, 0)
+	// Use the certificate for the correct servers.
+	for _, CertificateUpdater := range CertManager.CertificateUpdaters {
+		if len(certificate.targetsOf(CertificateUpdater.GetName())) == 0 {
+			continue
+		}
+		open := immediate
+		if !immediate {
+			var err error
+			if open, err = schedule.IsInWindows(CertificateUpdater.GetConfig().Windows, time.Now()); err != nil {
+				failures = append(failures, CertificateUpdater.GetName()+": "+err.Error())
+				continue
+			}
+		}
+		if !open {
+			log.Warn("[", certificate.Config.Name, "] Outside of the deployment windows of ",
+				CertificateUpdater.GetName(), ", the deployment waits for the next one.")
+			CertManager.addPendingDeployment(PendingDeployment{
+				Certificate: certificate.Config.Name,
+				Updater:     CertificateUpdater.GetName(),
+				Issued:      time.Now(),
+			})
+			continue
+		}
+		if err := CertManager.deployWithUpdater(ctx, CertificateUpdater, certificate); err != nil {
+			failures = append(failures, CertificateUpdater.GetName()+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Certificate [" + certificate.Config.Name + "] not deployed with " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Upload every variant of the certificate to every target of the updater, then reload its HTTP server once.
+func (CertManager *CertManager) deployWithUpdater(ctx context.Context, CertificateUpdater certificate_updater.CertificateUpdater, certificate *ManagedCertificate) error {
+	start := time.Now()
+	for _, variant := range certificate.Config.Variants() {
+		certificateFile, privateKeyFile := certificate.Config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+		if certificate.Config.CSR != "" {
+			privateKeyFile = ""
+		}
+		for _, target := range certificate.targetsOf(CertificateUpdater.GetName()) {
+			err := CertificateUpdater.UpdateCertificate(ctx, certificate_updater.Deployment{
+				Certificate:     certificate.Config.Name,
+				CertificateFile: certificateFile,
+				PrivateKeyFile:  privateKeyFile,
+				Location:        target.Location.Variant(variant),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	CertManager.recordDeployDuration(CertificateUpdater.GetName(), start)
+	start = time.Now()
+	if err := CertificateUpdater.ReloadHTTPServer(ctx); err != nil {
+		return err
+	}
+	CertManager.recordReloadDuration(CertificateUpdater.GetName(), start)
+	CertManager.removePendingDeployment(certificate.Config.Name, CertificateUpdater.GetName())
+	return nil
+}
+
+// Deploy the certificates waiting for a window, if their window is now open.
+func (CertManager *CertManager) deployPendingCertificates(ctx context.Context) {
+	for _, pending := range CertManager.getPendingDeployments() {
+		if ctx.Err() != nil {
+			return
+		}
+		certificate := CertManager.findCertificate(pending.Certificate)
+		CertificateUpdater := CertManager.findUpdater(pending.Updater)
+		if certificate == nil || CertificateUpdater == nil {
+			log.Warn("[", pending.Certificate, "] The pending deployment with ", pending.Updater, " is dropped, the certificate or the updater doesn't exist anymore.")
+			CertManager.removePendingDeployment(pending.Certificate, pending.Updater)
+			continue
+		}
+		open, err := schedule.IsInWindows(CertificateUpdater.GetConfig().Windows, time.Now())
+		// The site serves a revoked certificate, the new one doesn't wait for the window.
+		if (err != nil || !open) && !certificate.isRevoked() {
+			continue
+		}
+		if err := CertManager.deployWithUpdater(ctx, CertificateUpdater, certificate); err != nil {
+			CertManager.sendToRecipientsByCategories(ctx,
+				"["+pending.Certificate+"] "+"Error: "+err.Error()+";",
+				CategoryError)
+			continue
+		}
+		CertManager.sendToRecipientsByCategories(ctx,
+			"["+pending.Certificate+"] "+"Deferred certificate upload;",
+			CategoryRenew)
+	}
+}
+
+// Deploy the certificates waiting for a window, between two cycles, once their window opens.
+func (CertManager *CertManager) DeployPendingCertificates(ctx context.Context) {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	CertManager.deployPendingCertificates(ctx)
+	CertManager.snapshotStatus()
+}
+
+// Return the next opening of a deployment window with a deployment waiting for it, the zero time if there is none.
+func (CertManager *CertManager) NextPendingDeployment(now time.Time) time.Time {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	next := time.Time{}
+	for _, pending := range CertManager.getPendingDeployments() {
+		CertificateUpdater := CertManager.findUpdater(pending.Updater)
+		if CertificateUpdater == nil {
+			continue
+		}
+		opening, err := schedule.NextOpening(CertificateUpdater.GetConfig().Windows, now)
+		if err != nil || opening.IsZero() {
+			continue
+		}
+		if next.IsZero() || opening.Before(next) {
+			next = opening
+		}
+	}
+	return next
+}
+
+// Return true if the certificate waits for a deployment window.
+func (CertManager *CertManager) hasPendingDeployment(certificateName string) bool {
+	for _, pending := range CertManager.getPendingDeployments() {
+		if pending.Certificate == certificateName {
+			return true
+		}
+	}
+	return false
+}
+
+func (CertManager *CertManager) findUpdater(name string) certificate_updater.CertificateUpdater {
+	for _, CertificateUpdater := range CertManager.CertificateUpdaters {
+		if CertificateUpdater.GetName() == name {
+			return CertificateUpdater
+		}
+	}
+	return nil
+}
+
+func (CertManager *CertManager) getPendingDeployments() []PendingDeployment {
+	if !CertManager.pendingLoaded {
+		CertManager.pendingDeployments = CertManager.readPendingDeployments()
+		CertManager.pendingLoaded = true
+	}
+	return append([]PendingDeployment{}, CertManager.pendingDeployments...)
+}
+
+func (CertManager *CertManager) addPendingDeployment(deployment PendingDeployment) {
+	unlock := CertManager.lockPendingDeployments()
+	defer unlock()
+	CertManager.pendingDeployments = append(
+		CertManager.pendingDeploymentsBut(deployment.Certificate, deployment.Updater), deployment)
+	CertManager.writePendingDeployments()
+}
+
+func (CertManager *CertManager) removePendingDeployment(certificateName string, updaterName string) {
+	unlock := CertManager.lockPendingDeployments()
+	defer unlock()
+	pendingDeployments := CertManager.pendingDeploymentsBut(certificateName, updaterName)
+	if len(pendingDeployments) != len(CertManager.pendingDeployments) {
+		CertManager.pendingDeployments = pendingDeployments
+		CertManager.writePendingDeployments()
+	}
+}
+
+// Take the lock of the pending deployments, and read them again: another process may have written them.
+func (CertManager *CertManager) lockPendingDeployments() func() {
+	unlock := lockLedger(CertManager.pendingDeploymentsPath())
+	if CertManager.pendingDeploymentsPath() != "" {
+		CertManager.pendingLoaded = false
+	}
+	return unlock
+}
+
+func (CertManager *CertManager) pendingDeploymentsBut(certificateName string, updaterName string) []PendingDeployment {
+	pendingDeployments := make([]PendingDeployment, 0)
+	for _, pending := range CertManager.getPendingDeployments() {
+		if pending.Certificate != certificateName || pending.Updater != updaterName {
+			pendingDeployments = append(pendingDeployments, pending)
+		}
+	}
+	return pendingDeployments
+}
+
+// The pending deployments are kept on disk, so a run started by the timer knows about the previous ones.
+func (CertManager *CertManager) pendingDeploymentsPath() string {
+	if CertManager.ConfDirPath == "" {
+		return ""
+	}
+	return filepath.Join(CertManager.ConfDirPath, PendingDeploymentsFileName)
+}
+
+func (CertManager *CertManager) readPendingDeployments() []PendingDeployment {
+	pendingDeployments := make([]PendingDeployment, 0)
+	path := CertManager.pendingDeploymentsPath()
+	if path == "" {
+		return pendingDeployments
+	}
+	pendingBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("While reading the pending deployments: ", err.Error())
+		}
+		return pendingDeployments
+	}
+	if err := json.Unmarshal(pendingBytes, &pendingDeployments); err != nil {
+		log.Error("While reading the pending deployments: ", err.Error())
+	}
+	for index, pending := range pendingDeployments {
+		if pending.Certificate == "" {
+			pendingDeployments[index].Certificate = pending.Site
+			pendingDeployments[index].Site = ""
+		}
+	}
+	return pendingDeployments
+}
+
+func (CertManager *CertManager) writePendingDeployments() {
+	path := CertManager.pendingDeploymentsPath()
+	if path == "" {
+		return
+	}
+	pendingBytes, err := json.Marshal(CertManager.pendingDeployments)
+	if err != nil {
+		log.Error("While saving the pending deployments: ", err.Error())
+		return
+	}
+	if err := writeLedger(path, pendingBytes); err != nil {
+		log.Error("While saving the pending deployments: ", err.Error())
+	}
+}
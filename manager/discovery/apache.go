@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"strings"
+)
+
+// Return the VirtualHost sections of an Apache configuration file having a ServerName or a ServerAlias.
+func ParseApache(file string, content []byte) []VirtualHost {
+	virtualHosts := make([]VirtualHost, 0)
+	var current *VirtualHost
+	for _, line := range apacheLines(string(content)) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		arguments := unquote(fields[1:])
+		switch {
+		case strings.HasPrefix(name, "<virtualhost"):
+			current = &VirtualHost{File: file, Port: DefaultTLSPort}
+			addresses := append([]string{strings.TrimPrefix(name, "<virtualhost")}, arguments...)
+			for _, address := range addresses {
+				if port := listenPort(strings.TrimSuffix(address, ">")); port != 0 {
+					current.Port = port
+					break
+				}
+			}
+		case name == "</virtualhost>":
+			if current != nil && len(current.Names) > 0 {
+				virtualHosts = append(virtualHosts, *current)
+			}
+			current = nil
+		case current == nil:
+		case name == "servername" && len(arguments) > 0:
+			// The ServerName can contain a scheme and a port.
+			serverName := arguments[0]
+			if index := strings.Index(serverName, "://"); index >= 0 {
+				serverName = serverName[index+3:]
+			}
+			if index := strings.LastIndex(serverName, ":"); index >= 0 {
+				serverName = serverName[:index]
+			}
+			current.Names = append([]string{serverName}, current.Names...)
+		case name == "serveralias":
+			current.Names = append(current.Names, arguments...)
+		case name == "sslcertificatefile" && len(arguments) > 0:
+			current.Certificate = arguments[0]
+		case name == "sslcertificatekeyfile" && len(arguments) > 0:
+			current.PrivateKey = arguments[0]
+		}
+	}
+	return virtualHosts
+}
+
+// Return the lines of the configuration, with the continuations joined and without the comments.
+func apacheLines(content string) []string {
+	lines := make([]string, 0)
+	current := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line = current + line
+		current = ""
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func unquote(arguments []string) []string {
+	unquoted := make([]string, 0, len(arguments))
+	for _, argument := range arguments {
+		unquoted = append(unquoted, strings.Trim(argument, "\"'"))
+	}
+	return unquoted
+}
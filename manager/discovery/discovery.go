@@ -0,0 +1,150 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+)
+
+// Files read by default to find the virtual hosts. The include directives are not followed,
+// the patterns must match every file declaring a virtual host.
+var (
+	DefaultNginxPatterns  = []string{"/etc/nginx/nginx.conf", "/etc/nginx/conf.d/*.conf", "/etc/nginx/sites-enabled/*"}
+	DefaultApachePatterns = []string{"/etc/apache2/sites-enabled/*", "/etc/httpd/conf.d/*.conf", "/etc/httpd/conf/httpd.conf"}
+)
+
+// Port used when a TLS virtual host doesn't give one.
+const DefaultTLSPort = 443
+
+// A virtual host found in a web server configuration.
+type VirtualHost struct {
+	File        string
+	Names       []string
+	Port        int
+	Certificate string
+	PrivateKey  string
+}
+
+// A site generated from a virtual host, or the reason why the virtual host can't be used.
+type DiscoveredSite struct {
+	VirtualHost VirtualHost
+	Site        fetcher.CertificateFetchConfig
+	// Names of the virtual host that can't be in the certificate.
+	Ignored []IgnoredName
+	// Why no site can be generated, empty if the site is usable.
+	Skipped string
+}
+
+// A name of a virtual host left out of the site, and why.
+type IgnoredName struct {
+	Name   string
+	Reason string
+}
+
+// Reasons why a name of a virtual host is ignored.
+const (
+	ReasonCatchAll = "catch-all"
+	ReasonNotFQDN  = "not a domain"
+	ReasonRegex    = "regular expression"
+	ReasonWildcard = "wildcard, can't be probed: define it in the certificates"
+)
+
+func (ignored IgnoredName) String() string {
+	return ignored.Name + " (" + ignored.Reason + ")"
+}
+
+// Read the nginx and Apache configuration files with the reader and return their virtual hosts.
+func Discover(ctx context.Context, reader updater.FileReader, nginxPatterns []string, apachePatterns []string) ([]VirtualHost, error) {
+	virtualHosts := make([]VirtualHost, 0)
+	nginxFiles, err := reader.ReadFiles(ctx, nginxPatterns)
+	if err != nil {
+		return nil, errors.New("While reading the nginx configuration: " + err.Error())
+	}
+	for _, file := range sortedFiles(nginxFiles) {
+		virtualHosts = append(virtualHosts, ParseNginx(file, nginxFiles[file])...)
+	}
+	apacheFiles, err := reader.ReadFiles(ctx, apachePatterns)
+	if err != nil {
+		return nil, errors.New("While reading the Apache configuration: " + err.Error())
+	}
+	for _, file := range sortedFiles(apacheFiles) {
+		virtualHosts = append(virtualHosts, ParseApache(file, apacheFiles[file])...)
+	}
+	return virtualHosts, nil
+}
+
+// Generate a site per TLS virtual host, deployed with the updater.
+// The certificate of the site covers every usable name of the virtual host, the first one is the URL.
+func Sites(virtualHosts []VirtualHost, updaterName string) []DiscoveredSite {
+	discovered := make([]DiscoveredSite, 0)
+	for _, virtualHost := range virtualHosts {
+		site := DiscoveredSite{VirtualHost: virtualHost}
+		names, ignored := usableNames(virtualHost.Names)
+		switch {
+		case virtualHost.Certificate == "":
+			site.Skipped = "no TLS certificate"
+		case virtualHost.PrivateKey == "":
+			site.Skipped = "no private key path"
+		case len(names) == 0:
+			site.Skipped = "no usable name"
+		default:
+			site.Site = fetcher.CertificateFetchConfig{
+				Server: updaterName,
+				URL:    names[0],
+				Port:   virtualHost.Port,
+				Location: fetcher.LocationConfig{
+					Certificate: virtualHost.Certificate,
+					PrivateKey:  virtualHost.PrivateKey,
+				},
+			}
+			if len(names) > 1 {
+				site.Site.Names = names
+			}
+		}
+		site.Ignored = ignored
+		discovered = append(discovered, site)
+	}
+	return discovered
+}
+
+// Split the names that can be checked from the catch-all, regex and wildcard ones.
+// A wildcard, "*.example.com", "www.example.*" or ".example.com" for nginx, can't be probed,
+// it is left to a certificate of the configuration.
+func usableNames(names []string) ([]string, []IgnoredName) {
+	usable := make([]string, 0)
+	ignored := make([]IgnoredName, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		switch {
+		case name == "" || name == "_":
+			ignored = append(ignored, IgnoredName{Name: name, Reason: ReasonCatchAll})
+		case strings.HasPrefix(name, "~") || strings.ContainsAny(name, "$^()"):
+			ignored = append(ignored, IgnoredName{Name: name, Reason: ReasonRegex})
+		case strings.Contains(name, "*") || strings.HasPrefix(name, "."):
+			ignored = append(ignored, IgnoredName{Name: name, Reason: ReasonWildcard})
+		case name == "localhost" || !strings.Contains(name, "."):
+			ignored = append(ignored, IgnoredName{Name: name, Reason: ReasonNotFQDN})
+		default:
+			usable = append(usable, name)
+		}
+	}
+	return usable, ignored
+}
+
+func sortedFiles(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
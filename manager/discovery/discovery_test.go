@@ -0,0 +1,88 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNginx(t *testing.T) {
+	virtualHosts := ParseNginx("site.conf", []byte(`
+http {
+    # server { in a comment
+    server {
+        listen 80;
+        server_name www.example.com;
+    }
+    server {
+        listen [::]:8443 ssl http2;
+        server_name shop.example.com "*.example.net" _;
+        ssl_certificate /etc/ssl/shop/fullchain.pem;
+        ssl_certificate_key '/etc/ssl/shop/privkey.pem';
+        location / {
+            server_name ignored.example.com;
+        }
+    }
+}`))
+	expected := []VirtualHost{
+		{File: "site.conf", Names: []string{"www.example.com"}, Port: 443},
+		{File: "site.conf", Names: []string{"shop.example.com", "*.example.net", "_"}, Port: 8443,
+			Certificate: "/etc/ssl/shop/fullchain.pem", PrivateKey: "/etc/ssl/shop/privkey.pem"},
+	}
+	if !reflect.DeepEqual(virtualHosts, expected) {
+		t.Error("Expected ", expected, " got ", virtualHosts)
+	}
+}
+
+func TestParseApache(t *testing.T) {
+	virtualHosts := ParseApache("site.conf", []byte(`
+<VirtualHost *:80>
+    ServerName blog.example.com
+</VirtualHost>
+<VirtualHost _default_:8443 [::]:8443>
+    # ServerName commented.example.com
+    ServerName https://blog.example.com:8443
+    ServerAlias www.blog.example.com \
+        old.blog.example.com
+    SSLCertificateFile "/etc/ssl/blog/cert.pem"
+    SSLCertificateKeyFile /etc/ssl/blog/key.pem
+</VirtualHost>`))
+	expected := []VirtualHost{
+		{File: "site.conf", Names: []string{"blog.example.com"}, Port: 80},
+		{File: "site.conf", Names: []string{"blog.example.com", "www.blog.example.com", "old.blog.example.com"}, Port: 8443,
+			Certificate: "/etc/ssl/blog/cert.pem", PrivateKey: "/etc/ssl/blog/key.pem"},
+	}
+	if !reflect.DeepEqual(virtualHosts, expected) {
+		t.Error("Expected ", expected, " got ", virtualHosts)
+	}
+}
+
+func TestSites(t *testing.T) {
+	discovered := Sites([]VirtualHost{
+		{Names: []string{"www.example.com"}, Port: 443},
+		{Names: []string{"_", "Shop.Example.com.", "*.example.net", "www.shop.example.com"}, Port: 8443, Certificate: "/crt", PrivateKey: "/key"},
+		{Names: []string{"*.example.org", ".example.com", "~^(?<user>.+)\\.example\\.io$"}, Port: 443, Certificate: "/crt", PrivateKey: "/key"},
+	}, "Serv 1")
+	if discovered[0].Skipped == "" {
+		t.Error("A virtual host without certificate must be skipped")
+	}
+	site := discovered[1].Site
+	if !reflect.DeepEqual(site.Names, []string{"shop.example.com", "www.shop.example.com"}) {
+		t.Error("Unexpected names: ", site.Names)
+	}
+	if discovered[1].Skipped != "" || site.URL != "shop.example.com" || site.Server != "Serv 1" || site.Port != 8443 ||
+		site.Location.Certificate != "/crt" || site.Location.PrivateKey != "/key" {
+		t.Error("Unexpected site: ", discovered[1])
+	}
+	if !reflect.DeepEqual(discovered[1].Ignored, []IgnoredName{{"_", ReasonCatchAll}, {"*.example.net", ReasonWildcard}}) {
+		t.Error("Unexpected ignored names: ", discovered[1].Ignored)
+	}
+	// The wildcards are reported, not dropped, even when no site is left.
+	expected := []IgnoredName{
+		{"*.example.org", ReasonWildcard},
+		{".example.com", ReasonWildcard},
+		{"~^(?<user>.+)\\.example\\.io$", ReasonRegex},
+	}
+	if discovered[2].Skipped == "" || !reflect.DeepEqual(discovered[2].Ignored, expected) {
+		t.Error("Unexpected ignored names: ", discovered[2].Skipped, " ", discovered[2].Ignored)
+	}
+}
@@ -0,0 +1,142 @@
+package discovery
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Return the server blocks of an nginx configuration file having a server_name.
+func ParseNginx(file string, content []byte) []VirtualHost {
+	virtualHosts := make([]VirtualHost, 0)
+	tokens := tokenizeNginx(string(content))
+	// Depth of the server block being read, -1 outside of a server block.
+	depth, serverDepth := 0, -1
+	var current VirtualHost
+	var listens [][]string
+	directive := make([]string, 0)
+	for _, token := range tokens {
+		switch token {
+		case "{":
+			if serverDepth < 0 && len(directive) == 1 && directive[0] == "server" {
+				serverDepth = depth + 1
+				current = VirtualHost{File: file}
+				listens = make([][]string, 0)
+			}
+			depth++
+			directive = directive[:0]
+		case "}":
+			if depth == serverDepth {
+				current.Port = nginxTLSPort(listens)
+				if len(current.Names) > 0 {
+					virtualHosts = append(virtualHosts, current)
+				}
+				serverDepth = -1
+			}
+			depth--
+			directive = directive[:0]
+		case ";":
+			if depth == serverDepth && len(directive) > 0 {
+				arguments := directive[1:]
+				switch directive[0] {
+				case "server_name":
+					current.Names = append(current.Names, arguments...)
+				case "listen":
+					listens = append(listens, append([]string{}, arguments...))
+				case "ssl_certificate":
+					if len(arguments) > 0 {
+						current.Certificate = arguments[0]
+					}
+				case "ssl_certificate_key":
+					if len(arguments) > 0 {
+						current.PrivateKey = arguments[0]
+					}
+				}
+			}
+			directive = directive[:0]
+		default:
+			directive = append(directive, token)
+		}
+	}
+	return virtualHosts
+}
+
+// Return the port of the first listen directive with ssl, or the default TLS port.
+func nginxTLSPort(listens [][]string) int {
+	for _, listen := range listens {
+		if len(listen) == 0 {
+			continue
+		}
+		ssl := false
+		for _, parameter := range listen[1:] {
+			if parameter == "ssl" {
+				ssl = true
+			}
+		}
+		port := listenPort(listen[0])
+		if ssl || port == DefaultTLSPort {
+			if port == 0 {
+				return DefaultTLSPort
+			}
+			return port
+		}
+	}
+	return DefaultTLSPort
+}
+
+// Return the port of an address like "443", "*:8443" or "[::]:443", 0 if there is none.
+func listenPort(address string) int {
+	if strings.HasPrefix(address, "unix:") {
+		return 0
+	}
+	if index := strings.LastIndex(address, ":"); index >= 0 && !strings.HasSuffix(address, "]") {
+		address = address[index+1:]
+	}
+	port, err := strconv.Atoi(address)
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+// Split the configuration in words, with "{", "}" and ";" as their own tokens,
+// without the comments and the quotes.
+func tokenizeNginx(content string) []string {
+	tokens := make([]string, 0)
+	var word strings.Builder
+	var quote rune
+	comment := false
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range content {
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+			}
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			flush()
+			comment = true
+		case r == '{' || r == '}' || r == ';':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
@@ -0,0 +1,253 @@
+package discovery
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weppos/publicsuffix-go/publicsuffix"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Default values of the network scan.
+const (
+	DefaultScanTimeoutSec  = 3
+	DefaultScanConcurrency = 32
+	// A larger network is refused, to avoid scanning a whole range by mistake.
+	MaxScanAddresses = 65536
+)
+
+var DefaultScanPorts = []int{443}
+
+// Networks and ports scanned by the discover command.
+type ScanConfig struct {
+	Networks    []string `mapstructure:"networks"`
+	Ports       []int    `mapstructure:"ports"`
+	TimeoutSec  int      `mapstructure:"timeout_sec"`
+	Concurrency int      `mapstructure:"concurrency"`
+}
+
+// State of a certificate found by the scan, compared with the configured sites.
+const (
+	// One of the names of the certificate is a configured site.
+	EndpointManaged = "managed"
+	// The certificate belongs to a domain of the configured sites, but none of its names is a site.
+	EndpointUnmanaged = "unmanaged"
+	// The certificate doesn't belong to any domain of the configured sites.
+	EndpointForeign = "foreign"
+)
+
+// A TLS endpoint found by the scan.
+type Endpoint struct {
+	Address  string    `json:"address"`
+	Port     int       `json:"port"`
+	Names    []string  `json:"names"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int64     `json:"days_left"`
+	State    string    `json:"state"`
+}
+
+// Probe with the function every address of the networks on every port, and return the TLS endpoints found.
+type ProbeFunc func(ctx context.Context, host string, port int, timeout time.Duration) (*x509.Certificate, error)
+
+// Default probe, without server name: the certificate returned is the default one of the endpoint.
+func ProbeWithFetcher(ctx context.Context, host string, port int, timeout time.Duration) (*x509.Certificate, error) {
+	return fetcher.ProbeAddress(ctx, host, port, "", timeout)
+}
+
+// Scan the networks and return the endpoints sorted by address and port.
+func Scan(ctx context.Context, config ScanConfig, probe ProbeFunc) ([]Endpoint, error) {
+	addresses, err := expandNetworks(config.Networks)
+	if err != nil {
+		return nil, err
+	}
+	ports := config.Ports
+	if len(ports) == 0 {
+		ports = DefaultScanPorts
+	}
+	timeout := time.Duration(config.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultScanTimeoutSec * time.Second
+	}
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultScanConcurrency
+	}
+
+	type target struct {
+		address string
+		port    int
+	}
+	targets := make(chan target)
+	endpoints := make([]Endpoint, 0)
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for target := range targets {
+				certificate, err := probe(ctx, target.address, target.port, timeout)
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				endpoints = append(endpoints, Endpoint{
+					Address:  target.address,
+					Port:     target.port,
+					Names:    certificateNames(certificate),
+					Issuer:   certificate.Issuer.CommonName,
+					NotAfter: certificate.NotAfter,
+					DaysLeft: fetcher.ComputeDaysLeft(certificate),
+				})
+				mutex.Unlock()
+			}
+		}()
+	}
+send:
+	for _, address := range addresses {
+		for _, port := range ports {
+			if ctx.Err() != nil {
+				break send
+			}
+			targets <- target{address: address, port: port}
+		}
+	}
+	close(targets)
+	wait.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return compareAddresses(endpoints[i].Address, endpoints[j].Address)
+		}
+		return endpoints[i].Port < endpoints[j].Port
+	})
+	return endpoints, nil
+}
+
+// Set the state of every endpoint from the URLs of the configured sites.
+func Classify(endpoints []Endpoint, siteURLs []string) {
+	sites := make(map[string]bool)
+	domains := make(map[string]bool)
+	for _, url := range siteURLs {
+		sites[strings.ToLower(url)] = true
+		if domain, err := publicsuffix.Domain(url); err == nil {
+			domains[domain] = true
+		}
+	}
+	for i := range endpoints {
+		endpoints[i].State = EndpointForeign
+		for _, name := range endpoints[i].Names {
+			if sites[strings.ToLower(name)] {
+				endpoints[i].State = EndpointManaged
+				break
+			}
+			domain, err := publicsuffix.Domain(strings.TrimPrefix(name, "*."))
+			if err == nil && domains[domain] {
+				endpoints[i].State = EndpointUnmanaged
+			}
+		}
+	}
+}
+
+// Generate a site for every unmanaged endpoint, with the first name of its domain, without updater.
+func UnmanagedSites(endpoints []Endpoint, siteURLs []string) []fetcher.CertificateFetchConfig {
+	domains := make(map[string]bool)
+	for _, url := range siteURLs {
+		if domain, err := publicsuffix.Domain(url); err == nil {
+			domains[domain] = true
+		}
+	}
+	seen := make(map[string]bool)
+	sites := make([]fetcher.CertificateFetchConfig, 0)
+	for _, endpoint := range endpoints {
+		if endpoint.State != EndpointUnmanaged {
+			continue
+		}
+		for _, name := range endpoint.Names {
+			domain, err := publicsuffix.Domain(name)
+			if err != nil || !domains[domain] || strings.Contains(name, "*") {
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				sites = append(sites, fetcher.CertificateFetchConfig{URL: name, Port: endpoint.Port})
+			}
+			break
+		}
+	}
+	return sites
+}
+
+// Return every address of the networks, without the network and broadcast addresses of the IPv4 networks.
+func expandNetworks(networks []string) ([]string, error) {
+	addresses := make([]string, 0)
+	for _, network := range networks {
+		if ip := net.ParseIP(network); ip != nil {
+			addresses = append(addresses, ip.String())
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, errors.New("Invalid network " + network + ": " + err.Error())
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits-ones > 16 || len(addresses)+(1<<uint(bits-ones)) > MaxScanAddresses {
+			return nil, errors.New("The network " + network + " is too large, the scan is limited to " +
+				strconv.Itoa(MaxScanAddresses) + " addresses")
+		}
+		first := len(addresses)
+		for ip := ipNet.IP.Mask(ipNet.Mask); ipNet.Contains(ip); ip = nextIP(ip) {
+			addresses = append(addresses, ip.String())
+		}
+		if bits == 32 && bits-ones >= 2 {
+			addresses = append(addresses[:first], addresses[first+1:len(addresses)-1]...)
+		}
+	}
+	return addresses, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func compareAddresses(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a < b
+	}
+	return string(ipA.To16()) < string(ipB.To16())
+}
+
+// Return the DNS names of the certificate, and its common name if it is not one of them.
+func certificateNames(certificate *x509.Certificate) []string {
+	names := append([]string{}, certificate.DNSNames...)
+	commonName := certificate.Subject.CommonName
+	if commonName != "" {
+		for _, name := range names {
+			if name == commonName {
+				return names
+			}
+		}
+		names = append([]string{commonName}, names...)
+	}
+	return names
+}
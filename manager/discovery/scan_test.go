@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestExpandNetworks(t *testing.T) {
+	addresses, err := expandNetworks([]string{"192.168.1.0/30", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.168.1.1", "192.168.1.2", "10.0.0.1"}
+	if len(addresses) != len(expected) {
+		t.Fatal("Expected ", expected, " got ", addresses)
+	}
+	for i := range expected {
+		if addresses[i] != expected[i] {
+			t.Error("Expected ", expected, " got ", addresses)
+		}
+	}
+	if _, err := expandNetworks([]string{"10.0.0.0/8"}); err == nil {
+		t.Error("Expected an error for a too large network")
+	}
+}
+
+func TestScanFlagsUnmanagedCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	endpoints, err := Scan(context.Background(), ScanConfig{Networks: []string{host}, Ports: []int{portNumber}}, ProbeWithFetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Port != portNumber {
+		t.Fatal("Expected the test server, got ", endpoints)
+	}
+	// The certificate of the test server is for example.com.
+	Classify(endpoints, []string{"www.example.com"})
+	if endpoints[0].State != EndpointUnmanaged {
+		t.Error("Expected an unmanaged endpoint, got ", endpoints[0].State)
+	}
+	sites := UnmanagedSites(endpoints, []string{"www.example.com"})
+	if len(sites) != 1 || sites[0].URL != "example.com" || sites[0].Port != portNumber {
+		t.Error("Unexpected sites: ", sites)
+	}
+	Classify(endpoints, []string{"example.com"})
+	if endpoints[0].State != EndpointManaged {
+		t.Error("Expected a managed endpoint, got ", endpoints[0].State)
+	}
+	Classify(endpoints, []string{"www.example.org"})
+	if endpoints[0].State != EndpointForeign {
+		t.Error("Expected a foreign endpoint, got ", endpoints[0].State)
+	}
+}
@@ -1,49 +1,156 @@
 package fetcher
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/weppos/publicsuffix-go/publicsuffix"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Maximum time to establish the TCP connection with a site.
+const DialTimeout = 30 * time.Second
+
+// Modes of a site: its certificate is renewed by the manager, or it is only monitored,
+// e.g. a SaaS endpoint or a certificate of a commercial CA.
+const (
+	ModeRenew   = "renew"
+	ModeMonitor = "monitor"
+)
+
 type SiteCertProber interface {
 	DaysLeft() int
-	RefreshCertifAndGetDaysLeft() (int, error)
+	RefreshCertifAndGetDaysLeft(ctx context.Context) (int, error)
 	IsSiteValid() bool
-	Refresh() error
+	Refresh(ctx context.Context) error
 	GetConfig() CertificateFetchConfig
 	GetDomain() string
+	GetCertificate() *x509.Certificate
 }
 
 type CertificateFetchConfig struct {
-	Server   string         `mapstructure:"server"`
-	URL      string         `mapstructure:"url"`
-	Port     int            `mapstructure:"port"`
-	Location LocationConfig `mapstructure:"location"`
+	Server string `mapstructure:"server"`
+	// Name probed, and identifying the site. Set from Primary or Names when empty.
+	URL string `mapstructure:"url"`
+	// Every name of the certificate, a single SAN certificate is issued for all of them.
+	Names []string `mapstructure:"names"`
+	// Name used as URL, the first of Names when empty.
+	Primary string `mapstructure:"primary"`
+	// ModeRenew when empty, a site in ModeMonitor is probed and alerted on, never renewed.
+	Mode string `mapstructure:"mode"`
+	// Name of a shared certificate, issued once and deployed to every site referencing it.
+	Certificate string         `mapstructure:"certificate"`
+	Port        int            `mapstructure:"port"`
+	Location    LocationConfig `mapstructure:"location"`
+	// Overrides the renewal policy of the certificate_manager section for this site.
+	Renewal certificates.RenewalPolicy `mapstructure:"renewal"`
+	// Name of the CA tried first for the certificate of the site, when it isn't shared.
+	CA           string `mapstructure:"ca"`
+	StagingFirst bool   `mapstructure:"staging_first"`
+	// Definition of the shared certificate, set when the configuration is loaded.
+	Shared *certificates.Config `mapstructure:"-"`
+}
+
+// Return every name the certificate of the site must cover, the URL first.
+// A site of a shared certificate must be covered by the names of the certificate.
+func (config CertificateFetchConfig) GetNames() []string {
+	names := make([]string, 0, len(config.Names)+1)
+	seen := make(map[string]bool)
+	configNames := config.Names
+	if config.Shared != nil {
+		configNames = config.Shared.Names
+	}
+	for _, name := range append([]string{config.URL}, configNames...) {
+		name = strings.ToLower(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
-type LocationConfig struct {
-	PrivateKey  string `mapstructure:"private_key"`
-	Certificate string `mapstructure:"certificate"`
+// A site probes a certificate issued by the manager when it references a shared certificate,
+// or when it has an updater to deploy the certificate of its own names.
+// Any other site, and every site in ModeMonitor, is only monitored.
+func (config CertificateFetchConfig) IsManaged() bool {
+	if config.Mode == ModeMonitor {
+		return false
+	}
+	return config.Shared != nil || config.Server != ""
 }
 
+// Return the certificate probed by the site: its shared certificate, or the certificate of its own names,
+// named and stored after its URL, and deployed with its updater. False for a site only monitored.
+func (config CertificateFetchConfig) GetCertificateConfig() (certificates.Config, bool) {
+	if config.Shared != nil {
+		return *config.Shared, true
+	}
+	if !config.IsManaged() {
+		return certificates.Config{}, false
+	}
+	return certificates.Config{
+		Name:         config.URL,
+		Names:        config.GetNames(),
+		Deploy:       []certificates.Target{{Server: config.Server, Location: config.Location}},
+		CA:           config.CA,
+		StagingFirst: config.StagingFirst,
+	}, true
+}
+
+// Return the names not covered by the certificate.
+// A wildcard name must be one of the names of the certificate.
+func MissingNames(certificate *x509.Certificate, names []string) []string {
+	missing := make([]string, 0)
+	for _, name := range names {
+		if certificate == nil {
+			missing = append(missing, name)
+		} else if strings.HasPrefix(name, "*.") {
+			if !hasDNSName(certificate, name) {
+				missing = append(missing, name)
+			}
+		} else if certificate.VerifyHostname(name) != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func hasDNSName(certificate *x509.Certificate, name string) bool {
+	for _, dnsName := range certificate.DNSNames {
+		if strings.EqualFold(dnsName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+type LocationConfig = certificates.LocationConfig
+
 // Main client containing an X.509 certificate and the analyzer config.
 type Client struct {
 	Domain      string
 	Certificate *x509.Certificate
 	Config      CertificateFetchConfig
+	OCSP        OCSPStatus
 }
 
 // Receives multi analyzer configs, parse site by site and
 // build an array of clients (extracted certificate).
-func InitMulti(configSites []CertificateFetchConfig) []SiteCertProber {
+func InitMulti(ctx context.Context, configSites []CertificateFetchConfig) []SiteCertProber {
 	sitesCertificates := make([]SiteCertProber, 0)
 	for _, configSite := range configSites {
-		siteCertificate, err := Init(configSite)
+		if ctx.Err() != nil {
+			return sitesCertificates
+		}
+		siteCertificate, err := Init(ctx, configSite)
 		if err == nil {
 			sitesCertificates = append(sitesCertificates, siteCertificate)
 		} else {
@@ -54,47 +161,55 @@ func InitMulti(configSites []CertificateFetchConfig) []SiteCertProber {
 }
 
 // Build a client by extracting certificate from site.
-func Init(siteConfig CertificateFetchConfig) (SiteCertProber, error) {
+func Init(ctx context.Context, siteConfig CertificateFetchConfig) (SiteCertProber, error) {
 	domain, err := publicsuffix.Domain(siteConfig.URL)
 	if err != nil {
 		log.Error("For [", siteConfig.URL, "]; can't found the domain; ", err)
 	}
-	extract, err := extractCertificate(siteConfig)
-	if err != nil {
+	client := &Client{
+		Domain: domain,
+		Config: siteConfig,
+	}
+	if err := client.Refresh(ctx); err != nil {
 		return nil, err
-
 	}
-	return &Client{
-		Domain:      domain,
-		Certificate: extract,
-		Config:      siteConfig,
-	}, nil
+	return client, nil
 }
 
 // Method to refresh the certificate of a site, used to be sure the days left change to 90 days left.
-func (certifExtract *Client) Refresh() error {
-	extract, err := extractCertificate(certifExtract.Config)
+// The OCSP status of the certificate, and the response stapled by the site, are checked again.
+func (certifExtract *Client) Refresh(ctx context.Context) error {
+	extract, state, err := extractCertificate(ctx, certifExtract.Config)
 	if err != nil {
 		return err
 	}
 	certifExtract.Certificate = extract
+	certifExtract.OCSP = CheckOCSP(ctx, extract, issuerOf(extract, state.PeerCertificates), state.OCSPResponse)
+	if certifExtract.OCSP.Error != "" {
+		log.Warn("[", certifExtract.Config.URL, "] OCSP status not checked: ", certifExtract.OCSP.Error)
+	}
 	return nil
 }
 
+// Return the OCSP status of the last certificate extracted from the site.
+func (certifExtract *Client) GetOCSPStatus() OCSPStatus {
+	return certifExtract.OCSP
+}
+
 // Method who return the certificate validity days left.
 func (certifExtract *Client) DaysLeft() int {
 	return int(ComputeDaysLeft(certifExtract.Certificate))
 }
 
-// Method to check if this certificate belongs to the site request.
+// Method to check if this certificate covers every name of the site.
 func (certifExtract *Client) IsSiteValid() bool {
-	return certifExtract.Certificate.Subject.CommonName == certifExtract.Config.URL
+	return len(MissingNames(certifExtract.Certificate, certifExtract.Config.GetNames())) == 0
 }
 
 // Regroup the 3 methods above and return the number of days remaining.
-func (certifExtract *Client) RefreshCertifAndGetDaysLeft() (int, error) {
+func (certifExtract *Client) RefreshCertifAndGetDaysLeft(ctx context.Context) (int, error) {
 	// Refresh certificates of the siteConfig
-	err := certifExtract.Refresh()
+	err := certifExtract.Refresh(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -105,9 +220,9 @@ func (certifExtract *Client) RefreshCertifAndGetDaysLeft() (int, error) {
 		return 0, nil
 	}
 
-	// Look if the CommonName match with the SiteUrl
-	if !certifExtract.IsSiteValid() {
-		return day, errors.New("The domain name is wrong for this siteConfig: " + certifExtract.Config.URL)
+	// Look if the certificate covers every name of the site
+	if missing := MissingNames(certifExtract.Certificate, certifExtract.Config.GetNames()); len(missing) > 0 {
+		return day, errors.New("The certificate of " + certifExtract.Config.URL + " doesn't cover: " + strings.Join(missing, ", "))
 	}
 	return day, err
 }
@@ -120,21 +235,69 @@ func (certifExtract *Client) GetDomain() string {
 	return certifExtract.Domain
 }
 
-// Dial connects to the given network address using net.Dial,
-// is a valid certificate for the named host
-func extractCertificate(site CertificateFetchConfig) (*x509.Certificate, error) {
-	fullSite := site.URL + ":" + strconv.Itoa(site.Port)
-	conn, err := tls.Dial("tcp", fullSite, &tls.Config{InsecureSkipVerify: true})
+// Return the last certificate extracted from the site.
+func (certifExtract *Client) GetCertificate() *x509.Certificate {
+	return certifExtract.Certificate
+}
+
+// Dial connects to the given network address using net.Dialer,
+// is a valid certificate for the named host.
+// The connection and the handshake are aborted when the context is cancelled.
+// The state of the connection gives the chain and the OCSP response stapled.
+func extractCertificate(ctx context.Context, site CertificateFetchConfig) (*x509.Certificate, tls.ConnectionState, error) {
+	state, err := dialTLS(ctx, site.URL, site.Port, site.URL, DialTimeout)
 	if err != nil {
-		return nil, err
+		return nil, state, err
 	}
-	for _, peerCertificate := range conn.ConnectionState().PeerCertificates {
+	for _, peerCertificate := range state.PeerCertificates {
 		err := peerCertificate.VerifyHostname(site.URL)
 		if err == nil {
-			return peerCertificate, nil
+			return peerCertificate, state, nil
+		}
+	}
+	return nil, state, errors.New("No valid certificate found for [" + site.URL + "].")
+}
+
+// Return the certificate presented at the address, without checking it.
+// The server name is sent with SNI when it is not empty. Used to scan the networks.
+func ProbeAddress(ctx context.Context, host string, port int, serverName string, timeout time.Duration) (*x509.Certificate, error) {
+	state, err := dialTLS(ctx, host, port, serverName, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("No certificate presented by " + net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return state.PeerCertificates[0], nil
+}
+
+// The client asks the server to staple the OCSP response of its certificate.
+func dialTLS(ctx context.Context, host string, port int, serverName string, timeout time.Duration) (tls.ConnectionState, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	rawConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer rawConn.Close()
+	// The handshake can't last longer than the dial.
+	_ = rawConn.SetDeadline(time.Now().Add(timeout))
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = rawConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	if err := conn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return tls.ConnectionState{}, ctx.Err()
 		}
+		return tls.ConnectionState{}, err
 	}
-	return nil, errors.New("No valid certificate found for [" + site.URL + "].")
+	return conn.ConnectionState(), nil
 }
 
 func ComputeDaysLeft(certificate *x509.Certificate) int64 {
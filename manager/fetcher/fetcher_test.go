@@ -0,0 +1,38 @@
+package fetcher
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+)
+
+func TestGetNames(t *testing.T) {
+	config := CertificateFetchConfig{URL: "www.example.com", Names: []string{"example.com", "WWW.example.com"}}
+	if names := config.GetNames(); !reflect.DeepEqual(names, []string{"www.example.com", "example.com"}) {
+		t.Error("Unexpected names: ", names)
+	}
+}
+
+func TestMissingNames(t *testing.T) {
+	certificate := &x509.Certificate{DNSNames: []string{"example.com", "*.example.com"}}
+	missing := MissingNames(certificate, []string{"example.com", "www.example.com", "a.b.example.com", "example.org"})
+	if !reflect.DeepEqual(missing, []string{"a.b.example.com", "example.org"}) {
+		t.Error("Unexpected missing names: ", missing)
+	}
+	client := &Client{Certificate: certificate, Config: CertificateFetchConfig{URL: "example.com", Names: []string{"www.example.com"}}}
+	if !client.IsSiteValid() {
+		t.Error("The certificate covers every name of the site")
+	}
+	client.Config.Names = append(client.Config.Names, "example.org")
+	if client.IsSiteValid() {
+		t.Error("The certificate doesn't cover example.org")
+	}
+}
+
+func TestMissingWildcardNames(t *testing.T) {
+	certificate := &x509.Certificate{DNSNames: []string{"*.example.com"}}
+	missing := MissingNames(certificate, []string{"*.example.com", "*.example.org", "shop.example.com"})
+	if !reflect.DeepEqual(missing, []string{"*.example.org"}) {
+		t.Error("Unexpected missing names: ", missing)
+	}
+}
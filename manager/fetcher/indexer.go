@@ -19,7 +19,6 @@ type SitesPerDomain struct {
 func IndexSitesPerDomains(sitesList []SiteCertProber) []SitesPerDomain {
 	domainsSorted := make([]SitesPerDomain, 0)
 	domainExists := false
-	sitesList[0].GetConfig()
 	for _, site := range sitesList {
 		for index, domainSorted := range domainsSorted {
 			if site.GetDomain() == domainSorted.Name {
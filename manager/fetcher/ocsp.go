@@ -0,0 +1,227 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Maximum time to get the OCSP response of a certificate.
+const OCSPTimeout = 10 * time.Second
+
+// Age of a staple without next update from which it is stale.
+const StapleMaxAge = 7 * 24 * time.Hour
+
+// Statuses of a certificate given by the OCSP responder of its CA.
+const (
+	OCSPGood        = "good"
+	OCSPRevoked     = "revoked"
+	OCSPUnknown     = "unknown"
+	OCSPUnavailable = "unavailable" // The responder, or the issuer of the certificate, couldn't be reached.
+	OCSPNone        = "none"        // The certificate has no OCSP responder, nothing to check or staple.
+)
+
+// Statuses of the OCSP response stapled by the server during the handshake.
+const (
+	StapleValid   = "valid"
+	StapleMissing = "missing"
+	StapleStale   = "stale"
+	StapleInvalid = "invalid"
+)
+
+// Result of the OCSP check of the certificate served by a site.
+type OCSPStatus struct {
+	Status           string    `json:"status"`
+	RevokedAt        time.Time `json:"revoked_at,omitempty"`
+	RevocationReason int       `json:"revocation_reason,omitempty"`
+	NextUpdate       time.Time `json:"next_update,omitempty"`
+	Staple           string    `json:"staple,omitempty"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// Revoked certificates are critical, they must be replaced now.
+func (status OCSPStatus) IsRevoked() bool {
+	return status.Status == OCSPRevoked
+}
+
+// A missing, stale or invalid staple is a warning: the clients ask the responder themselves, or fail with must-staple.
+func (status OCSPStatus) HasStapleWarning() bool {
+	return status.Staple == StapleMissing || status.Staple == StapleStale || status.Staple == StapleInvalid
+}
+
+// Implemented by the probers checking the OCSP status of the certificate they extract.
+type OCSPProber interface {
+	GetOCSPStatus() OCSPStatus
+}
+
+// Ask the OCSP responder of the certificate its status, and check the response stapled by the server.
+// A revocation seen in the staple is reported even if the responder can't be reached.
+func CheckOCSP(ctx context.Context, leaf *x509.Certificate, issuer *x509.Certificate, staple []byte) OCSPStatus {
+	if len(leaf.OCSPServer) == 0 {
+		return OCSPStatus{Status: OCSPNone}
+	}
+	if issuer == nil {
+		var err error
+		if issuer, err = fetchIssuer(ctx, leaf); err != nil {
+			return OCSPStatus{Status: OCSPUnavailable, Error: "the issuer of the certificate isn't presented by the server: " + err.Error()}
+		}
+	}
+	status := OCSPStatus{Staple: checkStaple(leaf, issuer, staple, time.Now())}
+	response, err := queryOCSP(ctx, leaf.OCSPServer[0], leaf, issuer)
+	if err != nil {
+		status.Status = OCSPUnavailable
+		status.Error = err.Error()
+		if stapled, err := parseResponse(staple, leaf, issuer); err == nil && stapled.Status == ocsp.Revoked {
+			setResponse(&status, stapled)
+		}
+		return status
+	}
+	setResponse(&status, response)
+	return status
+}
+
+func setResponse(status *OCSPStatus, response *ocsp.Response) {
+	switch response.Status {
+	case ocsp.Good:
+		status.Status = OCSPGood
+	case ocsp.Revoked:
+		status.Status = OCSPRevoked
+		status.RevokedAt = response.RevokedAt
+		status.RevocationReason = response.RevocationReason
+	default:
+		status.Status = OCSPUnknown
+	}
+	status.NextUpdate = response.NextUpdate
+}
+
+// Return the status of the staple: it must be signed for the certificate, and not be past its next update.
+func checkStaple(leaf *x509.Certificate, issuer *x509.Certificate, staple []byte, now time.Time) string {
+	if len(staple) == 0 {
+		return StapleMissing
+	}
+	response, err := parseResponse(staple, leaf, issuer)
+	if err != nil {
+		return StapleInvalid
+	}
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return StapleStale
+	}
+	if response.NextUpdate.IsZero() && now.Sub(response.ThisUpdate) > StapleMaxAge {
+		return StapleStale
+	}
+	return StapleValid
+}
+
+// Send the OCSP request with a POST, accepted by every responder.
+func queryOCSP(ctx context.Context, responder string, leaf *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, OCSPTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+	httpRequest.Header.Set("Accept", "application/ocsp-response")
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.New("The OCSP responder " + responder + " answered " + strconv.Itoa(httpResponse.StatusCode))
+	}
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(body, leaf, issuer)
+}
+
+// Parse the OCSP response, it must be signed for the issuer and give the status of the leaf.
+func parseResponse(response []byte, leaf *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	parsed, err := ocsp.ParseResponseForCert(response, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.SerialNumber == nil || parsed.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		return nil, errors.New("The OCSP response is for another certificate")
+	}
+	return parsed, nil
+}
+
+// Issuers downloaded from the AIA of the certificates, by URL: they don't change during their lifetime.
+var fetchedIssuers sync.Map
+
+// Download the issuer of the certificate from its Authority Information Access,
+// when the server doesn't present it.
+func fetchIssuer(ctx context.Context, leaf *x509.Certificate) (*x509.Certificate, error) {
+	if len(leaf.IssuingCertificateURL) == 0 {
+		return nil, errors.New("the certificate has no issuer URL")
+	}
+	var lastErr error
+	for _, issuerURL := range leaf.IssuingCertificateURL {
+		if cached, ok := fetchedIssuers.Load(issuerURL); ok && leaf.CheckSignatureFrom(cached.(*x509.Certificate)) == nil {
+			return cached.(*x509.Certificate), nil
+		}
+		issuer, err := downloadIssuer(ctx, issuerURL)
+		if err == nil {
+			err = leaf.CheckSignatureFrom(issuer)
+		}
+		if err != nil {
+			lastErr = errors.New(issuerURL + ": " + err.Error())
+			continue
+		}
+		fetchedIssuers.Store(issuerURL, issuer)
+		return issuer, nil
+	}
+	return nil, lastErr
+}
+
+// The issuer is served in DER, or in PEM by some CAs.
+func downloadIssuer(ctx context.Context, issuerURL string) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, OCSPTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, issuerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.New("answered " + strconv.Itoa(httpResponse.StatusCode))
+	}
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	return x509.ParseCertificate(body)
+}
+
+// Return the certificate of the chain which signed the leaf.
+func issuerOf(leaf *x509.Certificate, chain []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range chain {
+		if candidate != leaf && leaf.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
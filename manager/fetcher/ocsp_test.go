@@ -0,0 +1,198 @@
+package fetcher
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// A CA with its OCSP responder, answering the status set by the test.
+type ocspResponder struct {
+	*httptest.Server
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+	mutex       sync.Mutex
+	status      int
+}
+
+func newOCSPResponder(t *testing.T) *ocspResponder {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(certificateDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := &ocspResponder{Certificate: certificate, Key: key, status: ocsp.Good}
+	responder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/issuer" {
+			_, _ = w.Write(responder.Certificate.Raw)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		responder.mutex.Lock()
+		status := responder.status
+		responder.mutex.Unlock()
+		_, _ = w.Write(responder.response(t, request.SerialNumber, status, time.Now().Add(time.Hour)))
+	}))
+	return responder
+}
+
+func (responder *ocspResponder) setStatus(status int) {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	responder.status = status
+}
+
+func (responder *ocspResponder) response(t *testing.T, serial *big.Int, status int, nextUpdate time.Time) []byte {
+	response, err := ocsp.CreateResponse(responder.Certificate, responder.Certificate, ocsp.Response{
+		Status:           status,
+		SerialNumber:     serial,
+		ThisUpdate:       nextUpdate.Add(-2 * time.Hour),
+		NextUpdate:       nextUpdate,
+		RevokedAt:        time.Now().Add(-time.Minute),
+		RevocationReason: ocsp.KeyCompromise,
+	}, responder.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Issue a certificate for localhost, checked with the responder.
+func (responder *ocspResponder) issue(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{responder.URL},
+		// Where the issuer is downloaded when the server doesn't present it.
+		IssuingCertificateURL: []string{responder.URL + "/issuer"},
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, responder.Certificate, &key.PublicKey, responder.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificateDER, responder.Certificate.Raw}, PrivateKey: key}
+}
+
+func TestOCSPStatusAndStapling(t *testing.T) {
+	responder := newOCSPResponder(t)
+	defer responder.Close()
+	served := responder.issue(t)
+	var mutex sync.Mutex
+	staple := responder.response(t, big.NewInt(42), ocsp.Good, time.Now().Add(time.Hour))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			certificate := served
+			certificate.OCSPStaple = staple
+			return &certificate, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	site, err := Init(context.Background(), CertificateFetchConfig{URL: "localhost", Port: listener.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := site.(OCSPProber).GetOCSPStatus()
+	if status.Status != OCSPGood || status.Staple != StapleValid {
+		t.Error("Expected ", OCSPGood, " with a valid staple got ", status)
+	}
+
+	// The certificate is revoked, the server still staples its last response, expired.
+	responder.setStatus(ocsp.Revoked)
+	mutex.Lock()
+	staple = responder.response(t, big.NewInt(42), ocsp.Good, time.Now().Add(-time.Minute))
+	mutex.Unlock()
+	if err := site.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status = site.(OCSPProber).GetOCSPStatus()
+	if !status.IsRevoked() || status.RevocationReason != ocsp.KeyCompromise || status.Staple != StapleStale {
+		t.Error("Expected ", OCSPRevoked, " with a stale staple got ", status)
+	}
+
+	mutex.Lock()
+	staple = nil
+	mutex.Unlock()
+	if err := site.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := site.(OCSPProber).GetOCSPStatus(); status.Staple != StapleMissing || !status.HasStapleWarning() {
+		t.Error("Expected ", StapleMissing, " got ", status.Staple)
+	}
+}
+
+func TestOCSPIssuerFromAIA(t *testing.T) {
+	responder := newOCSPResponder(t)
+	defer responder.Close()
+	leaf, err := x509.ParseCertificate(responder.issue(t).Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := CheckOCSP(context.Background(), leaf, nil, nil); status.Status != OCSPGood {
+		t.Error("Expected ", OCSPGood, " with the issuer downloaded, got ", status)
+	}
+}
+
+func TestOCSPWithoutResponder(t *testing.T) {
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(42)}
+	if status := CheckOCSP(context.Background(), leaf, nil, nil); status.Status != OCSPNone || status.HasStapleWarning() {
+		t.Error("Expected ", OCSPNone, " without warning got ", status)
+	}
+}
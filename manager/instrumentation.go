@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/metrics"
+)
+
+// Names of the metrics exposed by the manager.
+const (
+	MetricSiteDaysLeft          = "certificate_manager_site_days_left"
+	MetricSiteNotAfter          = "certificate_manager_site_not_after_timestamp_seconds"
+	MetricSiteProbeSuccess      = "certificate_manager_site_probe_success"
+	MetricSiteLastRenewal       = "certificate_manager_site_last_renewal_timestamp_seconds"
+	MetricSiteLastRenewalResult = "certificate_manager_site_last_renewal_success"
+	MetricDomainRenewals        = "certificate_manager_domain_renewals_total"
+	MetricDomainRenewalFailures = "certificate_manager_domain_renewal_failures_total"
+	MetricDomainRemainingLE     = "certificate_manager_domain_remaining_le_queries"
+	MetricUpdaterDeployDuration = "certificate_manager_updater_deploy_duration_seconds"
+	MetricUpdaterReloadDuration = "certificate_manager_updater_reload_duration_seconds"
+	MetricNotificationFailures  = "certificate_manager_notification_failures_total"
+	MetricSiteOCSPRevoked       = "certificate_manager_site_ocsp_revoked"
+	MetricSiteOCSPStapleValid   = "certificate_manager_site_ocsp_staple_valid"
+)
+
+// Probe every indexed site again, with the OCSP status of its certificate, and update the certificate
+// and rate limit metrics. The sites are probed even without metrics, a certificate can be revoked at any time.
+func (CertManager *CertManager) refreshSitesMetrics(ctx context.Context) {
+	CertManager.Metrics.Reset(MetricSiteDaysLeft)
+	CertManager.Metrics.Reset(MetricSiteNotAfter)
+	CertManager.Metrics.Reset(MetricSiteProbeSuccess)
+	CertManager.Metrics.Reset(MetricSiteOCSPRevoked)
+	CertManager.Metrics.Reset(MetricSiteOCSPStapleValid)
+	CertManager.Metrics.Reset(MetricDomainRemainingLE)
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			labels := siteLabels(site)
+			if err := site.Refresh(ctx); err != nil {
+				CertManager.Metrics.SetGauge(MetricSiteProbeSuccess, "1 if the last TLS probe of the site succeeded.", labels, 0)
+			} else {
+				CertManager.Metrics.SetGauge(MetricSiteProbeSuccess, "1 if the last TLS probe of the site succeeded.", labels, 1)
+			}
+			if certificate := site.GetCertificate(); certificate != nil {
+				CertManager.Metrics.SetGauge(MetricSiteDaysLeft, "Days left before the site certificate expires.",
+					labels, float64(site.DaysLeft()))
+				CertManager.Metrics.SetGauge(MetricSiteNotAfter, "NotAfter of the site certificate, as a unix timestamp.",
+					labels, float64(certificate.NotAfter.Unix()))
+			}
+			if status, ok := ocspStatusOf(site); ok {
+				CertManager.Metrics.SetGauge(MetricSiteOCSPRevoked, "1 if the OCSP responder gives the site certificate as revoked.",
+					labels, boolValue(status.IsRevoked()))
+				CertManager.Metrics.SetGauge(MetricSiteOCSPStapleValid, "1 if the site staples a valid and fresh OCSP response.",
+					labels, boolValue(status.Staple == fetcher.StapleValid))
+			}
+		}
+		for _, ca := range CertManager.authorities() {
+			CertManager.Metrics.SetGauge(MetricDomainRemainingLE, "Orders left at the CA for the domain in the next 7 days.",
+				metrics.Labels{"domain": domain.Name, "ca": ca.Name}, float64(CertManager.remainingOrders(ca, RateLimitDays, domain)))
+		}
+	}
+}
+
+// Record the time and the result of a renewal for the sites of a certificate and its domain.
+// The renewal counts once, for the domain of the first site.
+func (CertManager *CertManager) recordRenewal(sites []fetcher.SiteCertProber, err error) {
+	if len(sites) == 0 {
+		return
+	}
+	result := 1.0
+	domainLabels := metrics.Labels{"domain": sites[0].GetDomain()}
+	if err != nil {
+		result = 0
+		CertManager.Metrics.AddCounter(MetricDomainRenewalFailures, "Failed renewals per domain.", domainLabels, 1)
+	} else {
+		CertManager.Metrics.AddCounter(MetricDomainRenewals, "Successful renewals per domain.", domainLabels, 1)
+	}
+	for _, site := range sites {
+		CertManager.Metrics.SetGauge(MetricSiteLastRenewal, "Time of the last renewal attempt, as a unix timestamp.",
+			siteLabels(site), float64(time.Now().Unix()))
+		CertManager.Metrics.SetGauge(MetricSiteLastRenewalResult, "1 if the last renewal attempt succeeded.",
+			siteLabels(site), result)
+	}
+}
+
+func (CertManager *CertManager) recordDeployDuration(updaterName string, start time.Time) {
+	CertManager.Metrics.SetGauge(MetricUpdaterDeployDuration, "Duration of the last certificate deployment per updater.",
+		metrics.Labels{"updater": updaterName}, time.Since(start).Seconds())
+}
+
+func (CertManager *CertManager) recordReloadDuration(updaterName string, start time.Time) {
+	CertManager.Metrics.SetGauge(MetricUpdaterReloadDuration, "Duration of the last HTTP server reload per updater.",
+		metrics.Labels{"updater": updaterName}, time.Since(start).Seconds())
+}
+
+func (CertManager *CertManager) recordNotificationFailure(notifierName string) {
+	CertManager.Metrics.AddCounter(MetricNotificationFailures, "Notifications that couldn't be delivered after the retries.",
+		metrics.Labels{"notifier": notifierName}, 1)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func siteLabels(site fetcher.SiteCertProber) metrics.Labels {
+	return metrics.Labels{"site": site.GetConfig().URL, "domain": site.GetDomain()}
+}
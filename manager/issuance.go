@@ -0,0 +1,235 @@
+package manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	log "github.com/sirupsen/logrus"
+	"github.com/weppos/publicsuffix-go/publicsuffix"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Answer the challenges with the DNS server, and ask the CA a single certificate for every name,
+// for the CSR of the certificate when it has one, or for the key of the variant.
+func (CertManager *CertManager) requestCertificate(ctx context.Context, config certificates.Config, variant certificates.Variant, ca CA, DNSServer dns.DNSServer) (*certificate.Resource, error) {
+	if ca.LetsEncrypt.Client == nil {
+		return nil, errors.New("The ACME client of [" + ca.Name + "] isn't initialized")
+	}
+	if err := ca.LetsEncrypt.SetDNSProvider(dns.DNSProvider{DNSServer: contextDNSServer{DNSServer, ctx}}); err != nil {
+		return nil, err
+	}
+	if config.CSR != "" {
+		csr, err := certificates.ReadCSR(config.CSR)
+		if err != nil {
+			return nil, err
+		}
+		return ca.LetsEncrypt.Client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{CSR: csr, Bundle: true})
+	}
+	privateKey, err := CertManager.privateKeyFor(config, variant)
+	if err != nil {
+		return nil, err
+	}
+	return ca.LetsEncrypt.Client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains:    config.Names,
+		Bundle:     true,
+		PrivateKey: privateKey,
+	})
+}
+
+// Return the private key of the variant: the key of the previous certificate with key_reuse,
+// if it is still of the key type, or a new one. Without key type, the ACME client generates it.
+func (CertManager *CertManager) privateKeyFor(config certificates.Config, variant certificates.Variant) (crypto.PrivateKey, error) {
+	if variant.KeyType == "" && !config.KeyReuse {
+		return nil, nil
+	}
+	keyType := certificates.KeyTypes[certificates.DefaultKeyType]
+	if variant.KeyType != "" {
+		var ok bool
+		if keyType, ok = certificates.KeyTypes[variant.KeyType]; !ok {
+			return nil, errors.New("Unknown key type [" + variant.KeyType + "]")
+		}
+	}
+	if config.KeyReuse {
+		_, privateKeyFile := config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+		if keyBytes, err := ioutil.ReadFile(privateKeyFile); err == nil {
+			privateKey, err := certcrypto.ParsePEMPrivateKey(keyBytes)
+			if err == nil && certificates.IsKeyType(privateKey, keyType) {
+				return privateKey, nil
+			}
+			log.Warn("[", config.Name, "] The previous private key can't be reused, a new one is generated.")
+		}
+	}
+	return certificates.GeneratePrivateKey(keyType)
+}
+
+// Obtain every variant of the certificate from the CA, then write them in their storage, where the updaters read them:
+// a variant failing leaves the files of the previous certificate. The variants obtained are returned with the error,
+// they count in the rate limits anyway.
+func (CertManager *CertManager) obtainFromCA(ctx context.Context, config certificates.Config, ca CA, DNSServer dns.DNSServer) ([]*x509.Certificate, error) {
+	variants := config.Variants()
+	resources := make([]*certificate.Resource, 0, len(variants))
+	issued := make([]*x509.Certificate, 0, len(variants))
+	for _, variant := range variants {
+		resource, err := CertManager.requestCertificate(ctx, config, variant, ca, DNSServer)
+		if err != nil {
+			return issued, err
+		}
+		parsed, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+		if err != nil {
+			return issued, err
+		}
+		resources = append(resources, resource)
+		issued = append(issued, parsed)
+	}
+	for index, variant := range variants {
+		certificateFile, privateKeyFile := config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+		if config.CSR != "" {
+			privateKeyFile = ""
+		}
+		if err := writeCertificateFiles(certificateFile, privateKeyFile, resources[index]); err != nil {
+			return issued, err
+		}
+	}
+	return issued, nil
+}
+
+// Order the certificate from its CAs, in order: a CA failing, or without orders left this week
+// for one of the domains of its names, falls back to the next one.
+// Every variant issued, even when another one fails, is written in the ledger of its CA, once for each of these domains.
+// Every variant of the certificate is issued by the same CA.
+func (CertManager *CertManager) orderCertificate(ctx context.Context, certificate *ManagedCertificate, DNSServer dns.DNSServer) ([]*x509.Certificate, error) {
+	domains := CertManager.registeredDomains(certificate)
+	if err := CertManager.validateOnStaging(ctx, certificate, DNSServer); err != nil {
+		return nil, err
+	}
+	failures := make([]string, 0)
+	for _, ca := range CertManager.caOrder(certificate.Config) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if exhausted := CertManager.exhaustedDomains(ca, domains, len(certificate.Config.Variants())); len(exhausted) > 0 {
+			failures = append(failures, ca.Name+": no orders left this week for "+strings.Join(exhausted, ", "))
+			continue
+		}
+		issued, err := CertManager.obtainFromCA(ctx, certificate.Config, ca, DNSServer)
+		for _, domain := range domains {
+			for _, variant := range issued {
+				CertManager.recordOrder(ca, domain.Name, certificate.Config.Name, variant)
+			}
+		}
+		if err != nil {
+			log.Warn("[", certificate.Config.Name, "] The CA [", ca.Name, "] failed: ", err.Error())
+			failures = append(failures, ca.Name+": "+err.Error())
+			continue
+		}
+		log.Info("[", certificate.Config.Name, "] Issued by the CA [", ca.Name, "]")
+		return issued, nil
+	}
+	if len(failures) == 0 {
+		return nil, errors.New("No CA is configured")
+	}
+	return nil, errors.New("No CA issued the certificate: " + strings.Join(failures, "; "))
+}
+
+// Return the registered domains of the names of the certificate, the one of its first probe first,
+// with their indexed sites when they are monitored.
+func (CertManager *CertManager) registeredDomains(certificate *ManagedCertificate) []fetcher.SitesPerDomain {
+	names := []string{certificate.Probes[0].GetDomain()}
+	for _, name := range certificate.Config.Names {
+		if domain, err := publicsuffix.Domain(strings.TrimPrefix(name, "*.")); err == nil {
+			names = append(names, domain)
+		}
+	}
+	known := make(map[string]bool)
+	domains := make([]fetcher.SitesPerDomain, 0)
+	for _, name := range names {
+		if known[name] {
+			continue
+		}
+		known[name] = true
+		domain := fetcher.SitesPerDomain{Name: name, Sites: certificate.Probes}
+		for _, indexed := range CertManager.IndexedSites {
+			if indexed.Name == name {
+				domain = indexed
+			}
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// Return the domains the CA doesn't accept the given number of orders for this week, one for each variant.
+func (CertManager *CertManager) exhaustedDomains(ca CA, domains []fetcher.SitesPerDomain, orders int) []string {
+	exhausted := make([]string, 0)
+	for _, domain := range domains {
+		if CertManager.remainingOrders(ca, RateLimitDays, domain) < orders {
+			exhausted = append(exhausted, domain.Name)
+		}
+	}
+	return exhausted
+}
+
+// Without private key file, the key of a CSR stays with its owner.
+func writeCertificateFiles(certificateFile string, privateKeyFile string, resource *certificate.Resource) error {
+	if err := os.MkdirAll(filepath.Dir(certificateFile), 0700); err != nil {
+		return err
+	}
+	if privateKeyFile != "" {
+		if err := os.MkdirAll(filepath.Dir(privateKeyFile), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(privateKeyFile, resource.PrivateKey, 0600); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(certificateFile, resource.Certificate, 0644)
+}
+
+// Find the authoritative DNS server of every name of a certificate.
+func (CertManager *CertManager) dnsServerForNames(names []string) (dns.DNSServer, error) {
+	servers := make(map[string]dns.DNSServer)
+	for _, name := range names {
+		DNSServer, err := CertManager.GetDNSProviderForSite(name)
+		if err != nil {
+			return nil, errors.New(err.Error() + " for " + name)
+		}
+		servers[name] = DNSServer
+	}
+	if len(names) == 1 {
+		return servers[names[0]], nil
+	}
+	return namesDNSServer{DNSServer: servers[names[0]], servers: servers}, nil
+}
+
+// Send the challenge of each name of a certificate to its own DNS server,
+// the names can belong to different zones.
+type namesDNSServer struct {
+	dns.DNSServer
+	servers map[string]dns.DNSServer
+}
+
+func (server namesDNSServer) AddTXTRecord(domain, name, value string) error {
+	return server.serverFor(domain).AddTXTRecord(domain, name, value)
+}
+
+func (server namesDNSServer) CleanTXTRecord(domain, name string) error {
+	return server.serverFor(domain).CleanTXTRecord(domain, name)
+}
+
+func (server namesDNSServer) serverFor(domain string) dns.DNSServer {
+	if DNSServer, ok := server.servers[strings.TrimSuffix(strings.ToLower(domain), ".")]; ok {
+		return DNSServer
+	}
+	return server.DNSServer
+}
@@ -0,0 +1,265 @@
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Types of job that can be asked on demand.
+const (
+	JobForceRenew  = "renew"
+	JobRedeploy    = "deploy"
+	JobProbeSite   = "probe-site"
+	JobProbeDomain = "probe-domain"
+)
+
+// States of a job.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobDeferred  = "deferred" // Done, but the upload waits for the deployment window of an updater.
+)
+
+const (
+	jobsQueueSize   = 100
+	maxJobsInMemory = 500
+)
+
+// A renewal, a deployment or a probe asked on demand.
+// Jobs are run one by one, never at the same time as a ParseSites cycle.
+type Job struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"`
+	Target   string         `json:"target"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	DaysLeft map[string]int `json:"days_left,omitempty"`
+	Created  time.Time      `json:"created"`
+	Started  time.Time      `json:"started,omitempty"`
+	Finished time.Time      `json:"finished,omitempty"`
+}
+
+type jobQueue struct {
+	once  sync.Once
+	mutex sync.RWMutex
+	queue chan *Job
+	jobs  map[string]*Job
+	order []string
+}
+
+func (CertManager *CertManager) initJobQueue() {
+	CertManager.jobs.once.Do(func() {
+		CertManager.jobs.queue = make(chan *Job, jobsQueueSize)
+		CertManager.jobs.jobs = make(map[string]*Job)
+	})
+}
+
+// Queue a job and return it with its ID, the job is run by RunJobs.
+func (CertManager *CertManager) SubmitJob(jobType string, target string) (Job, error) {
+	CertManager.initJobQueue()
+	// The targets are checked against the status, the indexed sites belong to the running cycle.
+	switch jobType {
+	case JobForceRenew, JobRedeploy, JobProbeSite:
+		if !CertManager.isKnownSite(target) {
+			return Job{}, errors.New("Unknown site [" + target + "]")
+		}
+	case JobProbeDomain:
+		if !CertManager.isKnownDomain(target) {
+			return Job{}, errors.New("Unknown domain [" + target + "]")
+		}
+	default:
+		return Job{}, errors.New("Unknown job type " + jobType)
+	}
+	job := &Job{
+		ID:      newJobID(),
+		Type:    jobType,
+		Target:  target,
+		Status:  JobQueued,
+		Created: time.Now(),
+	}
+	CertManager.jobs.mutex.Lock()
+	CertManager.jobs.jobs[job.ID] = job
+	CertManager.jobs.order = append(CertManager.jobs.order, job.ID)
+	CertManager.pruneJobs()
+	jobCopy := *job
+	CertManager.jobs.mutex.Unlock()
+	select {
+	case CertManager.jobs.queue <- job:
+		return jobCopy, nil
+	default:
+		CertManager.finishJob(job, errors.New("The job queue is full"), false)
+		return Job{}, errors.New("The job queue is full")
+	}
+}
+
+// Return a copy of the job, and false if the ID is unknown.
+func (CertManager *CertManager) GetJob(id string) (Job, bool) {
+	CertManager.initJobQueue()
+	CertManager.jobs.mutex.RLock()
+	defer CertManager.jobs.mutex.RUnlock()
+	job, ok := CertManager.jobs.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Run the queued jobs until the context is cancelled.
+func (CertManager *CertManager) RunJobs(ctx context.Context) {
+	CertManager.initJobQueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-CertManager.jobs.queue:
+			CertManager.runJob(ctx, job)
+		}
+	}
+}
+
+func (CertManager *CertManager) runJob(ctx context.Context, job *Job) {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	CertManager.jobs.mutex.Lock()
+	job.Status = JobRunning
+	job.Started = time.Now()
+	CertManager.jobs.mutex.Unlock()
+
+	var err error
+	deferred := false
+	daysLeft := make(map[string]int)
+	site := CertManager.FindSite(job.Target)
+	domain := CertManager.findDomain(job.Target)
+	switch {
+	case job.Type == JobProbeDomain && domain == nil:
+		err = errors.New("Unknown domain [" + job.Target + "]")
+	case job.Type != JobProbeDomain && site == nil:
+		err = errors.New("Unknown site [" + job.Target + "]")
+	case job.Type == JobForceRenew:
+		err = CertManager.ForceRenewForSite(ctx, site)
+		CertManager.recordRenewal(CertManager.probesOf(site), err)
+		CertManager.recordRenewalStatus(CertManager.probesOf(site), err)
+		deferred = err == nil && CertManager.isDeferred(site)
+	case job.Type == JobRedeploy:
+		var certificate *ManagedCertificate
+		if certificate, err = CertManager.certificateOf(site); err == nil {
+			err = CertManager.Deploy(ctx, certificate)
+		}
+		deferred = err == nil && CertManager.isDeferred(site)
+	case job.Type == JobProbeSite:
+		err = probeSites(ctx, daysLeft, site)
+	case job.Type == JobProbeDomain:
+		err = probeSites(ctx, daysLeft, domain.Sites...)
+	}
+	CertManager.snapshotStatus()
+	CertManager.jobs.mutex.Lock()
+	job.DaysLeft = daysLeft
+	CertManager.jobs.mutex.Unlock()
+	CertManager.finishJob(job, err, deferred)
+}
+
+func (CertManager *CertManager) finishJob(job *Job, err error, deferred bool) {
+	CertManager.jobs.mutex.Lock()
+	defer CertManager.jobs.mutex.Unlock()
+	job.Finished = time.Now()
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		log.Error("Job ", job.ID, " (", job.Type, " ", job.Target, ") failed: ", err.Error())
+	} else if deferred {
+		job.Status = JobDeferred
+		log.Info("Job ", job.ID, " (", job.Type, " ", job.Target, ") deferred to the next deployment window.")
+	} else {
+		job.Status = JobSucceeded
+		log.Info("Job ", job.ID, " (", job.Type, " ", job.Target, ") succeeded.")
+	}
+}
+
+// Forget the oldest finished jobs when there are too many of them.
+func (CertManager *CertManager) pruneJobs() {
+	for len(CertManager.jobs.order) > maxJobsInMemory {
+		oldest := CertManager.jobs.jobs[CertManager.jobs.order[0]]
+		if oldest != nil && (oldest.Status == JobQueued || oldest.Status == JobRunning) {
+			return
+		}
+		delete(CertManager.jobs.jobs, CertManager.jobs.order[0])
+		CertManager.jobs.order = CertManager.jobs.order[1:]
+	}
+}
+
+// Return true if the certificate of the site waits for a deployment window.
+func (CertManager *CertManager) isDeferred(site fetcher.SiteCertProber) bool {
+	certificate, err := CertManager.certificateOf(site)
+	return err == nil && CertManager.hasPendingDeployment(certificate.Config.Name)
+}
+
+// Probe the sites again and fill the days left of each of them.
+func probeSites(ctx context.Context, daysLeft map[string]int, sites ...fetcher.SiteCertProber) error {
+	var lastErr error
+	for _, site := range sites {
+		days, err := site.RefreshCertifAndGetDaysLeft(ctx)
+		if err != nil {
+			lastErr = errors.New("[" + site.GetConfig().URL + "] " + err.Error())
+			continue
+		}
+		daysLeft[site.GetConfig().URL] = days
+	}
+	return lastErr
+}
+
+// Return the indexed site with the given URL, or nil.
+func (CertManager *CertManager) FindSite(url string) fetcher.SiteCertProber {
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			if site.GetConfig().URL == url {
+				return site
+			}
+		}
+	}
+	return nil
+}
+
+func (CertManager *CertManager) isKnownSite(url string) bool {
+	for _, site := range CertManager.SitesStatus() {
+		if site.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+func (CertManager *CertManager) isKnownDomain(name string) bool {
+	for _, domain := range CertManager.DomainsStatus() {
+		if domain.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (CertManager *CertManager) findDomain(name string) *fetcher.SitesPerDomain {
+	for index := range CertManager.IndexedSites {
+		if CertManager.IndexedSites[index].Name == name {
+			return &CertManager.IndexedSites[index]
+		}
+	}
+	return nil
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,64 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Suffix of the file locked while a ledger of the configuration directory is updated, next to it.
+const LedgerLockSuffix = ".lock"
+
+// Take the lock of the ledger until the returned function is called: the daemon and the commands,
+// e.g. revoke -replace, update the same ledgers, each one reads it again under the lock before writing it.
+// Without path, the ledger only lives in memory.
+func lockLedger(path string) func() {
+	if path == "" {
+		return func() {}
+	}
+	file, err := os.OpenFile(path+LedgerLockSuffix, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		log.Error("While locking ", filepath.Base(path), ": ", err.Error())
+		return func() {}
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		log.Error("While locking ", filepath.Base(path), ": ", err.Error())
+		_ = file.Close()
+		return func() {}
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}
+}
+
+// Replace the ledger at once, so it is never read half written.
+func writeLedger(path string, ledgerBytes []byte) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(ledgerBytes); err != nil {
+		_ = temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+// Read the ledgers again before a cycle or a revocation, a command may have written them since.
+func (CertManager *CertManager) reloadLedgers() {
+	if CertManager.ConfDirPath == "" {
+		return
+	}
+	CertManager.ordersLoaded = false
+	CertManager.stagingLoaded = false
+	CertManager.revocationsLoaded = false
+	CertManager.pendingLoaded = false
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	GaugeType   = "gauge"
+	CounterType = "counter"
+
+	DefaultPath = "/metrics"
+)
+
+type Config struct {
+	Listen string `mapstructure:"listen"`
+	Path   string `mapstructure:"path"`
+}
+
+// Labels attached to one sample, like {site="www.example.com"}.
+type Labels map[string]string
+
+// Registry keeps the last value of every sample and exposes them
+// with the Prometheus text format. A nil Registry ignores every call,
+// so the manager can run without metrics.
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples map[string]*sample
+}
+
+type sample struct {
+	Labels Labels
+	Value  float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Set the current value of a gauge.
+func (registry *Registry) SetGauge(name string, help string, labels Labels, value float64) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.getSample(name, help, GaugeType, labels).Value = value
+}
+
+// Increase a counter by the given value.
+func (registry *Registry) AddCounter(name string, help string, labels Labels, value float64) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.getSample(name, help, CounterType, labels).Value += value
+}
+
+// Remove every sample of a family, used when the set of labels changes (e.g. a site is removed).
+func (registry *Registry) Reset(name string) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if metricFamily, ok := registry.families[name]; ok {
+		metricFamily.Samples = make(map[string]*sample)
+	}
+}
+
+// Return the value of a sample and false if it doesn't exist.
+func (registry *Registry) Value(name string, labels Labels) (float64, bool) {
+	if registry == nil {
+		return 0, false
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	metricFamily, ok := registry.families[name]
+	if !ok {
+		return 0, false
+	}
+	metricSample, ok := metricFamily.Samples[formatLabels(labels)]
+	if !ok {
+		return 0, false
+	}
+	return metricSample.Value, true
+}
+
+func (registry *Registry) getSample(name string, help string, metricType string, labels Labels) *sample {
+	metricFamily, ok := registry.families[name]
+	if !ok {
+		metricFamily = &family{Name: name, Help: help, Type: metricType, Samples: make(map[string]*sample)}
+		registry.families[name] = metricFamily
+	}
+	key := formatLabels(labels)
+	metricSample, ok := metricFamily.Samples[key]
+	if !ok {
+		metricSample = &sample{Labels: labels}
+		metricFamily.Samples[key] = metricSample
+	}
+	return metricSample
+}
+
+// Write every family with the Prometheus text exposition format.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(registry.Expose())
+}
+
+func (registry *Registry) Expose() []byte {
+	var buffer bytes.Buffer
+	if registry == nil {
+		return buffer.Bytes()
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metricFamily := registry.families[name]
+		buffer.WriteString("# HELP " + name + " " + metricFamily.Help + "\n")
+		buffer.WriteString("# TYPE " + name + " " + metricFamily.Type + "\n")
+		keys := make([]string, 0, len(metricFamily.Samples))
+		for key := range metricFamily.Samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buffer.WriteString(name + key + " " +
+				strconv.FormatFloat(metricFamily.Samples[key].Value, 'g', -1, 64) + "\n")
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Start the HTTP listener exposing the registry, it blocks like http.ListenAndServe.
+func ListenAndServe(config Config, registry *Registry) error {
+	path := config.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, registry)
+	return http.ListenAndServe(config.Listen, mux)
+}
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabelValue(labels[name])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"context"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Return the OCSP status of the certificate served by the site,
+// false if the prober doesn't check it or the certificate has no OCSP responder.
+func ocspStatusOf(site fetcher.SiteCertProber) (fetcher.OCSPStatus, bool) {
+	prober, ok := site.(fetcher.OCSPProber)
+	if !ok {
+		return fetcher.OCSPStatus{}, false
+	}
+	status := prober.GetOCSPStatus()
+	return status, status.Status != "" && status.Status != fetcher.OCSPNone
+}
+
+func isRevoked(site fetcher.SiteCertProber) bool {
+	status, ok := ocspStatusOf(site)
+	return ok && status.IsRevoked()
+}
+
+// Return true if one of the probes serves the certificate revoked: it is renewed, and deployed, straight away.
+func (certificate *ManagedCertificate) isRevoked() bool {
+	for _, probe := range certificate.Probes {
+		if isRevoked(probe) {
+			return true
+		}
+	}
+	return false
+}
+
+// Put the sites serving a revoked certificate first, they take the orders left before the others.
+func revokedFirst(sites []fetcher.SiteCertProber) []fetcher.SiteCertProber {
+	ordered := make([]fetcher.SiteCertProber, 0, len(sites))
+	for _, site := range sites {
+		if isRevoked(site) {
+			ordered = append(ordered, site)
+		}
+	}
+	for _, site := range sites {
+		if !isRevoked(site) {
+			ordered = append(ordered, site)
+		}
+	}
+	return ordered
+}
+
+// Alert the ERROR recipients, once, on a revoked certificate served by a site, it is critical,
+// and warn about the sites without a fresh OCSP response stapled.
+func (CertManager *CertManager) alertOCSPStatus(ctx context.Context) {
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			status, ok := ocspStatusOf(site)
+			if !ok {
+				continue
+			}
+			if status.IsRevoked() && CertManager.firstAlert("revoked:"+serialOf(site.GetCertificate())) {
+				action := "it is renewed now"
+				if !site.GetConfig().IsManaged() {
+					action = "it isn't renewed by the manager"
+				}
+				CertManager.sendToRecipientsByCategories(ctx,
+					"["+site.GetConfig().URL+"] "+"Critical: the certificate "+serialOf(site.GetCertificate())+
+						" is revoked (reason "+strconv.Itoa(status.RevocationReason)+"), "+action+";",
+					CategoryError)
+			}
+			if status.HasStapleWarning() {
+				log.Warn("[", site.GetConfig().URL, "] The OCSP response stapled by the server is ", status.Staple, ".")
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/lets-encrypt"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/ari"
+)
+
+// Renewal window suggested by the CA for a certificate served, and the time chosen inside it.
+type renewalWindow struct {
+	Window    ari.Window
+	Scheduled time.Time
+	Announced bool // The opening of the window is logged once.
+}
+
+// Return the ARI client of the configuration, nil when it is disabled.
+func newARIClient(config ari.Config) *ari.Client {
+	if config.Disabled {
+		return nil
+	}
+	directoryURL := config.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = lets_encrypt.CADirURL
+	}
+	return ari.NewClient(directoryURL)
+}
+
+// Ask the CAs the renewal window of the certificate served by every managed site,
+// the first CA of the certificate knowing it answers.
+// The time chosen in a window is kept as long as the CA doesn't change the window.
+// A certificate unknown by the CAs keeps its renewal policy alone.
+func (CertManager *CertManager) refreshRenewalWindows(ctx context.Context) {
+	windows := make(map[string]renewalWindow)
+	for _, certificate := range CertManager.managedCertificates() {
+		for _, probe := range certificate.Probes {
+			served := probe.GetCertificate()
+			if served == nil {
+				continue
+			}
+			certID, err := ari.CertID(served)
+			if err != nil {
+				continue
+			}
+			if _, ok := windows[certID]; ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			window := CertManager.renewalInfo(ctx, certificate, served)
+			if window == nil {
+				continue
+			}
+			previous, ok := CertManager.renewalWindows[certID]
+			if ok && previous.Window.Start.Equal(window.Start) && previous.Window.End.Equal(window.End) {
+				windows[certID] = previous
+			} else {
+				windows[certID] = renewalWindow{Window: *window, Scheduled: window.RandomTime()}
+			}
+		}
+	}
+	CertManager.renewalWindows = windows
+}
+
+func (CertManager *CertManager) renewalInfo(ctx context.Context, certificate *ManagedCertificate, served *x509.Certificate) *ari.Window {
+	for _, ca := range CertManager.caOrder(certificate.Config) {
+		if ca.ARI == nil {
+			continue
+		}
+		window, err := ca.ARI.RenewalInfo(ctx, served)
+		if err == nil {
+			return window
+		}
+		log.Debug("[", certificate.Config.Name, "] No renewal information from [", ca.Name, "]: ", err.Error())
+	}
+	return nil
+}
+
+// Return true if the time chosen in the window suggested by the CA has come,
+// for one of the certificates served by the probes. It is sooner than the renewal policy
+// when the CA asks for an early renewal.
+func (CertManager *CertManager) isDueByCA(certificate *ManagedCertificate) bool {
+	for _, probe := range certificate.Probes {
+		if probe.GetCertificate() == nil {
+			continue
+		}
+		certID, err := ari.CertID(probe.GetCertificate())
+		if err != nil {
+			continue
+		}
+		window, ok := CertManager.renewalWindows[certID]
+		if ok && !time.Now().Before(window.Scheduled) {
+			if !window.Announced {
+				log.Info("[", certificate.Config.Name, "] Renewal window suggested by the CA started at ",
+					window.Window.Start.Format(time.RFC3339), " ", window.Window.ExplanationURL)
+				window.Announced = true
+				CertManager.renewalWindows[certID] = window
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/acme"
+)
+
+// Name of the file, inside the configuration directory, keeping the history of the revocations.
+const RevocationsFileName = "revocations.json"
+
+// A certificate revoked at its CA, Replaced when a new certificate was deployed in its place.
+type Revocation struct {
+	Certificate string    `json:"certificate"`
+	Serial      string    `json:"serial"`
+	CA          string    `json:"ca"`
+	Reason      string    `json:"reason"`
+	Revoked     time.Time `json:"revoked"`
+	Replaced    bool      `json:"replaced"`
+}
+
+// Revoke the certificate of a site, or of a certificate name, or the one with a serial (decimal or hexadecimal),
+// with a reason of acme.RevocationReasons. Every variant of the certificate is revoked, unless a serial is given.
+// With replace, a new certificate is issued and deployed straight away, outside of the deployment windows.
+// After a keyCompromise, the private key kept in the storage is removed, so it is never reused.
+func (CertManager *CertManager) Revoke(ctx context.Context, target string, reason string, replace bool) error {
+	CertManager.cycleMutex.Lock()
+	defer CertManager.cycleMutex.Unlock()
+	CertManager.reloadLedgers()
+	code, ok := acme.RevocationReasons[reason]
+	if !ok {
+		return errors.New("Unknown revocation reason [" + reason + "], expected one of " +
+			strings.Join(acme.RevocationReasonNames(), ", "))
+	}
+	certificate, serial := CertManager.findRevocationTarget(target)
+	if certificate == nil {
+		return errors.New("No site, certificate or serial [" + target + "] found")
+	}
+	revoked := 0
+	for _, variant := range certificate.Config.Variants() {
+		certificateFile, privateKeyFile := certificate.Config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+		certificatePEM, issued, err := readIssued(certificateFile)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if serial != "" && !matchSerial(issued, serial) {
+			continue
+		}
+		ca, err := CertManager.issuerOf(certificate.Config.Name, issued)
+		if err != nil {
+			return err
+		}
+		if err := acme.Revoke(ca.DirectoryURL, ca.LetsEncrypt.User, certificatePEM, code); err != nil {
+			return errors.New("The CA [" + ca.Name + "] didn't revoke the certificate " + serialOf(issued) + ": " + err.Error())
+		}
+		revoked++
+		log.Warn("[", certificate.Config.Name, "] Certificate ", serialOf(issued), " revoked by the CA [", ca.Name, "]: ", reason)
+		if reason == "keyCompromise" && certificate.Config.CSR == "" {
+			if err := os.Remove(privateKeyFile); err != nil && !os.IsNotExist(err) {
+				log.Error("[", certificate.Config.Name, "] While removing the compromised private key: ", err.Error())
+			}
+		}
+		CertManager.addRevocation(Revocation{
+			Certificate: certificate.Config.Name,
+			Serial:      serialOf(issued),
+			CA:          ca.Name,
+			Reason:      reason,
+			Revoked:     time.Now(),
+		})
+		CertManager.sendToRecipientsOfCategories(ctx,
+			"["+certificate.Config.Name+"] "+"Certificate "+serialOf(issued)+" revoked ("+reason+");",
+			CategoryError, CategoryRenew)
+	}
+	if revoked == 0 && serial != "" {
+		return errors.New("No certificate of [" + certificate.Config.Name + "] has the serial " + serial)
+	} else if revoked == 0 {
+		return errors.New("No certificate of [" + certificate.Config.Name + "] is stored, nothing is revoked")
+	}
+	if !replace {
+		return nil
+	}
+	if err := CertManager.renewCertificate(ctx, certificate, true); err != nil {
+		CertManager.sendToRecipientsOfCategories(ctx,
+			"["+certificate.Config.Name+"] "+"Error: the revoked certificate isn't replaced: "+err.Error()+";",
+			CategoryError, CategoryRenew)
+		return err
+	}
+	CertManager.markReplaced(certificate.Config.Name, revoked)
+	return nil
+}
+
+// Return the certificate of the site, the certificate with the name, or the one issued with the serial.
+// The serial is returned when the target is a serial, empty otherwise.
+func (CertManager *CertManager) findRevocationTarget(target string) (*ManagedCertificate, string) {
+	for _, certificate := range CertManager.managedCertificates() {
+		if certificate.Config.Name == target {
+			return certificate, ""
+		}
+		for _, probe := range certificate.Probes {
+			if strings.EqualFold(probe.GetConfig().URL, target) {
+				return certificate, ""
+			}
+		}
+	}
+	for _, certificate := range CertManager.managedCertificates() {
+		for _, variant := range certificate.Config.Variants() {
+			certificateFile, _ := certificate.Config.VariantFiles(CertManager.LetsEncrypt.CertificatesRootPath, variant)
+			if _, issued, err := readIssued(certificateFile); err == nil && matchSerial(issued, target) {
+				return certificate, target
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Return the CA which issued the certificate, from the ledger, or the first CA of the certificate
+// when it was issued before the ledger kept its orders until they expire.
+func (CertManager *CertManager) issuerOf(name string, issued *x509.Certificate) (CA, error) {
+	caName := ""
+	for _, order := range CertManager.getOrders() {
+		if order.Certificate == name && order.Serial == serialOf(issued) {
+			caName = order.CA
+		}
+	}
+	if caName == "" {
+		log.Warn("[", name, "] The certificate ", serialOf(issued), " isn't in the ledger, it is revoked at its first CA.")
+	}
+	config := CertManager.findCertificate(name).Config
+	for _, ca := range CertManager.caOrder(config) {
+		if caName == "" || ca.Name == caName {
+			return ca, nil
+		}
+	}
+	return CA{}, errors.New("The CA [" + caName + "] which issued the certificate " + serialOf(issued) + " isn't configured")
+}
+
+// Read the certificate issued, in the storage.
+func readIssued(certificateFile string) ([]byte, *x509.Certificate, error) {
+	certificatePEM, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	issued, err := certcrypto.ParsePEMCertificate(certificatePEM)
+	if err != nil {
+		return nil, nil, errors.New(certificateFile + ": " + err.Error())
+	}
+	return certificatePEM, issued, nil
+}
+
+// Compare the serial of the certificate with a decimal serial, or a hexadecimal one like 03:a1:7f.
+func matchSerial(certificate *x509.Certificate, serial string) bool {
+	if certificate.SerialNumber == nil || serial == "" {
+		return false
+	}
+	hexadecimal := strings.TrimLeft(strings.ToLower(strings.Replace(serial, ":", "", -1)), "0")
+	return certificate.SerialNumber.String() == serial || certificate.SerialNumber.Text(16) == hexadecimal
+}
+
+// Return the history of the revocations, the oldest first.
+func (CertManager *CertManager) Revocations() []Revocation {
+	return append([]Revocation{}, CertManager.getRevocations()...)
+}
+
+func (CertManager *CertManager) getRevocations() []Revocation {
+	if !CertManager.revocationsLoaded {
+		CertManager.revocations = CertManager.readRevocations()
+		CertManager.revocationsLoaded = true
+	}
+	return CertManager.revocations
+}
+
+func (CertManager *CertManager) addRevocation(revocation Revocation) {
+	unlock := lockLedger(CertManager.revocationsPath())
+	defer unlock()
+	if CertManager.revocationsPath() != "" {
+		CertManager.revocationsLoaded = false
+	}
+	CertManager.revocations = append(CertManager.getRevocations(), revocation)
+	CertManager.writeRevocations()
+}
+
+// Mark the last revocations of the certificate as replaced.
+func (CertManager *CertManager) markReplaced(name string, count int) {
+	unlock := lockLedger(CertManager.revocationsPath())
+	defer unlock()
+	if CertManager.revocationsPath() != "" {
+		CertManager.revocationsLoaded = false
+	}
+	revocations := CertManager.getRevocations()
+	for i := len(revocations) - 1; i >= 0 && count > 0; i-- {
+		if revocations[i].Certificate == name {
+			revocations[i].Replaced = true
+			count--
+		}
+	}
+	CertManager.writeRevocations()
+}
+
+// The history is kept on disk, the revocations are not frequent and it is never pruned.
+func (CertManager *CertManager) revocationsPath() string {
+	if CertManager.ConfDirPath == "" {
+		return ""
+	}
+	return filepath.Join(CertManager.ConfDirPath, RevocationsFileName)
+}
+
+func (CertManager *CertManager) readRevocations() []Revocation {
+	revocations := make([]Revocation, 0)
+	path := CertManager.revocationsPath()
+	if path == "" {
+		return revocations
+	}
+	revocationsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("While reading the revocations: ", err.Error())
+		}
+		return revocations
+	}
+	if err := json.Unmarshal(revocationsBytes, &revocations); err != nil {
+		log.Error("While reading the revocations: ", err.Error())
+	}
+	return revocations
+}
+
+func (CertManager *CertManager) writeRevocations() {
+	path := CertManager.revocationsPath()
+	if path == "" {
+		return
+	}
+	revocationsBytes, err := json.Marshal(CertManager.revocations)
+	if err != nil {
+		log.Error("While saving the revocations: ", err.Error())
+		return
+	}
+	if err := writeLedger(path, revocationsBytes); err != nil {
+		log.Error("While saving the revocations: ", err.Error())
+	}
+}
@@ -0,0 +1,198 @@
+package rfc2136
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	letsEncryptDNS "github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	"github.com/miekg/dns"
+)
+
+// Type of the DNS servers updated with RFC2136 dynamic updates, like BIND or Knot.
+const ServerDNSTypeRFC2136 = "rfc2136"
+
+const (
+	DefaultPort          = "53"
+	DefaultTSIGAlgorithm = "hmac-sha256"
+	// TTL of the challenge records, they only live during the validation.
+	ChallengeTTL = 60
+	// Maximum time to get the answer of the nameserver.
+	Timeout = 10 * time.Second
+	// Time difference accepted by the nameserver with the time of the signature.
+	TSIGFudge = 300
+)
+
+// TSIG algorithms accepted in the configuration.
+var TSIGAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// The fields of a DNS server of type rfc2136, next to the ones of every DNS server.
+// Without TSIG key, the updates are sent unsigned, for a nameserver allowing them by address.
+type Config struct {
+	// Primary nameserver of the zones, host or host:port, port 53 by default.
+	Nameserver    string `mapstructure:"nameserver"`
+	TSIGKey       string `mapstructure:"tsig_key"`
+	TSIGAlgorithm string `mapstructure:"tsig_algorithm"` // DefaultTSIGAlgorithm when empty.
+	TSIGSecret    string `mapstructure:"tsig_secret"`    // Base64 encoded, like in the key files of BIND and Knot.
+}
+
+// Return the nameserver address with its port.
+func (config Config) Address() string {
+	if _, _, err := net.SplitHostPort(config.Nameserver); err == nil {
+		return config.Nameserver
+	}
+	return net.JoinHostPort(strings.Trim(config.Nameserver, "[]"), DefaultPort)
+}
+
+// Return the name of the TSIG algorithm, as sent in the signature.
+func (config Config) Algorithm() (string, error) {
+	name := config.TSIGAlgorithm
+	if name == "" {
+		name = DefaultTSIGAlgorithm
+	}
+	algorithm, ok := TSIGAlgorithms[strings.TrimSuffix(strings.ToLower(name), ".")]
+	if !ok {
+		return "", errors.New("Unknown TSIG algorithm [" + config.TSIGAlgorithm + "], expected one of " +
+			strings.Join(TSIGAlgorithmNames(), ", "))
+	}
+	return algorithm, nil
+}
+
+// Return the accepted TSIG algorithms, sorted, for the error messages.
+func TSIGAlgorithmNames() []string {
+	names := make([]string, 0, len(TSIGAlgorithms))
+	for name := range TSIGAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check the fields of the configuration, the errors are prefixed by their key.
+func (config Config) Validate() []error {
+	errs := make([]error, 0)
+	if config.Nameserver == "" {
+		errs = append(errs, errors.New("nameserver: missing"))
+	}
+	if (config.TSIGKey == "") != (config.TSIGSecret == "") {
+		errs = append(errs, errors.New("tsig_key: tsig_key and tsig_secret go together"))
+	}
+	if _, err := base64.StdEncoding.DecodeString(config.TSIGSecret); err != nil {
+		errs = append(errs, errors.New("tsig_secret: must be base64 encoded"))
+	}
+	if _, err := config.Algorithm(); err != nil {
+		errs = append(errs, errors.New("tsig_algorithm: "+err.Error()))
+	}
+	return errs
+}
+
+// A nameserver accepting dynamic updates, signed with TSIG, for the DNS-01 challenges.
+type RFC2136 struct {
+	Config    letsEncryptDNS.DNSServerConfig
+	RFC2136   Config
+	algorithm string
+}
+
+func InitDNSServer(dnsServerConfig letsEncryptDNS.DNSServerConfig, config Config) (*RFC2136, error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errors.New("[" + dnsServerConfig.Name + "] " + errs[0].Error())
+	}
+	algorithm, _ := config.Algorithm()
+	return &RFC2136{Config: dnsServerConfig, RFC2136: config, algorithm: algorithm}, nil
+}
+
+func (server *RFC2136) GetConfig() letsEncryptDNS.DNSServerConfig {
+	return server.Config
+}
+
+// The nameserver is authoritative for the domain if it answers its SOA lookup with authority,
+// from the zone of the domain: the SOA is in the answer for the apex of a zone, in the authority section otherwise.
+func (server *RFC2136) IsAuthoritativeForDomain(domain string) bool {
+	zone, err := server.zoneOf(domain)
+	return err == nil && zone != ""
+}
+
+// Add the TXT record of the challenge in the zone of the name.
+func (server *RFC2136) AddTXTRecord(domain, name, value string) error {
+	fqdn := dns.Fqdn(name)
+	zone, err := server.zoneOf(fqdn)
+	if err != nil {
+		return err
+	}
+	record := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ChallengeTTL},
+		// The value is given quoted, like in the zone files.
+		Txt: []string{strings.Trim(value, "\"")},
+	}
+	update := new(dns.Msg)
+	update.SetUpdate(zone)
+	update.Insert([]dns.RR{record})
+	return server.update(update)
+}
+
+// Remove the TXT records of the challenge name.
+func (server *RFC2136) CleanTXTRecord(domain, name string) error {
+	fqdn := dns.Fqdn(name)
+	zone, err := server.zoneOf(fqdn)
+	if err != nil {
+		return err
+	}
+	update := new(dns.Msg)
+	update.SetUpdate(zone)
+	update.RemoveRRset([]dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET}}})
+	return server.update(update)
+}
+
+// Return the zone of the name hosted by the nameserver, an error if it doesn't host it.
+func (server *RFC2136) zoneOf(name string) (string, error) {
+	fqdn := dns.Fqdn(strings.ToLower(name))
+	query := new(dns.Msg)
+	query.SetQuestion(fqdn, dns.TypeSOA)
+	query.RecursionDesired = false
+	answer, _, err := server.client().Exchange(query, server.RFC2136.Address())
+	if err != nil {
+		return "", err
+	}
+	if !answer.Authoritative || (answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError) {
+		return "", errors.New("The nameserver " + server.RFC2136.Nameserver + " isn't authoritative for " + fqdn)
+	}
+	for _, record := range append(answer.Answer, answer.Ns...) {
+		if soa, ok := record.(*dns.SOA); ok && dns.IsSubDomain(strings.ToLower(soa.Hdr.Name), fqdn) {
+			return strings.ToLower(soa.Hdr.Name), nil
+		}
+	}
+	return "", errors.New("The nameserver " + server.RFC2136.Nameserver + " gives no SOA for " + fqdn)
+}
+
+// Send the update, signed when a TSIG key is set.
+func (server *RFC2136) update(update *dns.Msg) error {
+	client := server.client()
+	if server.RFC2136.TSIGKey != "" {
+		keyName := dns.Fqdn(strings.ToLower(server.RFC2136.TSIGKey))
+		client.TsigSecret = map[string]string{keyName: server.RFC2136.TSIGSecret}
+		update.SetTsig(keyName, server.algorithm, TSIGFudge, time.Now().Unix())
+	}
+	reply, _, err := client.Exchange(update, server.RFC2136.Address())
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return errors.New("The nameserver " + server.RFC2136.Nameserver + " refused the update: " + dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// The updates are small, UDP is enough.
+func (server *RFC2136) client() *dns.Client {
+	return &dns.Client{Timeout: Timeout}
+}
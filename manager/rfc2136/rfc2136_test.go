@@ -0,0 +1,141 @@
+package rfc2136
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	letsEncryptDNS "github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	"github.com/miekg/dns"
+)
+
+const (
+	testKey    = "acme-update."
+	testSecret = "c2VjcmV0IHNoYXJlZCB3aXRoIHRoZSBuYW1lc2VydmVy"
+)
+
+// An in-process nameserver of example.com, accepting the updates signed with the test key.
+type testNameserver struct {
+	*dns.Server
+	mutex   sync.Mutex
+	records map[string][]string
+}
+
+func startNameserver(t *testing.T) (*testNameserver, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameserver := &testNameserver{records: make(map[string][]string)}
+	started := make(chan struct{})
+	nameserver.Server = &dns.Server{
+		PacketConn: conn,
+		TsigSecret: map[string]string{testKey: testSecret},
+		Handler:    dns.HandlerFunc(nameserver.serve),
+		// The default one only accepts the queries and the notifies.
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = nameserver.ActivateAndServe() }()
+	<-started
+	return nameserver, conn.LocalAddr().String()
+}
+
+func (nameserver *testNameserver) serve(w dns.ResponseWriter, request *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	name := strings.ToLower(request.Question[0].Name)
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+	}
+	switch {
+	case !dns.IsSubDomain("example.com.", name):
+		reply.Rcode = dns.RcodeRefused
+	case request.Opcode == dns.OpcodeUpdate:
+		if request.IsTsig() == nil || w.TsigStatus() != nil {
+			reply.Rcode = dns.RcodeNotAuth
+			break
+		}
+		nameserver.apply(request.Ns)
+		reply.SetTsig(testKey, dns.HmacSHA256, TSIGFudge, int64(request.IsTsig().TimeSigned))
+	case name == "example.com.":
+		reply.Authoritative = true
+		reply.Answer = []dns.RR{soa}
+	default:
+		reply.Authoritative = true
+		reply.Ns = []dns.RR{soa}
+	}
+	_ = w.WriteMsg(reply)
+}
+
+func (nameserver *testNameserver) apply(updates []dns.RR) {
+	nameserver.mutex.Lock()
+	defer nameserver.mutex.Unlock()
+	for _, record := range updates {
+		txt, ok := record.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		if txt.Hdr.Class == dns.ClassANY {
+			delete(nameserver.records, txt.Hdr.Name)
+		} else {
+			nameserver.records[txt.Hdr.Name] = append(nameserver.records[txt.Hdr.Name], txt.Txt...)
+		}
+	}
+}
+
+func (nameserver *testNameserver) txt(name string) []string {
+	nameserver.mutex.Lock()
+	defer nameserver.mutex.Unlock()
+	return nameserver.records[name]
+}
+
+func TestDynamicUpdates(t *testing.T) {
+	nameserver, address := startNameserver(t)
+	defer nameserver.Shutdown()
+	server, err := InitDNSServer(letsEncryptDNS.DNSServerConfig{Name: "bind", Type: ServerDNSTypeRFC2136},
+		Config{Nameserver: address, TSIGKey: "acme-update", TSIGSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.IsAuthoritativeForDomain("www.example.com") || !server.IsAuthoritativeForDomain("example.com") {
+		t.Error("Expected the nameserver to be authoritative for example.com")
+	}
+	if server.IsAuthoritativeForDomain("www.example.org") {
+		t.Error("Expected the nameserver not to be authoritative for example.org")
+	}
+
+	if err := server.AddTXTRecord("www.example.com", "_acme-challenge.www.example.com.", "\"token\""); err != nil {
+		t.Fatal(err)
+	}
+	if records := nameserver.txt("_acme-challenge.www.example.com."); len(records) != 1 || records[0] != "token" {
+		t.Error("Expected the record ", "token", " got ", records)
+	}
+	if err := server.CleanTXTRecord("www.example.com", "_acme-challenge.www.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if records := nameserver.txt("_acme-challenge.www.example.com."); len(records) != 0 {
+		t.Error("Expected the records to be removed got ", records)
+	}
+
+	// A wrong secret is refused by the nameserver.
+	server.RFC2136.TSIGSecret = "d3Jvbmcgc2VjcmV0"
+	if err := server.AddTXTRecord("www.example.com", "_acme-challenge.www.example.com.", "\"token\""); err == nil {
+		t.Error("Expected the update signed with a wrong secret to be refused")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	if address := (Config{Nameserver: "ns1.example.com"}).Address(); address != "ns1.example.com:53" {
+		t.Error("Expected ", "ns1.example.com:53", " got ", address)
+	}
+	if address := (Config{Nameserver: "[2001:db8::53]:5353"}).Address(); address != "[2001:db8::53]:5353" {
+		t.Error("Expected ", "[2001:db8::53]:5353", " got ", address)
+	}
+	errs := Config{TSIGKey: "acme-update", TSIGAlgorithm: "hmac-sha3", TSIGSecret: "not base64!"}.Validate()
+	if len(errs) != 3 {
+		t.Error("Expected ", 3, " errors got ", errs)
+	}
+}
@@ -0,0 +1,273 @@
+package schedule
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration of the daemon loop.
+// Without cron expression, the loop runs every loop_restart_min minutes.
+type Config struct {
+	Cron      string `mapstructure:"cron"`
+	JitterMin int    `mapstructure:"jitter_min"`
+}
+
+// A parsed cron expression, with the 5 usual fields: minute, hour, day of month, month and day of week.
+type Schedule struct {
+	Expression string
+	minutes    uint64
+	hours      uint64
+	daysOfMon  uint64
+	months     uint64
+	daysOfWeek uint64
+	// The day of month and the day of week are combined with a OR when both are restricted, like cron does.
+	restrictedDom bool
+	restrictedDow bool
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a cron expression like "30 2 * * mon-fri" or a shortcut like "@daily".
+func Parse(expression string) (*Schedule, error) {
+	expanded := strings.TrimSpace(expression)
+	if shortcut, ok := shortcuts[strings.ToLower(expanded)]; ok {
+		expanded = shortcut
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, errors.New("Invalid cron expression \"" + expression + "\": 5 fields expected")
+	}
+	schedule := &Schedule{Expression: expression}
+	var err error
+	if schedule.minutes, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfMon, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfWeek, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	// Sunday can be written 0 or 7.
+	if schedule.daysOfWeek&(1<<7) != 0 {
+		schedule.daysOfWeek |= 1
+	}
+	schedule.restrictedDom = fields[2] != "*"
+	schedule.restrictedDow = fields[4] != "*"
+	return schedule, nil
+}
+
+// Parse one field made of comma separated "*", "a", "a-b", with an optional "/step".
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		step := 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[index+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("Invalid step in the " + f.name + " field: " + value)
+			}
+			part = part[:index]
+		}
+		start, end := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = f.parseValue(bounds[0]); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = f.parseValue(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+			if end < start {
+				return 0, errors.New("Invalid range in the " + f.name + " field: " + value)
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) parseValue(value string) (int, error) {
+	if number, ok := f.names[value]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < f.min || number > f.max {
+		return 0, errors.New("Invalid value \"" + value + "\" in the " + f.name + " field")
+	}
+	return number, nil
+}
+
+// Return true if the minute of the given time matches the expression.
+func (schedule *Schedule) Matches(t time.Time) bool {
+	return schedule.minutes&(1<<uint(t.Minute())) != 0 &&
+		schedule.hours&(1<<uint(t.Hour())) != 0 &&
+		schedule.months&(1<<uint(t.Month())) != 0 &&
+		schedule.matchesDay(t)
+}
+
+func (schedule *Schedule) matchesDay(t time.Time) bool {
+	domMatch := schedule.daysOfMon&(1<<uint(t.Day())) != 0
+	dowMatch := schedule.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if schedule.restrictedDom && schedule.restrictedDow {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Return the first matching minute strictly after the given time,
+// or the zero time if nothing matches in the next 5 years.
+func (schedule *Schedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		if schedule.months&(1<<uint(next.Month())) == 0 {
+			next = time.Date(next.Year(), next.Month(), 1, 0, 0, 0, 0, next.Location()).AddDate(0, 1, 0)
+			continue
+		}
+		if !schedule.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, next.Location()).AddDate(0, 0, 1)
+			continue
+		}
+		if schedule.hours&(1<<uint(next.Hour())) == 0 {
+			// Truncate works on the absolute time, the hour must be the one of the location.
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+		if schedule.minutes&(1<<uint(next.Minute())) == 0 {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+// Return true if one of the windows is open at the given time, or if there is no window at all.
+// Each window is a cron expression, the window is open during every minute it matches.
+func IsInWindows(windows []string, t time.Time) (bool, error) {
+	if len(windows) == 0 {
+		return true, nil
+	}
+	for _, window := range windows {
+		schedule, err := Parse(window)
+		if err != nil {
+			return false, err
+		}
+		if schedule.Matches(t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Return the next minute, strictly after the given time, where one of the windows opens:
+// it is open during this minute and wasn't during the previous one.
+// Return the zero time if no window opens in the next year, e.g. without window or with one always open.
+func NextOpening(windows []string, t time.Time) (time.Time, error) {
+	schedules := make([]*Schedule, 0, len(windows))
+	for _, window := range windows {
+		schedule, err := Parse(window)
+		if err != nil {
+			return time.Time{}, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	isOpen := func(minute time.Time) bool {
+		for _, schedule := range schedules {
+			if schedule.Matches(minute) {
+				return true
+			}
+		}
+		return false
+	}
+	from := t.Truncate(time.Minute)
+	limit := from.AddDate(1, 0, 0)
+	for from.Before(limit) {
+		// First minute after from where a window is open.
+		next := time.Time{}
+		for _, schedule := range schedules {
+			if candidate := schedule.Next(from); !candidate.IsZero() && (next.IsZero() || candidate.Before(next)) {
+				next = candidate
+			}
+		}
+		if next.IsZero() {
+			return time.Time{}, nil
+		}
+		if !isOpen(next.Add(-time.Minute)) {
+			return next, nil
+		}
+		from = next
+	}
+	return time.Time{}, nil
+}
+
+// Return how long to wait before the next cycle.
+// With a cron expression the cycle starts at the next matching minute,
+// otherwise it starts every interval after the start of the previous one so the run time doesn't drift.
+// A random jitter of up to jitter_min minutes is added in both cases.
+func (config Config) NextDelay(lastStart time.Time, interval time.Duration, now time.Time) (time.Duration, error) {
+	next := lastStart.Add(interval)
+	if config.Cron != "" {
+		schedule, err := Parse(config.Cron)
+		if err != nil {
+			return 0, err
+		}
+		next = schedule.Next(now)
+		if next.IsZero() {
+			return 0, errors.New("The cron expression \"" + config.Cron + "\" never matches")
+		}
+	}
+	delay := next.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	if config.JitterMin > 0 {
+		delay += time.Duration(rand.Int63n(int64(time.Duration(config.JitterMin) * time.Minute)))
+	}
+	return delay, nil
+}
@@ -0,0 +1,110 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	var arguments = []struct {
+		expression string
+		from       string
+		next       string
+	}{
+		{"0 3 * * *", "2020-11-17 17:44", "2020-11-18 03:00"},
+		{"*/15 * * * *", "2020-11-17 17:44", "2020-11-17 17:45"},
+		{"30 9-17 * * mon-fri", "2020-11-20 17:31", "2020-11-23 09:30"},
+		{"0 0 1 jan *", "2020-11-17 17:44", "2021-01-01 00:00"},
+		{"@daily", "2020-11-17 17:44", "2020-11-18 00:00"},
+		{"0 12 * * 7", "2020-11-17 17:44", "2020-11-22 12:00"},
+	}
+	for _, argument := range arguments {
+		schedule, err := Parse(argument.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, _ := time.Parse("2006-01-02 15:04", argument.from)
+		next := schedule.Next(from).Format("2006-01-02 15:04")
+		if next != argument.next {
+			t.Error(argument.expression, " from ", argument.from, ": expected ", argument.next, " got ", next)
+		}
+	}
+}
+
+func TestNextInHalfHourZone(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+30*60)
+	schedule, err := Parse("0 18 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2020, 11, 17, 17, 44, 0, 0, kolkata)
+	if next := schedule.Next(from); !next.Equal(time.Date(2020, 11, 17, 18, 0, 0, 0, kolkata)) {
+		t.Error("Expected ", "2020-11-17 18:00 IST", " got ", next)
+	}
+	from = time.Date(2020, 11, 17, 9, 10, 0, 0, kolkata)
+	if next := schedule.Next(from); !next.Equal(time.Date(2020, 11, 17, 18, 0, 0, 0, kolkata)) {
+		t.Error("Expected ", "2020-11-17 18:00 IST", " got ", next)
+	}
+	if _, err := (Config{Cron: "0 18 * * *"}).NextDelay(from, time.Hour, from); err != nil {
+		t.Error("Expected a delay, got ", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* * * * funday", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := Parse(expression); err == nil {
+			t.Error("Expected an error for \"", expression, "\"")
+		}
+	}
+}
+
+func TestIsInWindows(t *testing.T) {
+	saturday, _ := time.Parse("2006-01-02 15:04", "2020-11-21 10:00")
+	monday, _ := time.Parse("2006-01-02 15:04", "2020-11-23 10:00")
+	windows := []string{"* 9-17 * * mon-fri"}
+	if open, _ := IsInWindows(windows, saturday); open {
+		t.Error("The window shouldn't be open on saturday")
+	}
+	if open, _ := IsInWindows(windows, monday); !open {
+		t.Error("The window should be open on monday")
+	}
+	if open, _ := IsInWindows(nil, saturday); !open {
+		t.Error("Without window, the deployment is always allowed")
+	}
+}
+
+func TestNextDelay(t *testing.T) {
+	now, _ := time.Parse("2006-01-02 15:04", "2020-11-17 17:44")
+	delay, _ := Config{}.NextDelay(now.Add(-10*time.Minute), time.Hour, now)
+	if delay != 50*time.Minute {
+		t.Error("Expected the interval to start from the last start, got: ", delay)
+	}
+	delay, _ = Config{Cron: "0 18 * * *", JitterMin: 5}.NextDelay(now, time.Hour, now)
+	if delay < 16*time.Minute || delay >= 21*time.Minute {
+		t.Error("Expected the next cron minute plus the jitter, got: ", delay)
+	}
+}
+
+func TestNextOpening(t *testing.T) {
+	var arguments = []struct {
+		windows []string
+		from    string
+		opening string
+	}{
+		{[]string{"* 9-17 * * mon-fri"}, "2020-11-20 10:00", "2020-11-23 09:00"},
+		{[]string{"* 9-17 * * mon-fri"}, "2020-11-20 08:30", "2020-11-20 09:00"},
+		{[]string{"* 9-11 * * *", "* 12-13 * * *"}, "2020-11-20 10:00", "2020-11-21 09:00"},
+		{[]string{"* * * * *"}, "2020-11-20 10:00", "0001-01-01 00:00"},
+		{nil, "2020-11-20 10:00", "0001-01-01 00:00"},
+	}
+	for _, argument := range arguments {
+		from, _ := time.Parse("2006-01-02 15:04", argument.from)
+		opening, err := NextOpening(argument.windows, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opening.Format("2006-01-02 15:04") != argument.opening {
+			t.Error(argument.windows, " from ", argument.from, ": expected ", argument.opening, " got ", opening)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default directory name of the spool, created inside the configuration directory.
+const DefaultSpoolDirName = "spool"
+
+// A notification that couldn't be delivered, saved on disk until the next run.
+type SpooledMessage struct {
+	Notifier string    `json:"notifier"`
+	Dest     string    `json:"dest"`
+	Msg      string    `json:"msg"`
+	Category string    `json:"category"`
+	Created  time.Time `json:"created"`
+}
+
+// Return the spool directory given in the configuration,
+// or the default one inside the configuration directory.
+func (CertManager *CertManager) spoolPath() string {
+	if CertManager.Config.Notification.SpoolPath != "" {
+		return CertManager.Config.Notification.SpoolPath
+	}
+	if CertManager.ConfDirPath == "" {
+		return ""
+	}
+	return filepath.Join(CertManager.ConfDirPath, DefaultSpoolDirName)
+}
+
+// Write the undelivered message as a json file inside the spool directory.
+func (CertManager *CertManager) spoolMessage(message SpooledMessage) {
+	spoolPath := CertManager.spoolPath()
+	if spoolPath == "" {
+		log.Error("No spool directory, the message to ", message.Dest, " is lost.")
+		return
+	}
+	if message.Created.IsZero() {
+		message.Created = time.Now()
+	}
+	if err := os.MkdirAll(spoolPath, 0700); err != nil {
+		log.Error("While creating the spool: ", err.Error())
+		return
+	}
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Error("While spooling the message: ", err.Error())
+		return
+	}
+	fileName := strconv.FormatInt(message.Created.UnixNano(), 10) + "-" + sanitizeFileName(message.Notifier+"-"+message.Dest) + ".json"
+	if err := ioutil.WriteFile(filepath.Join(spoolPath, fileName), messageBytes, 0600); err != nil {
+		log.Error("While spooling the message: ", err.Error())
+	}
+}
+
+// Read the spool and try to send again every message inside.
+// A delivered message is removed from the spool, the others stay for the next run.
+func (CertManager *CertManager) FlushSpool(ctx context.Context) {
+	spoolPath := CertManager.spoolPath()
+	if spoolPath == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(spoolPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("While reading the spool: ", err.Error())
+		}
+		return
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		filePath := filepath.Join(spoolPath, file.Name())
+		messageBytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			log.Error("While reading the spool: ", err.Error())
+			continue
+		}
+		var message SpooledMessage
+		if err := json.Unmarshal(messageBytes, &message); err != nil {
+			log.Error("Invalid spooled message ", file.Name(), ": ", err.Error())
+			continue
+		}
+		if CertManager.sendSpooledMessage(ctx, message) {
+			if err := os.Remove(filePath); err != nil {
+				log.Error("While cleaning the spool: ", err.Error())
+			}
+		}
+	}
+}
+
+// Find the notifier of the spooled message and send it, return true if it was delivered.
+func (CertManager *CertManager) sendSpooledMessage(ctx context.Context, message SpooledMessage) bool {
+	for _, notifier := range CertManager.Notifiers {
+		if strings.EqualFold(notifier.GetName(), message.Notifier) {
+			if err := CertManager.sendWithRetries(ctx, notifier, message.Msg, message.Dest, message.Category); err != nil {
+				log.Warn("[", notifier.GetName(), "] Spooled message to ", message.Dest, " still undelivered: ", err.Error())
+				return false
+			}
+			return true
+		}
+	}
+	log.Warn("Spooled message for the unknown notifier ", message.Notifier, " kept in the spool.")
+	return false
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == '#' || r == '@' {
+			return '_'
+		}
+		return r
+	}, name)
+}
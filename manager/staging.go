@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+)
+
+// Name of the file, inside the configuration directory, keeping the certificates validated on staging.
+const StagingValidationsFileName = "staging-validations.json"
+
+// A certificate whose DNS-01 flow succeeded on a staging directory.
+// Fingerprint identifies its names and their DNS servers at this time.
+type StagingValidation struct {
+	Certificate string    `json:"certificate"`
+	Fingerprint string    `json:"fingerprint"`
+	CA          string    `json:"ca"`
+	Validated   time.Time `json:"validated"`
+}
+
+// Run the DNS-01 flow of a certificate with staging_first on the staging directory of its CA
+// before ordering it in production: for its first order, and the first one after a change of its names
+// or of their DNS servers. A failure stops the order, so the failed validations limit of production is kept.
+// The certificate issued by the staging directory is thrown away.
+func (CertManager *CertManager) validateOnStaging(ctx context.Context, certificate *ManagedCertificate, DNSServer dns.DNSServer) error {
+	if !certificate.Config.StagingFirst {
+		return nil
+	}
+	fingerprint, err := CertManager.stagingFingerprint(certificate.Config)
+	if err != nil {
+		return err
+	}
+	if CertManager.isValidatedOnStaging(certificate.Config.Name, fingerprint) {
+		return nil
+	}
+	staging, ok := CertManager.stagingCA(certificate.Config)
+	if !ok {
+		log.Warn("[", certificate.Config.Name, "] Its CA has no staging directory, it is ordered in production directly.")
+		return nil
+	}
+	log.Info("[", certificate.Config.Name, "] New or changed configuration, validated on the staging CA [", staging.Name, "] first.")
+	if _, err := CertManager.requestCertificate(ctx, certificate.Config, certificate.Config.Variants()[0], staging, DNSServer); err != nil {
+		return errors.New("Validation on the staging CA [" + staging.Name + "] failed, nothing is ordered in production: " + err.Error())
+	}
+	CertManager.addStagingValidation(StagingValidation{
+		Certificate: certificate.Config.Name,
+		Fingerprint: fingerprint,
+		CA:          staging.Name,
+		Validated:   time.Now(),
+	})
+	return nil
+}
+
+// Return the staging CA of the CA of the certificate, the first of its CAs.
+func (CertManager *CertManager) stagingCA(config certificates.Config) (CA, bool) {
+	order := CertManager.caOrder(config)
+	if len(order) == 0 || order[0].Staging == "" {
+		return CA{}, false
+	}
+	for _, staging := range CertManager.authorities() {
+		if staging.Name == order[0].Staging {
+			return staging, true
+		}
+	}
+	return CA{}, false
+}
+
+// Identify the names of the certificate and the configuration of their DNS servers.
+func (CertManager *CertManager) stagingFingerprint(config certificates.Config) (string, error) {
+	names := make([]string, 0, len(config.Names))
+	for _, name := range config.Names {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	servers := make([]dns.DNSServerConfig, 0, len(names))
+	for _, name := range names {
+		DNSServer, err := CertManager.GetDNSProviderForSite(name)
+		if err != nil {
+			return "", errors.New(err.Error() + " for " + name)
+		}
+		servers = append(servers, DNSServer.GetConfig())
+	}
+	fingerprintBytes, err := json.Marshal(struct {
+		Names   []string
+		Servers []dns.DNSServerConfig
+	}{names, servers})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(fingerprintBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (CertManager *CertManager) isValidatedOnStaging(certificateName string, fingerprint string) bool {
+	for _, validation := range CertManager.getStagingValidations() {
+		if validation.Certificate == certificateName && validation.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+func (CertManager *CertManager) getStagingValidations() []StagingValidation {
+	if !CertManager.stagingLoaded {
+		CertManager.stagingValidations = CertManager.readStagingValidations()
+		CertManager.stagingLoaded = true
+	}
+	return CertManager.stagingValidations
+}
+
+// Keep the last validation of every certificate.
+func (CertManager *CertManager) addStagingValidation(validation StagingValidation) {
+	unlock := lockLedger(CertManager.stagingValidationsPath())
+	defer unlock()
+	if CertManager.stagingValidationsPath() != "" {
+		CertManager.stagingLoaded = false
+	}
+	validations := make([]StagingValidation, 0)
+	for _, previous := range CertManager.getStagingValidations() {
+		if previous.Certificate != validation.Certificate {
+			validations = append(validations, previous)
+		}
+	}
+	CertManager.stagingValidations = append(validations, validation)
+	CertManager.writeStagingValidations()
+}
+
+// The validations are kept on disk, so the next runs order in production directly.
+func (CertManager *CertManager) stagingValidationsPath() string {
+	if CertManager.ConfDirPath == "" {
+		return ""
+	}
+	return filepath.Join(CertManager.ConfDirPath, StagingValidationsFileName)
+}
+
+func (CertManager *CertManager) readStagingValidations() []StagingValidation {
+	validations := make([]StagingValidation, 0)
+	path := CertManager.stagingValidationsPath()
+	if path == "" {
+		return validations
+	}
+	validationsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("While reading the staging validations: ", err.Error())
+		}
+		return validations
+	}
+	if err := json.Unmarshal(validationsBytes, &validations); err != nil {
+		log.Error("While reading the staging validations: ", err.Error())
+	}
+	return validations
+}
+
+func (CertManager *CertManager) writeStagingValidations() {
+	path := CertManager.stagingValidationsPath()
+	if path == "" {
+		return
+	}
+	validationsBytes, err := json.Marshal(CertManager.stagingValidations)
+	if err != nil {
+		log.Error("While saving the staging validations: ", err.Error())
+		return
+	}
+	if err := writeLedger(path, validationsBytes); err != nil {
+		log.Error("While saving the staging validations: ", err.Error())
+	}
+}
@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+)
+
+// Possible outcomes of a ParseSites cycle.
+const (
+	CycleOutcomeSuccess = "success"
+	CycleOutcomePartial = "partial"
+	CycleOutcomeFailure = "failure"
+	CycleOutcomeRunning = "running"
+)
+
+// Result of the last ParseSites cycle.
+type CycleStatus struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Outcome  string        `json:"outcome"`
+	Renewed  int           `json:"renewed"`
+	Failed   int           `json:"failed"`
+	Cycles   int           `json:"cycles"`
+}
+
+// Renewal history of one site since the start of the program.
+type RenewalState struct {
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Certificate details and renewal state of a site.
+type SiteStatus struct {
+	URL    string `json:"url"`
+	Domain string `json:"domain"`
+	Server string `json:"server"`
+	Port   int    `json:"port"`
+	// fetcher.ModeRenew, or fetcher.ModeMonitor for a site only monitored.
+	Mode string `json:"mode"`
+	// Certificate probed by the site, empty for a site only monitored.
+	Certificate string       `json:"certificate,omitempty"`
+	Subject     string       `json:"subject,omitempty"`
+	Issuer      string       `json:"issuer,omitempty"`
+	Names       []string     `json:"names,omitempty"`
+	NotBefore   time.Time    `json:"not_before,omitempty"`
+	NotAfter    time.Time    `json:"not_after,omitempty"`
+	DaysLeft    int          `json:"days_left"`
+	Renewal     RenewalState `json:"renewal"`
+	// Empty when the certificate has no OCSP responder.
+	OCSP *fetcher.OCSPStatus `json:"ocsp,omitempty"`
+}
+
+// Let's Encrypt rate limit budget of a domain.
+type DomainStatus struct {
+	Name             string `json:"name"`
+	Sites            int    `json:"sites"`
+	SitesDue         int    `json:"sites_due"`           // Renewal policy reached.
+	SitesDueThisWeek int    `json:"sites_due_this_week"` // Reached before the rate limits week ends.
+	RemainingQueries int    `json:"remaining_queries"`
+}
+
+// State shared with the readers of the API, it is only updated between the steps of a cycle.
+type managerStatus struct {
+	mutex    sync.RWMutex
+	cycle    CycleStatus
+	ready    bool
+	sites    []SiteStatus
+	domains  []DomainStatus
+	renewals map[string]RenewalState
+}
+
+// Return the result of the last cycle, or the running one.
+func (CertManager *CertManager) Status() CycleStatus {
+	CertManager.status.mutex.RLock()
+	defer CertManager.status.mutex.RUnlock()
+	return CertManager.status.cycle
+}
+
+// Return true once a first cycle is over.
+func (CertManager *CertManager) IsReady() bool {
+	CertManager.status.mutex.RLock()
+	defer CertManager.status.mutex.RUnlock()
+	return CertManager.status.ready
+}
+
+// Return every site with its certificate and renewal state, as seen during the last cycle.
+func (CertManager *CertManager) SitesStatus() []SiteStatus {
+	CertManager.status.mutex.RLock()
+	defer CertManager.status.mutex.RUnlock()
+	return append([]SiteStatus{}, CertManager.status.sites...)
+}
+
+// Return the rate limit budget of every domain, as computed during the last cycle.
+func (CertManager *CertManager) DomainsStatus() []DomainStatus {
+	CertManager.status.mutex.RLock()
+	defer CertManager.status.mutex.RUnlock()
+	return append([]DomainStatus{}, CertManager.status.domains...)
+}
+
+func (CertManager *CertManager) startCycleStatus() {
+	CertManager.status.mutex.Lock()
+	defer CertManager.status.mutex.Unlock()
+	CertManager.status.cycle = CycleStatus{
+		Start:   time.Now(),
+		Outcome: CycleOutcomeRunning,
+		Cycles:  CertManager.status.cycle.Cycles,
+	}
+}
+
+func (CertManager *CertManager) endCycleStatus() {
+	CertManager.status.mutex.Lock()
+	defer CertManager.status.mutex.Unlock()
+	for index := range CertManager.status.sites {
+		CertManager.status.sites[index].Renewal = CertManager.status.renewals[CertManager.status.sites[index].URL]
+	}
+	cycle := &CertManager.status.cycle
+	cycle.Duration = time.Since(cycle.Start)
+	cycle.Cycles += 1
+	switch {
+	case cycle.Failed == 0:
+		cycle.Outcome = CycleOutcomeSuccess
+	case cycle.Renewed > 0:
+		cycle.Outcome = CycleOutcomePartial
+	default:
+		cycle.Outcome = CycleOutcomeFailure
+	}
+	CertManager.status.ready = true
+}
+
+// Keep the renewal result of the sites of a certificate for the API, the cycle counts it once.
+func (CertManager *CertManager) recordRenewalStatus(sites []fetcher.SiteCertProber, err error) {
+	CertManager.status.mutex.Lock()
+	defer CertManager.status.mutex.Unlock()
+	if CertManager.status.renewals == nil {
+		CertManager.status.renewals = make(map[string]RenewalState)
+	}
+	if err != nil {
+		CertManager.status.cycle.Failed += 1
+	} else {
+		CertManager.status.cycle.Renewed += 1
+	}
+	for _, site := range sites {
+		state := CertManager.status.renewals[site.GetConfig().URL]
+		state.LastAttempt = time.Now()
+		if err != nil {
+			state.LastError = err.Error()
+		} else {
+			state.LastSuccess = state.LastAttempt
+			state.LastError = ""
+		}
+		CertManager.status.renewals[site.GetConfig().URL] = state
+	}
+}
+
+// Build the sites and domains views from the indexed sites,
+// before the domains which don't respect the limits are discarded.
+func (CertManager *CertManager) snapshotStatus() {
+	sites := make([]SiteStatus, 0)
+	domains := make([]DomainStatus, 0)
+	for _, domain := range CertManager.IndexedSites {
+		for _, site := range domain.Sites {
+			sites = append(sites, buildSiteStatus(site))
+		}
+		domains = append(domains, DomainStatus{
+			Name:             domain.Name,
+			Sites:            len(domain.Sites),
+			SitesDue:         CertManager.GetSitesQtyToRenewBefore(0, domain),
+			SitesDueThisWeek: CertManager.GetSitesQtyToRenewBefore(RateLimitDays, domain),
+			RemainingQueries: CertManager.GetRemainingLEQueriesUntil(RateLimitDays, domain),
+		})
+	}
+	CertManager.status.mutex.Lock()
+	defer CertManager.status.mutex.Unlock()
+	for index := range sites {
+		sites[index].Renewal = CertManager.status.renewals[sites[index].URL]
+	}
+	CertManager.status.sites = sites
+	CertManager.status.domains = domains
+}
+
+func buildSiteStatus(site fetcher.SiteCertProber) SiteStatus {
+	config := site.GetConfig()
+	siteStatus := SiteStatus{
+		URL:    config.URL,
+		Domain: site.GetDomain(),
+		Server: config.Server,
+		Port:   config.Port,
+	}
+	siteStatus.Mode = fetcher.ModeMonitor
+	if certificateConfig, ok := config.GetCertificateConfig(); ok {
+		siteStatus.Mode = fetcher.ModeRenew
+		siteStatus.Certificate = certificateConfig.Name
+	}
+	if certificate := site.GetCertificate(); certificate != nil {
+		siteStatus.Subject = certificate.Subject.CommonName
+		siteStatus.Issuer = certificate.Issuer.CommonName
+		siteStatus.Names = certificate.DNSNames
+		siteStatus.NotBefore = certificate.NotBefore
+		siteStatus.NotAfter = certificate.NotAfter
+		siteStatus.DaysLeft = site.DaysLeft()
+	}
+	if status, ok := ocspStatusOf(site); ok {
+		siteStatus.OCSP = &status
+	}
+	return siteStatus
+}
@@ -1,9 +1,12 @@
 package local
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 
-	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
 	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
 )
 
@@ -28,53 +31,75 @@ func initLocalUpdater(config updater.CertificateUpdateConfig, certifRootPath str
 	}, nil
 }
 
-// Send with the client create in the InitMulti,
-// the Certificate and the Private key to the right place, given in the site configuration.
-func (lcu *Local) UpdateCertificate(site fetcher.SiteCertProber) error {
-	// Copy the Certificate to the right place given in site config
-	_, err := exec.Command("cp " + lcu.CertifRootPath + "/" + site.GetConfig().URL + "/" +
-		site.GetConfig().URL + ".crt " + site.GetConfig().Location.Certificate).Output()
+// Copy the Certificate and the Private key to the right place, given in the deployment.
+// The commands are killed if the context is cancelled.
+func (lcu *Local) UpdateCertificate(ctx context.Context, deployment updater.Deployment) error {
+	// Copy the Certificate to the right place given in the deployment
+	_, err := exec.CommandContext(ctx, "cp", deployment.CertificateFile, deployment.Location.Certificate).Output()
 	if err != nil {
 		return err
 	}
-	// Copy the Private Key to the right place given in site config
-	_, err = exec.Command("cp " + lcu.CertifRootPath + "/" + site.GetConfig().URL + "/" +
-		site.GetConfig().URL + ".key " + site.GetConfig().Location.PrivateKey).Output()
+	_, err = exec.CommandContext(ctx, "chown", lcu.Config.CertificatesOwner+":"+lcu.Config.CertificatesOwner,
+		deployment.Location.Certificate).Output()
 	if err != nil {
 		return err
 	}
-	_, err = exec.Command("chown " + lcu.Config.CertificatesOwner + ":" + lcu.Config.CertificatesOwner + " " +
-		site.GetConfig().Location.Certificate).Output()
-	if err != nil {
-		return err
-	}
-	_, err = exec.Command("chown " + lcu.Config.CertificatesOwner + ":" + lcu.Config.CertificatesOwner + " " +
-		site.GetConfig().Location.PrivateKey).Output()
-	if err != nil {
-		return err
+	if deployment.PrivateKeyFile == "" {
+		return nil
 	}
-	_, err = exec.Command("chown " + lcu.Config.CertificatesOwner + " " + site.GetConfig().Location.Certificate).Output()
+	// Copy the Private Key to the right place given in the deployment
+	_, err = exec.CommandContext(ctx, "cp", deployment.PrivateKeyFile, deployment.Location.PrivateKey).Output()
 	if err != nil {
 		return err
 	}
-	_, err = exec.Command("chown " + lcu.Config.CertificatesOwner + " " + site.GetConfig().Location.PrivateKey).Output()
+	_, err = exec.CommandContext(ctx, "chown", lcu.Config.CertificatesOwner+":"+lcu.Config.CertificatesOwner,
+		deployment.Location.PrivateKey).Output()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Retrieve the restart command and execute the named program with
-// the given arguments.
-func (lcu *Local) ReloadHTTPServer() error {
-	_, err := exec.Command(lcu.Config.RestartCMD).Output()
+// Retrieve the restart command and execute it with a shell.
+func (lcu *Local) ReloadHTTPServer(ctx context.Context) error {
+	_, err := exec.CommandContext(ctx, "sh", "-c", lcu.Config.RestartCMD).Output()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Read the local files matching the patterns.
+func (lcu *Local) ReadFiles(ctx context.Context, patterns []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			content, err := ioutil.ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			files[match] = content
+		}
+	}
+	return files, nil
+}
+
 // Get the name of the updater used.
 func (lcu *Local) GetName() string {
 	return lcu.Config.Name
 }
+
+// Get the configuration of the updater.
+func (lcu *Local) GetConfig() updater.CertificateUpdateConfig {
+	return lcu.Config
+}
@@ -1,14 +1,16 @@
 package ssh
 
 import (
+	"context"
 	"errors"
 	"github.com/hnakamur/go-scp"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
 	"github.com/DumesnyJeremy/certificate-manager/manager/updater"
 )
 
@@ -16,6 +18,8 @@ type SSH struct {
 	Client         *ssh.Client
 	Config         certificate_updater.CertificateUpdateConfig
 	CertifRootPath string
+	clientConfig   *ssh.ClientConfig
+	mutex          sync.Mutex // Guards the Client while it is dialed again.
 }
 
 // Receives the config from the file, read and parse the id_rasa
@@ -38,48 +42,82 @@ func initSSHUpdater(config certificate_updater.CertificateUpdateConfig, certifRo
 	if err != nil {
 		return nil, errors.New("Read private key for this config: " + config.RemoteConnection.Hostname + " fail: " + err.Error())
 	}
-	client, err := initSSHClient(config, signer)
-	if err != nil {
-		return nil, err
-	}
-	return &SSH{
-		Client:         client,
-		Config:         config,
-		CertifRootPath: certifRootPath,
-	}, nil
+	return newSSHUpdater(config, certifRootPath, signer)
 }
 
-func initSSHClient(config certificate_updater.CertificateUpdateConfig, signer ssh.Signer) (*ssh.Client, error) {
+func newSSHUpdater(config certificate_updater.CertificateUpdateConfig, certifRootPath string, signer ssh.Signer) (*SSH, error) {
 	// Fill up client
-	clientConfig := &ssh.ClientConfig{
-		User: config.CertificatesOwner,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
+	updater := &SSH{
+		Config:         config,
+		CertifRootPath: certifRootPath,
+		clientConfig: &ssh.ClientConfig{
+			User: config.CertificatesOwner,
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(signer),
+			},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
+	if _, err := updater.connected(); err != nil {
+		return nil, err
+	}
+	return updater, nil
+}
 
+// Return the client of the updater, kept between the deployments.
+// A connection dropped by the server or the network is dialed again.
+func (scu *SSH) connected() (*ssh.Client, error) {
+	scu.mutex.Lock()
+	defer scu.mutex.Unlock()
+	if scu.Client != nil {
+		if _, _, err := scu.Client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return scu.Client, nil
+		}
+		_ = scu.Client.Close()
+		scu.Client = nil
+	}
 	// Create client connection
 	client, err := ssh.Dial("tcp",
-		config.RemoteConnection.Hostname+":"+strconv.Itoa(config.RemoteConnection.Port),
-		clientConfig)
+		scu.Config.RemoteConnection.Hostname+":"+strconv.Itoa(scu.Config.RemoteConnection.Port),
+		scu.clientConfig)
 	if err != nil {
 		return nil, err
 	}
+	scu.Client = client
 	return client, nil
 }
 
+// Close the connection, once the updater is no longer used.
+func (scu *SSH) Close() error {
+	scu.mutex.Lock()
+	defer scu.mutex.Unlock()
+	if scu.Client == nil {
+		return nil
+	}
+	err := scu.Client.Close()
+	scu.Client = nil
+	return err
+}
+
 // Send with the client create in the InitMulti,
-// the Certificate and the Private key to the right place, given in the site configuration.
-func (scu *SSH) UpdateCertificate(site fetcher.SiteCertProber) error {
-	err := scp.NewSCP(scu.Client).SendFile(scu.CertifRootPath+"/"+site.GetConfig().URL+"/"+
-		site.GetConfig().URL+".crt", site.GetConfig().Location.Certificate)
+// the Certificate and the Private key to the right place, given in the deployment.
+// A cancelled context stops before the next file.
+func (scu *SSH) UpdateCertificate(ctx context.Context, deployment certificate_updater.Deployment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client, err := scu.connected()
 	if err != nil {
 		return err
 	}
-
-	err = scp.NewSCP(scu.Client).SendFile(scu.CertifRootPath+"/"+site.GetConfig().URL+"/"+
-		site.GetConfig().URL+".key", site.GetConfig().Location.PrivateKey)
+	err = scp.NewSCP(client).SendFile(deployment.CertificateFile, deployment.Location.Certificate)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil || deployment.PrivateKeyFile == "" {
+		return err
+	}
+	err = scp.NewSCP(client).SendFile(deployment.PrivateKeyFile, deployment.Location.PrivateKey)
 	if err != nil {
 		return err
 	}
@@ -87,20 +125,111 @@ func (scu *SSH) UpdateCertificate(site fetcher.SiteCertProber) error {
 }
 
 // NewSession opens  for this client and execute the restart command.
-func (scu *SSH) ReloadHTTPServer() error {
-	defer scu.Client.Close()
-	session, err := scu.Client.NewSession()
+// The session is closed if the context is cancelled, the client is kept for the next deployments.
+func (scu *SSH) ReloadHTTPServer(ctx context.Context) error {
+	session, err := scu.newSession()
 	if err != nil {
 		return err
 	}
+	defer session.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-done:
+		}
+	}()
 	// Reload the scu
 	if err := session.Run(scu.Config.RestartCMD); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	return nil
 }
 
+// List the remote files matching the patterns with the shell, then read them one by one.
+func (scu *SSH) ReadFiles(ctx context.Context, patterns []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	globs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		globs = append(globs, shellGlob(pattern))
+	}
+	listing, err := scu.run(ctx, "for f in "+strings.Join(globs, " ")+"; do [ -f \"$f\" ] && echo \"$f\"; done; true")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+		if path == "" {
+			continue
+		}
+		content, err := scu.run(ctx, "cat -- "+shellQuote(path))
+		if err != nil {
+			return nil, errors.New("While reading " + path + ": " + err.Error())
+		}
+		files[path] = content
+	}
+	return files, nil
+}
+
+// Quote the pattern for the shell, keeping its glob characters: the rest of the pattern can't run anything.
+func shellGlob(pattern string) string {
+	var glob strings.Builder
+	for _, r := range pattern {
+		if strings.ContainsRune("*?[]!^-_./,:=@%+", r) || (r < 128 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')) {
+			glob.WriteRune(r)
+		} else {
+			glob.WriteString(shellQuote(string(r)))
+		}
+	}
+	return glob.String()
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "'\\''") + "'"
+}
+
+// Run the command in a new session and return its output.
+// The session is closed if the context is cancelled.
+func (scu *SSH) run(ctx context.Context, command string) ([]byte, error) {
+	session, err := scu.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-done:
+		}
+	}()
+	output, err := session.Output(command)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return output, err
+}
+
+func (scu *SSH) newSession() (*ssh.Session, error) {
+	client, err := scu.connected()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
 // Get the name of the updater used.
 func (scu *SSH) GetName() string {
 	return scu.Config.Name
 }
+
+// Get the configuration of the updater.
+func (scu *SSH) GetConfig() certificate_updater.CertificateUpdateConfig {
+	return scu.Config
+}
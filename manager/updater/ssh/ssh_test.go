@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	certificate_updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+)
+
+func TestShellGlob(t *testing.T) {
+	var arguments = []struct {
+		pattern string
+		glob    string
+	}{
+		{"/etc/nginx/sites-enabled/*", "/etc/nginx/sites-enabled/*"},
+		{"/etc/httpd/conf.d/[a-z]*.conf", "/etc/httpd/conf.d/[a-z]*.conf"},
+		{"/etc/my sites/*.conf", "/etc/my' 'sites/*.conf"},
+		{"/tmp/x;touch /tmp/pwned", "/tmp/x';'touch' '/tmp/pwned"},
+		{"/tmp/$(id)'", "/tmp/'$''('id')'''\\'''"},
+	}
+	for _, argument := range arguments {
+		if glob := shellGlob(argument.pattern); glob != argument.glob {
+			t.Error("Expected ", argument.glob, " got ", glob)
+		}
+	}
+	// The shell sees the special characters as text.
+	output, err := exec.Command("sh", "-c", "echo "+shellGlob("/nonexistent/$(echo injected);`id`")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "/nonexistent/$(echo injected);`id`\n" {
+		t.Error("Expected the pattern untouched, got ", string(output))
+	}
+}
+
+// Serve SSH on a local port and run the exec requests with the local shell, the way a host would.
+func newSSHServer(t *testing.T) (net.Listener, ssh.Signer) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener, clientSigner
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range requests {
+				if request.Type != "exec" || len(request.Payload) < 4 {
+					_ = request.Reply(false, nil)
+					continue
+				}
+				_ = request.Reply(true, nil)
+				go execSSH(channel, string(request.Payload[4:]))
+			}
+		}()
+	}
+}
+
+func execSSH(channel ssh.Channel, command string) {
+	defer channel.Close()
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(stdin, channel)
+		_ = stdin.Close()
+	}()
+	status := make([]byte, 4)
+	if err := cmd.Wait(); err != nil {
+		binary.BigEndian.PutUint32(status, 1)
+	}
+	_, _ = channel.SendRequest("exit-status", false, status)
+}
+
+func TestDeployTwice(t *testing.T) {
+	listener, signer := newSSHServer(t)
+	defer listener.Close()
+	dir, err := ioutil.TempDir("", "ssh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := certificate_updater.CertificateUpdateConfig{
+		Name:       "web",
+		Type:       "ssh",
+		RestartCMD: "echo reloaded >> " + filepath.Join(dir, "reloads"),
+	}
+	config.RemoteConnection.Protocol = "ssh"
+	config.RemoteConnection.Hostname = "127.0.0.1"
+	config.RemoteConnection.Port = listener.Addr().(*net.TCPAddr).Port
+	updater, err := newSSHUpdater(config, dir, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updater.Close()
+
+	certificateFile := filepath.Join(dir, "certificate.pem")
+	deployment := certificate_updater.Deployment{CertificateFile: certificateFile}
+	deployment.Location.Certificate = filepath.Join(dir, "deployed.pem")
+	for i, content := range []string{"first", "second", "third"} {
+		if err := ioutil.WriteFile(certificateFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			// The server dropped the connection: the next deployment dials again.
+			_ = updater.Client.Close()
+		}
+		if err := updater.UpdateCertificate(context.Background(), deployment); err != nil {
+			t.Fatal("Deployment ", i+1, ": ", err)
+		}
+		if err := updater.ReloadHTTPServer(context.Background()); err != nil {
+			t.Fatal("Reload ", i+1, ": ", err)
+		}
+		deployed, err := ioutil.ReadFile(deployment.Location.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(deployed) != content {
+			t.Error("Expected ", content, " deployed, got ", string(deployed))
+		}
+	}
+	reloads, err := ioutil.ReadFile(filepath.Join(dir, "reloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reloads) != "reloaded\nreloaded\nreloaded\n" {
+		t.Error("Expected 3 reloads, got ", string(reloads))
+	}
+}
@@ -1,7 +1,9 @@
 package certificate_updater
 
 import (
-	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"context"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
 )
 
 // The 2 types of implementation to upload a certificate.
@@ -9,9 +11,24 @@ const LocalAccessType = "local"
 const RemoteAccessType = "remote"
 
 type CertificateUpdater interface {
-	UpdateCertificate(site fetcher.SiteCertProber) error
-	ReloadHTTPServer() error
+	UpdateCertificate(ctx context.Context, deployment Deployment) error
+	ReloadHTTPServer(ctx context.Context) error
 	GetName() string
+	GetConfig() CertificateUpdateConfig
+}
+
+// A certificate to upload: the files issued by the manager, and the paths where the server reads them.
+type Deployment struct {
+	Certificate     string // Name of the certificate.
+	CertificateFile string
+	PrivateKeyFile  string // Empty for a certificate ordered with its own CSR, the server already has its key.
+	Location        certificates.LocationConfig
+}
+
+// Implemented by the updaters able to read the files of their server, used to discover the sites.
+// Return the content of every file matching one of the shell patterns, by path.
+type FileReader interface {
+	ReadFiles(ctx context.Context, patterns []string) (map[string][]byte, error)
 }
 
 type CertificateUpdateConfig struct {
@@ -20,6 +37,9 @@ type CertificateUpdateConfig struct {
 	CertificatesOwner string               `mapstructure:"certificates_owner"`
 	RemoteConnection  infoRemoteConnection `mapstructure:"remote_connection"`
 	RestartCMD        string               `mapstructure:"reload_cmd"`
+	// Cron expressions of the minutes where a deployment is allowed, e.g. "* 9-17 * * mon-fri".
+	// Without window, the certificates are deployed as soon as they are issued.
+	Windows []string `mapstructure:"windows"`
 }
 
 type infoRemoteConnection struct {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	"github.com/DumesnyJeremy/notification-service"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+	"github.com/DumesnyJeremy/certificate-manager/viper-fetcher"
+)
+
+// Parse and validate the configuration again, then give the new components to the CertManager.
+// If the new configuration is invalid, the current one is kept.
+func reloadConfiguration(ctx context.Context, CertManager *manager.CertManager, current *viper_fetcher.Config,
+	confDirPath string) *viper_fetcher.Config {
+	config, errs := viper_fetcher.ValidateConfig(confDirPath)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error("Invalid configuration: ", err.Error())
+		}
+		log.Error("The configuration is rejected, the current one is kept.")
+		return current
+	}
+	changes := viper_fetcher.Diff(current, config)
+	if len(changes) == 0 {
+		log.Info("Configuration unchanged.")
+		return config
+	}
+	for _, change := range changes {
+		log.Info("Configuration: ", change)
+	}
+	components := reuseComponents(ctx, CertManager, current, config)
+	running := CertManager.CertificateUpdaters
+	CertManager.Reload(
+		config.CertManager,
+		components.Updaters,
+		components.IndexedSites,
+		components.Notifiers,
+		components.DNSServers,
+		components.LetsEncrypt,
+		components.CAs)
+	closeDroppedUpdaters(running, components.Updaters)
+	log.Info("Configuration reloaded.")
+	return config
+}
+
+// Build the components of the new configuration, keeping the running ones whose configuration didn't change,
+// so the open connections and the probed certificates are not lost.
+func reuseComponents(ctx context.Context, CertManager *manager.CertManager, current *viper_fetcher.Config,
+	config *viper_fetcher.Config) components {
+	rootPathUnchanged := current.CertRootPath == config.CertRootPath
+
+	updaters := make([]updater.CertificateUpdater, 0)
+	for _, updaterConfig := range config.Updaters {
+		if CertificateUpdater := findRunningUpdater(CertManager, updaterConfig); CertificateUpdater != nil && rootPathUnchanged {
+			updaters = append(updaters, CertificateUpdater)
+		} else if CertificateUpdater, err := initCertifUpdater(updaterConfig, config.CertRootPath); err == nil {
+			updaters = append(updaters, CertificateUpdater)
+		} else {
+			log.Error("While InitCertifUpdater: " + err.Error())
+		}
+	}
+
+	notifiers := make([]notification_service.Notifier, 0)
+	for _, notifierConfig := range config.Notifiers {
+		if notifier := findRunningNotifier(CertManager, current, notifierConfig); notifier != nil {
+			notifiers = append(notifiers, notifier)
+		} else if notifier, err := initNotifier(notifierConfig); notifier != nil {
+			notifiers = append(notifiers, notifier)
+		} else {
+			log.Error("While InitNotifier: ", err.Error())
+		}
+	}
+
+	dnsServers := make([]dns.DNSServer, 0)
+	for _, dnsServerConfig := range config.DNSServers {
+		if dnsServer := findRunningDNSServer(CertManager, current, dnsServerConfig); dnsServer != nil {
+			dnsServers = append(dnsServers, dnsServer)
+		} else if dnsServer, err := initDNSServer(dnsServerConfig); dnsServer != nil {
+			dnsServers = append(dnsServers, dnsServer)
+		} else {
+			log.Error("While InitDNSServer: ", err.Error())
+		}
+	}
+
+	sites := make([]fetcher.SiteCertProber, 0)
+	for _, siteConfig := range config.Sites {
+		if site := CertManager.FindSite(siteConfig.URL); site != nil && reflect.DeepEqual(site.GetConfig(), siteConfig) {
+			sites = append(sites, site)
+		} else if site, err := fetcher.Init(ctx, siteConfig); err == nil {
+			sites = append(sites, site)
+		} else {
+			log.Error("[", siteConfig.URL, "] ", err.Error())
+		}
+	}
+
+	letsEncrypt := CertManager.LetsEncrypt
+	if !rootPathUnchanged || !reflect.DeepEqual(current.LetsEncryptUser, config.LetsEncryptUser) {
+		letsEncrypt = initLetsEncrypt(config)
+	}
+	// A CA that failed to initialize is left out, it is tried again.
+	CAs := CertManager.CAs
+	if !rootPathUnchanged || !reflect.DeepEqual(current.ACMEAccounts, config.ACMEAccounts) || len(CAs) < len(config.ACMEAccounts) {
+		CAs = initCAs(config)
+	}
+	return components{
+		Notifiers:    notifiers,
+		DNSServers:   dnsServers,
+		Updaters:     updaters,
+		IndexedSites: fetcher.IndexSitesPerDomains(sites),
+		LetsEncrypt:  letsEncrypt,
+		CAs:          CAs,
+	}
+}
+
+// A reused updater keeps its connection, an SSH updater dials again the host if it was lost.
+func findRunningUpdater(CertManager *manager.CertManager, updaterConfig updater.CertificateUpdateConfig) updater.CertificateUpdater {
+	for _, CertificateUpdater := range CertManager.CertificateUpdaters {
+		if CertificateUpdater.GetName() == updaterConfig.Name && reflect.DeepEqual(CertificateUpdater.GetConfig(), updaterConfig) {
+			return CertificateUpdater
+		}
+	}
+	return nil
+}
+
+// Close the connections of the updaters the new configuration doesn't use anymore.
+func closeDroppedUpdaters(running []updater.CertificateUpdater, kept []updater.CertificateUpdater) {
+	for _, CertificateUpdater := range running {
+		dropped := true
+		for _, keptUpdater := range kept {
+			if keptUpdater == CertificateUpdater {
+				dropped = false
+			}
+		}
+		if closer, ok := CertificateUpdater.(io.Closer); ok && dropped {
+			if err := closer.Close(); err != nil {
+				log.Error("[", CertificateUpdater.GetName(), "] While closing: ", err.Error())
+			}
+		}
+	}
+}
+
+// A notifier doesn't give its configuration back, the one of the running configuration is compared instead.
+func findRunningNotifier(CertManager *manager.CertManager, current *viper_fetcher.Config,
+	notifierConfig notification_service.NotifierConfig) notification_service.Notifier {
+	unchanged := false
+	for _, currentConfig := range current.Notifiers {
+		if currentConfig.Name == notifierConfig.Name && reflect.DeepEqual(currentConfig, notifierConfig) {
+			unchanged = true
+		}
+	}
+	if !unchanged {
+		return nil
+	}
+	for _, notifier := range CertManager.Notifiers {
+		if strings.EqualFold(notifier.GetName(), notifierConfig.Name) {
+			return notifier
+		}
+	}
+	return nil
+}
+
+// The fields of the rfc2136 type aren't in the configuration given back by the DNS server,
+// the one of the running configuration is compared too.
+func findRunningDNSServer(CertManager *manager.CertManager, current *viper_fetcher.Config,
+	dnsServerConfig viper_fetcher.DNSServerConfig) dns.DNSServer {
+	unchanged := false
+	for _, currentConfig := range current.DNSServers {
+		if currentConfig.Name == dnsServerConfig.Name && reflect.DeepEqual(currentConfig, dnsServerConfig) {
+			unchanged = true
+		}
+	}
+	if !unchanged {
+		return nil
+	}
+	for _, dnsServer := range CertManager.DNSServers {
+		if reflect.DeepEqual(dnsServer.GetConfig(), dnsServerConfig.DNSServerConfig) {
+			return dnsServer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/acme"
+)
+
+// Revoke the certificate of a site, a certificate name or a serial, at the CA which issued it.
+// With -replace, a new certificate is issued and deployed straight away.
+func revokeCommand(ctx context.Context, CertManager *manager.CertManager, args []string) int {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	reason := flags.String("reason", "unspecified", "revocation reason: "+strings.Join(acme.RevocationReasonNames(), ", "))
+	replace := flags.Bool("replace", false, "issue a new certificate and deploy it straight away, outside of the deployment windows")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: revoke [-reason <reason>] [-replace] <site, certificate or serial>")
+		return 2
+	}
+	if err := CertManager.Revoke(ctx, flags.Arg(0), *reason, *replace); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
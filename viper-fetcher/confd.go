@@ -0,0 +1,252 @@
+package viper_fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DumesnyJeremy/notification-service"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+)
+
+// Directory, inside the configuration directory, whose files add certificates, sites, updaters, notifiers and DNS servers.
+const ConfDDirName = "conf.d"
+
+// File types loaded from the conf.d directory.
+var confDFileTypes = []string{"toml", "yaml", "json"}
+
+// Where an entry of a list was defined: the file, and the index of the entry in the list of this file.
+type Source struct {
+	File  string
+	Index int
+}
+
+// Source of every entry of the lists, in the same order as the lists of the Config.
+type Sources struct {
+	Certificates []Source
+	Sites        []Source
+	Updaters     []Source
+	Notifiers    []Source
+	DNSServers   []Source
+}
+
+// The only sections allowed in a file of the conf.d directory.
+type confDFile struct {
+	Certificates []certificates.Config                 `mapstructure:"certificates"`
+	Sites        []fetcher.CertificateFetchConfig      `mapstructure:"sites"`
+	Updaters     []updater.CertificateUpdateConfig     `mapstructure:"updaters"`
+	Notifiers    []notification_service.NotifierConfig `mapstructure:"notifiers"`
+	DNSServers   []DNSServerConfig                     `mapstructure:"dns_servers"`
+}
+
+// Return the files of the conf.d directory, sorted by name so the merge order is always the same.
+func confDFiles(configFilePath string) []string {
+	files := make([]string, 0)
+	for _, fileType := range confDFileTypes {
+		matches, _ := filepath.Glob(filepath.Join(configFilePath, ConfDDirName, "*."+fileType))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Record the main configuration file as the source of the entries it defines.
+func (config *Config) setMainSources(file string) {
+	config.File = file
+	config.Sources = Sources{
+		Certificates: sourcesOf(file, len(config.Certificates)),
+		Sites:        sourcesOf(file, len(config.Sites)),
+		Updaters:     sourcesOf(file, len(config.Updaters)),
+		Notifiers:    sourcesOf(file, len(config.Notifiers)),
+		DNSServers:   sourcesOf(file, len(config.DNSServers)),
+	}
+}
+
+// Append the lists of every file of the conf.d directory to the configuration.
+// With strict, the unknown keys and the wrong types are errors, like in the main file.
+func (config *Config) mergeConfD(configFilePath string, strict bool) []error {
+	errs := make([]error, 0)
+	for _, file := range confDFiles(configFilePath) {
+		fileViper := viper.New()
+		fileViper.SetConfigFile(file)
+		if err := fileViper.ReadInConfig(); err != nil {
+			errs = append(errs, errors.New(file+": "+err.Error()))
+			continue
+		}
+		registerSecrets(fileViper.AllSettings(), "")
+		var part confDFile
+		options := []viper.DecoderConfigOption{decodeHooks}
+		if strict {
+			options = append(options, strictDecoding)
+		}
+		if err := fileViper.Unmarshal(&part, options...); err != nil {
+			errs = append(errs, decodeErrors(file, err)...)
+		}
+		config.Certificates = append(config.Certificates, part.Certificates...)
+		config.Sources.Certificates = append(config.Sources.Certificates, sourcesOf(file, len(part.Certificates))...)
+		config.Sites = append(config.Sites, part.Sites...)
+		config.Sources.Sites = append(config.Sources.Sites, sourcesOf(file, len(part.Sites))...)
+		config.Updaters = append(config.Updaters, part.Updaters...)
+		config.Sources.Updaters = append(config.Sources.Updaters, sourcesOf(file, len(part.Updaters))...)
+		config.Notifiers = append(config.Notifiers, part.Notifiers...)
+		config.Sources.Notifiers = append(config.Sources.Notifiers, sourcesOf(file, len(part.Notifiers))...)
+		config.DNSServers = append(config.DNSServers, part.DNSServers...)
+		config.Sources.DNSServers = append(config.Sources.DNSServers, sourcesOf(file, len(part.DNSServers))...)
+	}
+	return errs
+}
+
+// Add the lists of the conf.d directory to the settings of the main file, for the dump.
+func mergeConfDSettings(configFilePath string, settings map[string]interface{}) error {
+	for _, file := range confDFiles(configFilePath) {
+		fileViper := viper.New()
+		fileViper.SetConfigFile(file)
+		if err := fileViper.ReadInConfig(); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+		registerSecrets(fileViper.AllSettings(), "")
+		for _, key := range []string{"certificates", "sites", "updaters", "notifiers", "dns_servers"} {
+			entries, ok := fileViper.Get(key).([]interface{})
+			if !ok {
+				continue
+			}
+			merged, _ := settings[key].([]interface{})
+			settings[key] = append(merged, entries...)
+		}
+	}
+	return nil
+}
+
+// Return the location of an entry of a list, e.g. "conf.d/team.yaml: sites[2]".
+func (config *Config) location(section string, sources []Source, index int) string {
+	if index < len(sources) {
+		return sources[index].File + ": " + section + "[" + strconv.Itoa(sources[index].Index) + "]"
+	}
+	return section + "[" + strconv.Itoa(index) + "]"
+}
+
+// Return the location of a key outside of the lists, in the main file.
+func (config *Config) mainLocation(key string) string {
+	if config.File == "" {
+		return key
+	}
+	return config.File + ": " + key
+}
+
+func sourcesOf(file string, count int) []Source {
+	sources := make([]Source, 0, count)
+	for i := 0; i < count; i++ {
+		sources = append(sources, Source{File: file, Index: i})
+	}
+	return sources
+}
+
+func strictDecoding(decoderConfig *mapstructure.DecoderConfig) {
+	decoderConfig.ErrorUnused = true
+	decoderConfig.WeaklyTypedInput = false
+}
+
+// Split the errors of the decoder, one per problem, prefixed by the file.
+func decodeErrors(file string, err error) []error {
+	errs := make([]error, 0)
+	if decodeErr, ok := err.(*mapstructure.Error); ok {
+		for _, message := range decodeErr.Errors {
+			errs = append(errs, errors.New(file+": "+message))
+		}
+	} else if err != nil {
+		errs = append(errs, errors.New(file+": "+err.Error()))
+	}
+	return errs
+}
+
+// A field the decoder couldn't set, e.g. a secret file that can't be read: "config.yaml: error decoding 'dns_servers[0].tsig_secret': ...".
+var undecodedField = regexp.MustCompile(`^(.*?): error decoding '([^']+)'`)
+
+// Leave out the errors of the checks depending on a field the decoder couldn't set:
+// the field is empty, and the reason is already given by the decoding error.
+// An error depends on the field when it is about the same entry and names the field,
+// e.g. "dns_servers[0].tsig_key: tsig_key and tsig_secret go together".
+func withoutDependentErrors(errs []error, decodeErrs []error) []error {
+	entries := make([]string, 0)
+	fields := make([]string, 0)
+	for _, err := range decodeErrs {
+		match := undecodedField.FindStringSubmatch(err.Error())
+		if match == nil {
+			continue
+		}
+		entry, field := match[1]+": ", match[2]
+		if dot := strings.LastIndex(field, "."); dot >= 0 {
+			entry, field = entry+field[:dot], field[dot+1:]
+		}
+		entries = append(entries, entry)
+		fields = append(fields, field)
+	}
+	kept := make([]error, 0, len(errs))
+	for _, err := range errs {
+		dependent := false
+		for i, entry := range entries {
+			if message := err.Error(); strings.HasPrefix(message, entry) && strings.Contains(message[len(entry):], fields[i]) {
+				dependent = true
+			}
+		}
+		if !dependent {
+			kept = append(kept, err)
+		}
+	}
+	return kept
+}
+
+// Write the sites in a JSON file of the conf.d directory, loaded with the rest of the configuration.
+func WriteConfDSites(path string, sites []fetcher.CertificateFetchConfig) error {
+	content, err := ConfDSites(sites)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0640)
+}
+
+// Return the sites as the content of a JSON file of the conf.d directory.
+func ConfDSites(sites []fetcher.CertificateFetchConfig) ([]byte, error) {
+	entries := make([]map[string]interface{}, 0, len(sites))
+	for _, site := range sites {
+		entry := map[string]interface{}{
+			"url":  site.URL,
+			"port": site.Port,
+		}
+		if site.Mode != "" {
+			entry["mode"] = site.Mode
+		}
+		if site.Server != "" {
+			entry["server"] = site.Server
+		}
+		if len(site.Names) > 0 {
+			entry["names"] = site.Names
+		}
+		if site.Location.Certificate != "" || site.Location.PrivateKey != "" {
+			entry["location"] = map[string]string{
+				"certificate": site.Location.Certificate,
+				"private_key": site.Location.PrivateKey,
+			}
+		}
+		entries = append(entries, entry)
+	}
+	content, err := json.MarshalIndent(map[string]interface{}{"sites": entries}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
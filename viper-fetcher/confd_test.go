@@ -0,0 +1,75 @@
+package viper_fetcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfDIsMerged(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+sites:
+  - url: www.example.com
+updaters:
+  - name: Serv 1
+    type: local
+`)
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ConfDDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	teamA := filepath.Join(dir, ConfDDirName, "team-a.yaml")
+	teamB := filepath.Join(dir, ConfDDirName, "team-b.toml")
+	if err := ioutil.WriteFile(teamA, []byte("sites:\n  - url: a.example.com\n  - url: www.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(teamB, []byte("loop_restart_min = 5\n[[updaters]]\nname = \"Serv 2\"\ntype = \"local\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Sites) != 3 || len(config.Updaters) != 2 {
+		t.Fatal("Expected 3 sites and 2 updaters, got ", len(config.Sites), " and ", len(config.Updaters))
+	}
+	if config.Sources.Sites[2] != (Source{File: teamA, Index: 1}) {
+		t.Error("Wrong source for the last site: ", config.Sources.Sites[2])
+	}
+	_, errs := ValidateConfig(dir)
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	expected := []string{
+		teamA + ": sites[1].url: duplicate site [www.example.com], already defined in " + filepath.Join(dir, "config.yaml") + ": sites[0]",
+		teamB + ": '' has invalid keys: loop_restart_min",
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+}
+
+func TestParseConfigReportsEveryFile(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", "sites:\n  - url: www.example.com\n")
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ConfDDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	teamA := filepath.Join(dir, ConfDDirName, "team-a.yaml")
+	teamB := filepath.Join(dir, ConfDDirName, "team-b.json")
+	if err := ioutil.WriteFile(teamA, []byte("sites: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(teamB, []byte("{\"sites\": "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ParseConfig(dir)
+	if err == nil || !strings.Contains(err.Error(), teamA) || !strings.Contains(err.Error(), teamB) {
+		t.Error("Expected an error for both files, got ", err)
+	}
+}
@@ -0,0 +1,94 @@
+package viper_fetcher
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Describe what changed between two configurations, one line per change.
+func Diff(previous *Config, next *Config) []string {
+	changes := make([]string, 0)
+	changes = append(changes, diffNamed("certificate", certificatesByName(previous), certificatesByName(next))...)
+	changes = append(changes, diffNamed("site", sitesByURL(previous), sitesByURL(next))...)
+	changes = append(changes, diffNamed("updater", updatersByName(previous), updatersByName(next))...)
+	changes = append(changes, diffNamed("notifier", notifiersByName(previous), notifiersByName(next))...)
+	changes = append(changes, diffNamed("DNS server", dnsServersByName(previous), dnsServersByName(next))...)
+	if !reflect.DeepEqual(previous.CertManager, next.CertManager) {
+		changes = append(changes, "certificate_manager changed")
+	}
+	if !reflect.DeepEqual(previous.LetsEncryptUser, next.LetsEncryptUser) {
+		changes = append(changes, "lets_encrypt_user changed")
+	}
+	if !reflect.DeepEqual(previous.ACMEAccounts, next.ACMEAccounts) {
+		changes = append(changes, "acme_accounts changed")
+	}
+	if previous.CertRootPath != next.CertRootPath {
+		changes = append(changes, "certificates_root_path changed: "+previous.CertRootPath+" -> "+next.CertRootPath)
+	}
+	if previous.RestartMinutes != next.RestartMinutes || !reflect.DeepEqual(previous.Schedule, next.Schedule) {
+		changes = append(changes, "schedule changed")
+	}
+	if !reflect.DeepEqual(previous.Metrics, next.Metrics) || !reflect.DeepEqual(previous.API, next.API) {
+		changes = append(changes, "metrics or api changed, a restart is needed to apply it")
+	}
+	return changes
+}
+
+func diffNamed(kind string, previous map[string]interface{}, next map[string]interface{}) []string {
+	changes := make([]string, 0)
+	for name, nextEntry := range next {
+		previousEntry, ok := previous[name]
+		if !ok {
+			changes = append(changes, kind+" ["+name+"] added")
+		} else if !reflect.DeepEqual(previousEntry, nextEntry) {
+			changes = append(changes, kind+" ["+name+"] changed")
+		}
+	}
+	for name := range previous {
+		if _, ok := next[name]; !ok {
+			changes = append(changes, kind+" ["+name+"] removed")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func certificatesByName(config *Config) map[string]interface{} {
+	certificates := make(map[string]interface{})
+	for _, certificate := range config.Certificates {
+		certificates[certificate.Name] = certificate
+	}
+	return certificates
+}
+
+func sitesByURL(config *Config) map[string]interface{} {
+	sites := make(map[string]interface{})
+	for _, site := range config.Sites {
+		sites[site.URL] = site
+	}
+	return sites
+}
+
+func updatersByName(config *Config) map[string]interface{} {
+	updaters := make(map[string]interface{})
+	for _, updaterConfig := range config.Updaters {
+		updaters[updaterConfig.Name] = updaterConfig
+	}
+	return updaters
+}
+
+func notifiersByName(config *Config) map[string]interface{} {
+	notifiers := make(map[string]interface{})
+	for _, notifier := range config.Notifiers {
+		notifiers[notifier.Name] = notifier
+	}
+	return notifiers
+}
+
+func dnsServersByName(config *Config) map[string]interface{} {
+	dnsServers := make(map[string]interface{})
+	for _, dnsServer := range config.DNSServers {
+		dnsServers[dnsServer.Name] = dnsServer
+	}
+	return dnsServers
+}
@@ -0,0 +1,120 @@
+package viper_fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// A value starting with one of these prefixes is replaced by the content of the file,
+// or by the output of the command run with sh.
+const (
+	FileSourcePrefix    = "file:"
+	CommandSourcePrefix = "cmd:"
+)
+
+// Maximum time given to a command source to print its value.
+const CommandSourceTimeout = 10 * time.Second
+
+// "${NAME}" inside a value is replaced by the environment variable NAME.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Keys whose value is a secret, redacted from the logs even when it comes from an environment variable.
+var SecretKeys = []string{"pwd", "token", "api_key", "hmac_key", "tsig_secret"}
+
+// Resolve the environment variables, the files and the commands referenced by the value.
+// The values read from a file or a command are secrets and redacted from the logs, the environment variables
+// only under one of the SecretKeys: hostnames, ports or users stay readable.
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, FileSourcePrefix):
+		path := strings.TrimPrefix(value, FileSourcePrefix)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.New("While reading the secret file " + path + ": " + err.Error())
+		}
+		return addSecret(strings.TrimSpace(string(content))), nil
+	case strings.HasPrefix(value, CommandSourcePrefix):
+		command := strings.TrimPrefix(value, CommandSourcePrefix)
+		ctx, cancel := context.WithTimeout(context.Background(), CommandSourceTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return "", errors.New("While running the secret command " + command + ": " + err.Error())
+		}
+		return addSecret(strings.TrimSpace(string(output))), nil
+	}
+	return resolveEnv(value)
+}
+
+func resolveEnv(value string) (string, error) {
+	var err error
+	resolved := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			err = errors.New("The environment variable " + name + " is not set")
+			return reference
+		}
+		return envValue
+	})
+	return resolved, err
+}
+
+// Register as secrets the values of the SecretKeys of the settings, written in the file
+// or read from environment variables.
+func registerSecrets(settings interface{}, key string) {
+	switch value := settings.(type) {
+	case string:
+		if !isSecretKey(key) || strings.HasPrefix(value, FileSourcePrefix) || strings.HasPrefix(value, CommandSourcePrefix) {
+			return
+		}
+		if resolved, err := resolveEnv(value); err == nil {
+			addSecret(resolved)
+		}
+	case map[string]interface{}:
+		for entryKey, entry := range value {
+			registerSecrets(entry, entryKey)
+		}
+	case map[interface{}]interface{}:
+		for entryKey, entry := range value {
+			registerSecrets(entry, fmt.Sprint(entryKey))
+		}
+	case []interface{}:
+		for _, entry := range value {
+			registerSecrets(entry, key)
+		}
+	case []map[string]interface{}:
+		for _, entry := range value {
+			registerSecrets(entry, key)
+		}
+	}
+}
+
+func isSecretKey(key string) bool {
+	for _, secretKey := range SecretKeys {
+		if strings.EqualFold(key, secretKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode hook resolving every string of the configuration before it is stored in the Config.
+func interpolationHook() mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return data, nil
+		}
+		return Resolve(reflect.ValueOf(data).String())
+	}
+}
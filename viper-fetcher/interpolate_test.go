@@ -0,0 +1,106 @@
+package viper_fetcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	os.Setenv("CERTIFICATE_MANAGER_TEST_HOST", "smtp.example.com")
+	defer os.Unsetenv("CERTIFICATE_MANAGER_TEST_HOST")
+	dir := writeConfig(t, "secret", "file-secret\n")
+	defer os.RemoveAll(dir)
+	var arguments = []struct {
+		value    string
+		resolved string
+	}{
+		{"plain value", "plain value"},
+		{"https://${CERTIFICATE_MANAGER_TEST_HOST}:587", "https://smtp.example.com:587"},
+		{"file:" + filepath.Join(dir, "secret"), "file-secret"},
+		{"cmd:echo command-secret", "command-secret"},
+	}
+	for _, argument := range arguments {
+		resolved, err := Resolve(argument.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != argument.resolved {
+			t.Error(argument.value, ": expected ", argument.resolved, " got ", resolved)
+		}
+	}
+	for _, value := range []string{"${CERTIFICATE_MANAGER_TEST_UNSET}", "file:" + filepath.Join(dir, "missing"), "cmd:exit 1"} {
+		if _, err := Resolve(value); err == nil {
+			t.Error("Expected an error for ", value)
+		}
+	}
+	if redacted := Redact("sent with file-secret to smtp.example.com"); redacted != "sent with ****** to smtp.example.com" {
+		t.Error("Expected only the secrets to be redacted, got: ", redacted)
+	}
+}
+
+func TestParseConfigResolvesSecrets(t *testing.T) {
+	os.Setenv("CERTIFICATE_MANAGER_TEST_PWD", "env-password")
+	defer os.Unsetenv("CERTIFICATE_MANAGER_TEST_PWD")
+	dir := writeConfig(t, "config.yaml", `
+notifiers:
+  - name: gmail-example
+    type: mail
+    source:
+      from: example@example.com
+      pwd: '${CERTIFICATE_MANAGER_TEST_PWD}'
+`)
+	defer os.RemoveAll(dir)
+	config, err := ParseConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Notifiers[0].Source.Pwd != "env-password" {
+		t.Error("Password not resolved: ", config.Notifiers[0].Source.Pwd)
+	}
+	dump, err := DumpConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump, "env-password") || !strings.Contains(dump, RedactedValue) {
+		t.Error("The dump shows the secret: ", dump)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte("api:\n  token: '${CERTIFICATE_MANAGER_TEST_UNSET}'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(dir); err == nil {
+		t.Error("Expected an error for an unset variable")
+	}
+}
+
+func TestDumpRedactsLiteralSecrets(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+notifiers:
+  - name: gmail-example
+    type: mail
+    source:
+      from: example@example.com
+      pwd: literal-password
+api:
+  listen: 127.0.0.1:8080
+  token: pw
+`)
+	defer os.RemoveAll(dir)
+	dump, err := DumpConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even a secret shorter than MinSecretLength is hidden under its key.
+	if strings.Contains(dump, "literal-password") || strings.Contains(dump, `"pw"`) ||
+		strings.Count(dump, RedactedValue) != 2 {
+		t.Error("The dump shows a secret: ", dump)
+	}
+	if !strings.Contains(dump, "example@example.com") || !strings.Contains(dump, "127.0.0.1:8080") {
+		t.Error("Expected the other values untouched, got: ", dump)
+	}
+	if redacted := Redact("login with literal-password"); redacted != "login with "+RedactedValue {
+		t.Error("Expected the literal secret redacted from the logs, got: ", redacted)
+	}
+}
@@ -0,0 +1,146 @@
+package viper_fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Text written in place of a secret.
+const RedactedValue = "******"
+
+// Shorter secrets are not redacted, they would hide too much of the logs.
+const MinSecretLength = 4
+
+var secrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: make(map[string]bool)}
+
+func addSecret(value string) string {
+	if len(value) >= MinSecretLength {
+		secrets.Lock()
+		secrets.values[value] = true
+		secrets.Unlock()
+	}
+	return value
+}
+
+// Replace every secret resolved from the configuration found in the text.
+func Redact(text string) string {
+	secrets.RLock()
+	values := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		values = append(values, value)
+	}
+	secrets.RUnlock()
+	// The longest first, a secret can contain another one.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		text = strings.ReplaceAll(text, value, RedactedValue)
+	}
+	return text
+}
+
+// Logrus hook removing the secrets from the messages and the fields before they are written.
+type RedactionHook struct{}
+
+func (RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (RedactionHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		switch field := value.(type) {
+		case string:
+			entry.Data[key] = Redact(field)
+		case error:
+			entry.Data[key] = Redact(field.Error())
+		}
+	}
+	return nil
+}
+
+// Return the configuration as indented JSON, with the references resolved and the secrets redacted.
+func DumpConfig(configFilePath string) (string, error) {
+	if err := readConfig(configFilePath); err != nil {
+		return "", err
+	}
+	settings := viper.AllSettings()
+	if err := mergeConfDSettings(configFilePath, settings); err != nil {
+		return "", err
+	}
+	resolved, err := resolveSettings(settings)
+	if err != nil {
+		return "", err
+	}
+	dump, err := json.MarshalIndent(resolved, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return Redact(string(dump)), nil
+}
+
+// Resolve the strings of the settings, and convert the maps so they can be written as JSON.
+// The value of one of the SecretKeys is redacted, even when it is written in the configuration file.
+func resolveSettings(settings interface{}) (interface{}, error) {
+	switch value := settings.(type) {
+	case string:
+		return Resolve(value)
+	case map[string]interface{}:
+		resolved := make(map[string]interface{})
+		for key, entry := range value {
+			resolvedEntry, err := resolveEntry(key, entry)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = resolvedEntry
+		}
+		return resolved, nil
+	case map[interface{}]interface{}:
+		resolved := make(map[string]interface{})
+		for key, entry := range value {
+			resolvedEntry, err := resolveEntry(fmt.Sprint(key), entry)
+			if err != nil {
+				return nil, err
+			}
+			resolved[fmt.Sprint(key)] = resolvedEntry
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, 0, len(value))
+		for _, entry := range value {
+			resolvedEntry, err := resolveSettings(entry)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, resolvedEntry)
+		}
+		return resolved, nil
+	case []map[string]interface{}:
+		resolved := make([]interface{}, 0, len(value))
+		for _, entry := range value {
+			resolvedEntry, err := resolveSettings(entry)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, resolvedEntry)
+		}
+		return resolved, nil
+	}
+	return settings, nil
+}
+
+func resolveEntry(key string, entry interface{}) (interface{}, error) {
+	resolved, err := resolveSettings(entry)
+	if _, ok := resolved.(string); ok && err == nil && isSecretKey(key) {
+		return RedactedValue, nil
+	}
+	return resolved, err
+}
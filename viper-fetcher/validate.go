@@ -0,0 +1,561 @@
+package viper_fetcher
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
+	"github.com/DumesnyJeremy/notification-service"
+
+	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/acme"
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/rfc2136"
+	"github.com/DumesnyJeremy/certificate-manager/manager/schedule"
+	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
+)
+
+// Check the values and the references between the sections of the configuration.
+// Every error starts with the key where the problem is.
+// A configuration with errors must not replace a running one.
+func (config *Config) Validate() []error {
+	errs := make([]error, 0)
+	if config.CertRootPath == "" {
+		errs = append(errs, errors.New(config.mainLocation("certificates_root_path")+": missing path"))
+	}
+	// The lets_encrypt_user account is optional once acme_accounts are configured.
+	if config.LetsEncryptUser.Mail == "" && (len(config.ACMEAccounts) == 0 || config.LetsEncryptUser.AccountDir != "") {
+		errs = append(errs, errors.New(config.mainLocation("lets_encrypt_user.mail")+": missing"))
+	}
+	if config.LetsEncryptUser.AccountDir == "" && (len(config.ACMEAccounts) == 0 || config.LetsEncryptUser.Mail != "") {
+		errs = append(errs, errors.New(config.mainLocation("lets_encrypt_user.account_path")+": missing path"))
+	}
+	if config.Schedule.Cron != "" {
+		if _, err := schedule.Parse(config.Schedule.Cron); err != nil {
+			errs = append(errs, errors.New(config.mainLocation("schedule.cron")+": "+err.Error()))
+		}
+	}
+	for i, network := range config.Discovery.Networks {
+		if _, _, err := net.ParseCIDR(network); err != nil && net.ParseIP(network) == nil {
+			errs = append(errs, errors.New(config.mainLocation("discovery.networks["+strconv.Itoa(i)+"]")+": invalid network "+network))
+		}
+	}
+	for i, port := range config.Discovery.Ports {
+		if port <= 0 || port > 65535 {
+			errs = append(errs, errors.New(config.mainLocation("discovery.ports["+strconv.Itoa(i)+"]")+": invalid port "+strconv.Itoa(port)))
+		}
+	}
+	errs = append(errs, validateRenewal(config.mainLocation("certificate_manager.renewal"), config.CertManager.Renewal)...)
+	if directoryURL := config.CertManager.ARI.DirectoryURL; directoryURL != "" &&
+		!strings.HasPrefix(directoryURL, "https://") && !strings.HasPrefix(directoryURL, "http://") {
+		errs = append(errs, errors.New(config.mainLocation("certificate_manager.ari.directory_url")+": invalid URL "+directoryURL))
+	}
+	errs = append(errs, config.validateACMEAccounts()...)
+	errs = append(errs, config.validateUpdaters()...)
+	errs = append(errs, config.validateCertificates()...)
+	errs = append(errs, config.validateSites()...)
+	errs = append(errs, config.validateNotifiers()...)
+	errs = append(errs, config.validateDNSServers()...)
+	return errs
+}
+
+func (config *Config) validateACMEAccounts() []error {
+	errs := make([]error, 0)
+	names := make(map[string]string)
+	for i, account := range config.ACMEAccounts {
+		key := config.mainLocation("acme_accounts[" + strconv.Itoa(i) + "]")
+		if account.Name == "" {
+			errs = append(errs, errors.New(key+".name: missing"))
+		} else if account.Name == manager.DefaultCA {
+			errs = append(errs, errors.New(key+".name: ["+manager.DefaultCA+"] is the name of the lets_encrypt_user account"))
+		} else if first, ok := names[account.Name]; ok {
+			errs = append(errs, errors.New(key+".name: duplicate name ["+account.Name+"], already defined in "+first))
+		} else {
+			names[account.Name] = key
+		}
+		if account.DirectoryURL == "" {
+			errs = append(errs, errors.New(key+".directory_url: missing"))
+		} else if directoryURL := account.Directory(); !strings.HasPrefix(directoryURL, "https://") && !strings.HasPrefix(directoryURL, "http://") {
+			errs = append(errs, errors.New(key+".directory_url: invalid URL "+directoryURL+", or one of "+
+				strings.Join(acmeDirectoryNames(), ", ")))
+		}
+		if account.Mail == "" {
+			errs = append(errs, errors.New(key+".mail: missing"))
+		}
+		if account.AccountPath == "" {
+			errs = append(errs, errors.New(key+".account_path: missing path"))
+		}
+		if account.RateLimit < 0 {
+			errs = append(errs, errors.New(key+".rate_limit: must not be negative"))
+		}
+		errs = append(errs, validateEAB(key+".eab", account)...)
+		if account.Staging == account.Name && account.Staging != "" {
+			errs = append(errs, errors.New(key+".staging: an account can't be its own staging"))
+		} else if account.Staging != "" && !config.hasACMEAccount(account.Staging) {
+			errs = append(errs, errors.New(key+".staging: unknown account ["+account.Staging+"]"))
+		}
+	}
+	return errs
+}
+
+// The key identifier and the HMAC key of a binding go together, some CAs require them.
+func validateEAB(key string, account acme.AccountConfig) []error {
+	errs := make([]error, 0)
+	if !account.HasEAB() {
+		if account.RequiresEAB() {
+			errs = append(errs, errors.New(key+": the directory ["+account.DirectoryURL+"] requires key_id and hmac_key"))
+		}
+		return errs
+	}
+	if account.EAB.KeyID == "" {
+		errs = append(errs, errors.New(key+".key_id: missing"))
+	}
+	if account.EAB.HMACKey == "" {
+		errs = append(errs, errors.New(key+".hmac_key: missing"))
+	} else if _, err := base64.RawURLEncoding.DecodeString(account.EAB.HMACKey); err != nil {
+		errs = append(errs, errors.New(key+".hmac_key: must be base64url encoded, without padding"))
+	}
+	return errs
+}
+
+// Check the CA chosen by a certificate or a site is configured,
+// and that a certificate validated on staging first has a staging directory.
+func (config *Config) validateCA(key string, ca string, stagingFirst bool) []error {
+	errs := make([]error, 0)
+	if ca != "" && !config.hasACMEAccount(ca) && (ca != manager.DefaultCA || config.LetsEncryptUser.Mail == "") {
+		errs = append(errs, errors.New(key+".ca: unknown CA ["+ca+"]"))
+	}
+	if !stagingFirst {
+		return errs
+	}
+	if ca == "" {
+		ca = config.defaultCA()
+	}
+	for _, account := range config.ACMEAccounts {
+		if account.Name == ca && account.Staging != "" {
+			return errs
+		}
+	}
+	return append(errs, errors.New(key+".staging_first: the CA ["+ca+"] has no staging account"))
+}
+
+// Return the CA of the certificates without ca: the lets_encrypt_user account when it is configured or alone,
+// the first account of acme_accounts that isn't the staging of another one otherwise.
+func (config *Config) defaultCA() string {
+	if config.LetsEncryptUser.Mail != "" || len(config.ACMEAccounts) == 0 {
+		return manager.DefaultCA
+	}
+	for _, account := range config.ACMEAccounts {
+		if !config.isStagingAccount(account.Name) {
+			return account.Name
+		}
+	}
+	return ""
+}
+
+func (config *Config) isStagingAccount(name string) bool {
+	for _, account := range config.ACMEAccounts {
+		if account.Staging == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *Config) hasACMEAccount(name string) bool {
+	for _, account := range config.ACMEAccounts {
+		if account.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func acmeDirectoryNames() []string {
+	names := make([]string, 0, len(acme.Directories))
+	for name := range acme.Directories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (config *Config) validateUpdaters() []error {
+	errs := make([]error, 0)
+	names := make(map[string]string)
+	for i, updaterConfig := range config.Updaters {
+		key := config.location("updaters", config.Sources.Updaters, i)
+		if updaterConfig.Name == "" {
+			errs = append(errs, errors.New(key+".name: missing"))
+		} else if first, ok := names[updaterConfig.Name]; ok {
+			errs = append(errs, errors.New(key+".name: duplicate name ["+updaterConfig.Name+"], already defined in "+first))
+		} else {
+			names[updaterConfig.Name] = key
+		}
+		switch updaterConfig.Type {
+		case updater.LocalAccessType:
+		case updater.RemoteAccessType:
+			if updaterConfig.RemoteConnection.Hostname == "" {
+				errs = append(errs, errors.New(key+".remote_connection.hostname: missing"))
+			}
+			if updaterConfig.RemoteConnection.Port <= 0 || updaterConfig.RemoteConnection.Port > 65535 {
+				errs = append(errs, errors.New(key+".remote_connection.port: invalid port "+
+					strconv.Itoa(updaterConfig.RemoteConnection.Port)))
+			}
+		default:
+			errs = append(errs, errors.New(key+".type: unknown type ["+updaterConfig.Type+"], expected "+
+				updater.LocalAccessType+" or "+updater.RemoteAccessType))
+		}
+		for j, window := range updaterConfig.Windows {
+			if _, err := schedule.Parse(window); err != nil {
+				errs = append(errs, errors.New(key+".windows["+strconv.Itoa(j)+"]: "+err.Error()))
+			}
+		}
+	}
+	return errs
+}
+
+func (config *Config) validateCertificates() []error {
+	errs := make([]error, 0)
+	names := make(map[string]string)
+	for i, certificate := range config.Certificates {
+		key := config.location("certificates", config.Sources.Certificates, i)
+		if certificate.Name == "" {
+			errs = append(errs, errors.New(key+".name: missing"))
+		} else if strings.ContainsAny(certificate.Name, "/\\") {
+			errs = append(errs, errors.New(key+".name: ["+certificate.Name+"] must not contain a path separator"))
+		} else if first, ok := names[certificate.Name]; ok {
+			errs = append(errs, errors.New(key+".name: duplicate name ["+certificate.Name+"], already defined in "+first))
+		} else {
+			names[certificate.Name] = key
+		}
+		if len(certificate.Names) == 0 {
+			errs = append(errs, errors.New(key+".names: missing"))
+		}
+		for _, name := range certificate.Names {
+			if !isValidName(name) {
+				errs = append(errs, errors.New(key+".names: invalid name ["+name+"]"))
+			}
+		}
+		if _, ok := certificates.KeyTypes[certificate.KeyType]; certificate.KeyType != "" && !ok {
+			errs = append(errs, errors.New(key+".key_type: unknown key type ["+certificate.KeyType+"], expected one of "+
+				strings.Join(certificates.KeyTypeNames(), ", ")))
+		}
+		errs = append(errs, validateKey(key, certificate)...)
+		for j, target := range certificate.Deploy {
+			errs = append(errs, config.validateTarget(key+".deploy["+strconv.Itoa(j)+"]", target, certificate.CSR == "")...)
+		}
+		errs = append(errs, config.validateCA(key, certificate.CA, certificate.StagingFirst)...)
+		// The renewal of a certificate is decided with the sites probing it,
+		// and the certificate of a site is named after its url.
+		probed := false
+		for _, site := range config.Sites {
+			if site.Certificate == certificate.Name {
+				probed = true
+			} else if site.Certificate == "" && site.IsManaged() && site.URL == certificate.Name {
+				errs = append(errs, errors.New(key+".name: ["+certificate.Name+"] is the url of a site with its own certificate"))
+			}
+		}
+		if certificate.Name != "" && !probed {
+			errs = append(errs, errors.New(key+": no site probes the certificate ["+certificate.Name+"]"))
+		}
+	}
+	return errs
+}
+
+func (config *Config) validateSites() []error {
+	errs := make([]error, 0)
+	urls := make(map[string]string)
+	names := make(map[string]string)
+	// The names of a shared certificate are ordered with it, not with a site.
+	for i, certificate := range config.Certificates {
+		for _, name := range certificate.Names {
+			if _, ok := names[strings.ToLower(name)]; !ok {
+				names[strings.ToLower(name)] = config.location("certificates", config.Sources.Certificates, i)
+			}
+		}
+	}
+	for i, site := range config.Sites {
+		key := config.location("sites", config.Sources.Sites, i)
+		if site.URL == "" {
+			errs = append(errs, errors.New(key+".url: missing, set url or names"))
+		} else if first, ok := urls[site.URL]; ok {
+			errs = append(errs, errors.New(key+".url: duplicate site ["+site.URL+"], already defined in "+first))
+			continue
+		} else {
+			urls[site.URL] = key
+		}
+		if site.Mode != "" && site.Mode != fetcher.ModeRenew && site.Mode != fetcher.ModeMonitor {
+			errs = append(errs, errors.New(key+".mode: unknown mode ["+site.Mode+"], expected "+
+				fetcher.ModeRenew+" or "+fetcher.ModeMonitor))
+		}
+		if site.Mode == fetcher.ModeMonitor && site.Certificate != "" {
+			errs = append(errs, errors.New(key+".certificate: a site only monitored has no certificate issued"))
+		}
+		if site.Mode == fetcher.ModeMonitor && site.Server != "" {
+			errs = append(errs, errors.New(key+".server: a site only monitored has no deployment"))
+		}
+		if (site.CA != "" || site.StagingFirst) && site.Mode == fetcher.ModeMonitor {
+			errs = append(errs, errors.New(key+": a site only monitored has no certificate issued, ca and staging_first are not used"))
+		} else if (site.CA != "" || site.StagingFirst) && site.Certificate != "" {
+			errs = append(errs, errors.New(key+": ca and staging_first of a shared certificate are set on the certificate ["+site.Certificate+"]"))
+		} else {
+			errs = append(errs, config.validateCA(key, site.CA, site.StagingFirst)...)
+		}
+		if site.Certificate != "" {
+			errs = append(errs, config.validateSharedSite(key, site)...)
+		} else if site.Primary != "" && !strings.EqualFold(site.Primary, site.URL) {
+			errs = append(errs, errors.New(key+".primary: ["+site.Primary+"] differs from the url ["+site.URL+"]"))
+		}
+		if site.Primary != "" && len(site.Names) > 0 && !containsName(site.Names, site.Primary) {
+			errs = append(errs, errors.New(key+".primary: ["+site.Primary+"] is not one of the names"))
+		}
+		// A name in two sites would be ordered twice.
+		for _, name := range site.GetNames() {
+			if site.Certificate != "" {
+				break
+			}
+			if !isValidName(name) {
+				errs = append(errs, errors.New(key+".names: invalid name ["+name+"]"))
+			} else if first, ok := names[strings.ToLower(name)]; ok && first != key {
+				errs = append(errs, errors.New(key+".names: ["+name+"] is already a name of "+first))
+			} else {
+				names[strings.ToLower(name)] = key
+			}
+		}
+		errs = append(errs, validateRenewal(key+".renewal", site.Renewal)...)
+		if site.Port < 0 || site.Port > 65535 {
+			errs = append(errs, errors.New(key+".port: invalid port "+strconv.Itoa(site.Port)))
+		}
+		if site.Server == "" {
+			continue
+		}
+		errs = append(errs, config.validateTarget(key, certificates.Target{Server: site.Server, Location: site.Location}, true)...)
+	}
+	return errs
+}
+
+// The dual key type must differ from the key type, and a CSR, whose key stays with its owner,
+// must be readable and cover the names.
+func validateKey(key string, certificate certificates.Config) []error {
+	errs := make([]error, 0)
+	if certificate.DualKeyType != "" {
+		keyType := certificate.KeyType
+		if keyType == "" {
+			keyType = certificates.DefaultKeyType
+		}
+		if _, ok := certificates.KeyTypes[certificate.DualKeyType]; !ok {
+			errs = append(errs, errors.New(key+".dual_key_type: unknown key type ["+certificate.DualKeyType+"], expected one of "+
+				strings.Join(certificates.KeyTypeNames(), ", ")))
+		} else if certificate.DualKeyType == keyType {
+			errs = append(errs, errors.New(key+".dual_key_type: ["+certificate.DualKeyType+"] is already the key type of the certificate"))
+		}
+	}
+	if certificate.CSR == "" {
+		return errs
+	}
+	if certificate.KeyType != "" || certificate.DualKeyType != "" || certificate.KeyReuse {
+		errs = append(errs, errors.New(key+".csr: the key of a CSR is chosen by its owner, key_type, dual_key_type and key_reuse are not used"))
+	}
+	csr, err := certificates.ReadCSR(certificate.CSR)
+	if err != nil {
+		return append(errs, errors.New(key+".csr: "+err.Error()))
+	}
+	csrNames := append([]string{csr.Subject.CommonName}, csr.DNSNames...)
+	for _, name := range certificate.Names {
+		if !containsName(csrNames, name) {
+			errs = append(errs, errors.New(key+".csr: ["+name+"] isn't a name of the CSR "+certificate.CSR))
+		}
+	}
+	return errs
+}
+
+// The updater of a deployment target must exist, and it writes the certificate and the key at the paths given.
+// Without key, for a certificate ordered with a CSR, the private_key path isn't needed.
+func (config *Config) validateTarget(key string, target certificates.Target, withKey bool) []error {
+	errs := make([]error, 0)
+	var updaterConfig *updater.CertificateUpdateConfig
+	for i := range config.Updaters {
+		if config.Updaters[i].Name == target.Server {
+			updaterConfig = &config.Updaters[i]
+			break
+		}
+	}
+	if updaterConfig == nil {
+		return append(errs, errors.New(key+".server: unknown updater ["+target.Server+"]"))
+	}
+	paths := map[string]string{
+		"certificate": target.Location.Certificate,
+		"private_key": target.Location.PrivateKey,
+	}
+	for _, name := range []string{"certificate", "private_key"} {
+		if name == "private_key" && !withKey && paths[name] == "" {
+			continue
+		}
+		if paths[name] == "" {
+			errs = append(errs, errors.New(key+".location."+name+": missing path"))
+		} else if updaterConfig.Type == updater.LocalAccessType {
+			if _, err := os.Stat(filepath.Dir(paths[name])); err != nil {
+				errs = append(errs, errors.New(key+".location."+name+": the directory of "+paths[name]+" doesn't exist"))
+			}
+		}
+	}
+	return errs
+}
+
+// A site of a shared certificate takes its names from it, and must be covered by them.
+func (config *Config) validateSharedSite(key string, site fetcher.CertificateFetchConfig) []error {
+	errs := make([]error, 0)
+	if site.Shared == nil {
+		return append(errs, errors.New(key+".certificate: unknown certificate ["+site.Certificate+"]"))
+	}
+	if len(site.Names) > 0 || site.Primary != "" {
+		errs = append(errs, errors.New(key+".names: the names are the ones of the certificate ["+site.Certificate+"]"))
+	}
+	if site.URL != "" && !isValidName(site.URL) {
+		errs = append(errs, errors.New(key+".url: invalid name ["+site.URL+"]"))
+	} else if site.URL != "" && !coversName(site.Shared.Names, site.URL) {
+		errs = append(errs, errors.New(key+".url: ["+site.URL+"] isn't covered by the certificate ["+site.Certificate+"]"))
+	}
+	return errs
+}
+
+func (config *Config) validateNotifiers() []error {
+	errs := make([]error, 0)
+	names := make(map[string]string)
+	for i, notifier := range config.Notifiers {
+		key := config.location("notifiers", config.Sources.Notifiers, i)
+		name := strings.ToLower(notifier.Name)
+		if notifier.Name == "" {
+			errs = append(errs, errors.New(key+".name: missing"))
+		} else if first, ok := names[name]; ok {
+			errs = append(errs, errors.New(key+".name: duplicate name ["+notifier.Name+"], already defined in "+first))
+		} else {
+			names[name] = key
+		}
+		if notifier.Type != notification_service.NotifierTypeMail && notifier.Type != notification_service.NotifierTypeRocket {
+			errs = append(errs, errors.New(key+".type: unknown type ["+notifier.Type+"], expected "+
+				notification_service.NotifierTypeMail+" or "+notification_service.NotifierTypeRocket))
+		}
+	}
+	for i, recipient := range config.CertManager.Recipients {
+		key := config.mainLocation("certificate_manager.recipients[" + strconv.Itoa(i) + "]")
+		if _, ok := names[strings.ToLower(recipient.Notifier)]; !ok {
+			errs = append(errs, errors.New(key+".notifier: unknown notifier ["+recipient.Notifier+"]"))
+		}
+		for j, category := range recipient.Categories {
+			if !isValidCategory(category) {
+				errs = append(errs, errors.New(key+".categories["+strconv.Itoa(j)+"]: unknown category ["+category+"], expected one of "+
+					strings.Join(manager.Categories, ", ")))
+			}
+		}
+		if len(recipient.Dest) == 0 {
+			errs = append(errs, errors.New(key+".dest: missing"))
+		}
+	}
+	if config.CertManager.Notification.Retries < 0 {
+		errs = append(errs, errors.New(config.mainLocation("certificate_manager.notification.retries")+": must not be negative"))
+	}
+	return errs
+}
+
+func (config *Config) validateDNSServers() []error {
+	errs := make([]error, 0)
+	names := make(map[string]string)
+	for i, dnsServer := range config.DNSServers {
+		key := config.location("dns_servers", config.Sources.DNSServers, i)
+		if dnsServer.Name == "" {
+			errs = append(errs, errors.New(key+".name: missing"))
+		} else if first, ok := names[dnsServer.Name]; ok {
+			errs = append(errs, errors.New(key+".name: duplicate name ["+dnsServer.Name+"], already defined in "+first))
+		} else {
+			names[dnsServer.Name] = key
+		}
+		switch dnsServer.Type {
+		case dns.ServerDNSTypeGandy, dns.ServerDNSTypePDNS:
+		case rfc2136.ServerDNSTypeRFC2136:
+			for _, err := range dnsServer.Config.Validate() {
+				errs = append(errs, errors.New(key+"."+err.Error()))
+			}
+		default:
+			errs = append(errs, errors.New(key+".type: unknown type ["+dnsServer.Type+"], expected "+
+				dns.ServerDNSTypeGandy+", "+dns.ServerDNSTypePDNS+" or "+rfc2136.ServerDNSTypeRFC2136))
+		}
+	}
+	return errs
+}
+
+func validateRenewal(key string, policy certificates.RenewalPolicy) []error {
+	errs := make([]error, 0)
+	if policy.RenewAt < 0 || policy.RenewAt >= 1 {
+		errs = append(errs, errors.New(key+".renew_at: must be a part of the lifetime, between 0 and 1"))
+	}
+	if policy.DaysBefore < 0 {
+		errs = append(errs, errors.New(key+".days_before: must not be negative"))
+	}
+	return errs
+}
+
+func isValidCategory(category string) bool {
+	for _, validCategory := range manager.Categories {
+		if category == validCategory {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// True if one of the names, maybe a wildcard, matches the host.
+func coversName(names []string, host string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			labels := strings.SplitN(host, ".", 2)
+			if len(labels) == 2 && labels[0] != "*" && strings.EqualFold(name[2:], labels[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A name of a certificate: labels of letters, digits and hyphens, the first one can be a wildcard.
+// The names are case insensitive, an uppercase letter is valid.
+func isValidName(name string) bool {
+	labels := strings.Split(strings.ToLower(name), ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
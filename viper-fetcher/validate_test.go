@@ -0,0 +1,429 @@
+package viper_fetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "certificate-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir + "/"
+}
+
+// A file reference of a sample, e.g. file:/run/secrets/zerossl_hmac_key or file:/etc/bind/acme-update.secret.
+var sampleSecret = regexp.MustCompile(FileSourcePrefix + `(/[A-Za-z0-9_./-]+)`)
+
+func TestSamplesAreValid(t *testing.T) {
+	for _, fileType := range []string{"yaml", "toml", "json"} {
+		sample, err := ioutil.ReadFile("../configuration-files/config." + fileType + ".sample")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The secrets referenced by the sample are read from the configuration directory instead.
+		secrets, err := ioutil.TempDir("", "certificate-manager")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(secrets)
+		for _, reference := range sampleSecret.FindAllStringSubmatch(string(sample), -1) {
+			path := filepath.Join(secrets, filepath.Base(reference[1]))
+			if err := ioutil.WriteFile(path, []byte("c2VjcmV0"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			sample = []byte(strings.Replace(string(sample), reference[0], FileSourcePrefix+path, 1))
+		}
+		dir := writeConfig(t, "config."+fileType, string(sample))
+		defer os.RemoveAll(dir)
+		if _, errs := ValidateConfig(dir); len(errs) > 0 {
+			t.Error(fileType, " sample: ", errs)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+unknown_key: true
+lets_encrypt_user:
+  mail: example@example.com
+  account_path: /tmp
+certificate_manager:
+  recipients:
+    - notifier: missing-notifier
+      categories: [RENEW, OTHER]
+      dest: ['@user']
+sites:
+  - url: www.example.com
+    server: missing-updater
+  - url: status.example.com
+    mode: watch
+    renewal:
+      renew_at: 1.5
+  - url: vendor.example.com
+    mode: monitor
+    server: Serv 1
+updaters:
+  - name: Serv 1
+    type: remote
+    remote_connection:
+      hostname: 0.0.0.0
+      port: '22'
+  - name: Serv 1
+    type: local
+    restart_cmd: systemctl reload nginx
+`)
+	defer os.RemoveAll(dir)
+	_, errs := ValidateConfig(dir)
+	expected := []string{
+		"has invalid keys: unknown_key",
+		"'updaters[0].remote_connection.port' expected type 'int'",
+		"'updaters[1]' has invalid keys: restart_cmd",
+		"updaters[1].name: duplicate name [Serv 1]",
+		"sites[0].server: unknown updater [missing-updater]",
+		"sites[1].mode: unknown mode [watch]",
+		"sites[1].renewal.renew_at: must be a part of the lifetime",
+		"sites[2].server: a site only monitored has no deployment",
+		"certificate_manager.recipients[0].notifier: unknown notifier [missing-notifier]",
+		"certificate_manager.recipients[0].categories[1]: unknown category [OTHER]",
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		if !strings.HasPrefix(err.Error(), filepath.Join(dir, "config.yaml")+": ") {
+			t.Error("The error doesn't give the file: ", err)
+		}
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+}
+
+func TestSharedCertificates(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+lets_encrypt_user:
+  mail: example@example.com
+  account_path: /tmp
+certificates:
+  - name: wildcard
+    names: ['*.example.com', example.com]
+    key_type: ec256
+  - name: other
+    names: [example.org]
+    key_type: dsa
+    deploy:
+      - server: missing-updater
+        location:
+          certificate: /etc/ssl/example.org.crt
+          private_key: /etc/ssl/example.org.key
+sites:
+  - url: shop.example.com
+    certificate: wildcard
+  - url: blog.example.com
+    certificate: wildcard
+  - url: www.example.net
+    certificate: wildcard
+  - url: www.example.org
+    certificate: missing
+`)
+	defer os.RemoveAll(dir)
+	config, errs := ValidateConfig(dir)
+	expected := []string{
+		"certificates[1].key_type: unknown key type [dsa]",
+		"certificates[1].deploy[0].server: unknown updater [missing-updater]",
+		"certificates[1]: no site probes the certificate [other]",
+		"sites[2].url: [www.example.net] isn't covered by the certificate [wildcard]",
+		"sites[3].certificate: unknown certificate [missing]",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Expected ", len(expected), " errors got ", errs)
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+	if config.Sites[1].Shared == nil || config.Sites[1].Shared.Name != "wildcard" {
+		t.Error("Expected the site to be linked to its certificate, got ", config.Sites[1].Shared)
+	}
+}
+
+func TestUppercaseNames(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+lets_encrypt_user:
+  mail: example@example.com
+  account_path: /tmp
+certificates:
+  - name: wildcard
+    names: ['*.Example.com', Example.COM]
+sites:
+  - url: Shop.Example.com
+    certificate: wildcard
+  - url: WWW.example.org
+    names: [www.Example.org, example.org]
+  - url: Example.org
+`)
+	defer os.RemoveAll(dir)
+	_, errs := ValidateConfig(dir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "sites[2].names: [example.org] is already a name of ") {
+		t.Error("Expected only the name of two sites to be rejected, got ", errs)
+	}
+}
+
+func TestACMEAccounts(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+acme_accounts:
+  - name: letsencrypt
+    directory_url: letsencrypt
+    mail: example@example.com
+    account_path: /tmp/letsencrypt
+    staging: letsencrypt-staging
+  - name: step-ca
+    directory_url: https://ca.internal:9000/acme/acme/directory
+    mail: example@example.com
+    account_path: /tmp/step-ca
+    no_fallback: true
+  - name: step-ca
+    directory_url: step
+    account_path: /tmp/other
+  - name: zerossl
+    directory_url: zerossl
+    mail: example@example.com
+    account_path: /tmp/zerossl
+  - name: google
+    directory_url: google
+    mail: example@example.com
+    account_path: /tmp/google
+    eab:
+      key_id: kid-1
+      hmac_key: not base64url!
+updaters:
+  - name: Serv 1
+    type: local
+sites:
+  - url: www.example.com
+    server: Serv 1
+    ca: step-ca
+    staging_first: true
+    location:
+      certificate: /etc/ssl/www.example.com.crt
+      private_key: /etc/ssl/www.example.com.key
+  - url: intranet.example.com
+    ca: default
+  - url: mail.example.com
+    mode: monitor
+    ca: letsencrypt
+`)
+	defer os.RemoveAll(dir)
+	config, errs := ValidateConfig(dir)
+	expected := []string{
+		"acme_accounts[2].name: duplicate name [step-ca]",
+		"acme_accounts[2].directory_url: invalid URL step",
+		"acme_accounts[0].staging: unknown account [letsencrypt-staging]",
+		"acme_accounts[2].mail: missing",
+		"acme_accounts[3].eab: the directory [zerossl] requires key_id and hmac_key",
+		"acme_accounts[4].eab.hmac_key: must be base64url encoded",
+		"sites[0].staging_first: the CA [step-ca] has no staging account",
+		"sites[1].ca: unknown CA [default]",
+		"sites[2]: a site only monitored has no certificate issued",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Expected ", len(expected), " errors got ", errs)
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+	if certificate, _ := config.Sites[0].GetCertificateConfig(); certificate.CA != "step-ca" {
+		t.Error("Expected ", "step-ca", " got ", certificate.CA)
+	}
+}
+
+func TestKeyPolicies(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"www.example.com", "example.com"},
+	}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeConfig(t, "www.example.com.csr", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"config.yaml", []byte(`
+certificates_root_path: /tmp
+lets_encrypt_user:
+  mail: example@example.com
+  account_path: /tmp
+updaters:
+  - name: Serv 1
+    type: local
+certificates:
+  - name: dual
+    names: [shop.example.com]
+    dual_key_type: rsa2048
+  - name: own-csr
+    names: [www.example.com, example.com]
+    csr: `+dir+`www.example.com.csr
+    deploy:
+      - server: Serv 1
+        location:
+          certificate: /tmp/www.example.com.crt
+  - name: other-csr
+    names: [blog.example.com]
+    csr: `+dir+`www.example.com.csr
+    key_reuse: true
+  - name: rsa3072
+    names: [mail.example.com]
+    key_type: rsa3072
+    dual_key_type: ec384
+sites:
+  - url: shop.example.com
+    certificate: dual
+  - url: www.example.com
+    certificate: own-csr
+  - url: blog.example.com
+    certificate: other-csr
+  - url: mail.example.com
+    certificate: rsa3072
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, errs := ValidateConfig(dir)
+	expected := []string{
+		"certificates[0].dual_key_type: [rsa2048] is already the key type of the certificate",
+		"certificates[2].csr: the key of a CSR is chosen by its owner",
+		"certificates[2].csr: [blog.example.com] isn't a name of the CSR",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Expected ", len(expected), " errors got ", errs)
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+}
+
+func TestDNSServers(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+lets_encrypt_user:
+  mail: example@example.com
+  account_path: /tmp
+dns_servers:
+  - name: bind
+    type: rfc2136
+    nameserver: ns1.example.com
+    tsig_key: acme-update
+    tsig_algorithm: hmac-sha512
+    tsig_secret: c2VjcmV0IHNoYXJlZCB3aXRoIHRoZSBuYW1lc2VydmVy
+  - name: knot
+    type: rfc2136
+    tsig_key: acme-update
+    tsig_algorithm: hmac-sha3
+  - name: route53
+    type: route53
+`)
+	defer os.RemoveAll(dir)
+	config, errs := ValidateConfig(dir)
+	expected := []string{
+		"dns_servers[1].nameserver: missing",
+		"dns_servers[1].tsig_key: tsig_key and tsig_secret go together",
+		"dns_servers[1].tsig_algorithm: Unknown TSIG algorithm [hmac-sha3]",
+		"dns_servers[2].type: unknown type [route53]",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Expected ", len(expected), " errors got ", errs)
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+	if config.DNSServers[0].Name != "bind" || config.DNSServers[0].Nameserver != "ns1.example.com" {
+		t.Error("Expected ", "bind ns1.example.com", " got ", config.DNSServers[0].Name, " ", config.DNSServers[0].Nameserver)
+	}
+}
+
+func TestUnreadableSecrets(t *testing.T) {
+	dir := writeConfig(t, "config.yaml", `
+certificates_root_path: /tmp
+lets_encrypt_user:
+  mail: ${CERTIFICATE_MANAGER_UNSET_MAIL}
+  account_path: /tmp
+acme_accounts:
+  - name: zerossl
+    directory_url: https://acme.zerossl.com/v2/DV90
+    mail: example@example.com
+    account_path: /tmp
+    eab:
+      key_id: abc
+      hmac_key: file:/nonexistent/zerossl_hmac_key
+dns_servers:
+  - name: bind
+    type: rfc2136
+    nameserver: ns1.example.com
+    tsig_key: acme-update
+    tsig_algorithm: hmac-sha512
+    tsig_secret: file:/nonexistent/acme-update.secret
+`)
+	defer os.RemoveAll(dir)
+	_, errs := ValidateConfig(dir)
+	// Only the failed references are reported, not the checks of the fields left empty.
+	expected := []string{
+		"error decoding 'lets_encrypt_user.mail'",
+		"error decoding 'acme_accounts[0].eab.hmac_key'",
+		"error decoding 'dns_servers[0].tsig_secret'",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Expected ", len(expected), " errors got ", errs)
+	}
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	for _, message := range expected {
+		if !strings.Contains(strings.Join(messages, "\n"), message) {
+			t.Error("Missing error: ", message, "\ngot:\n", strings.Join(messages, "\n"))
+		}
+	}
+}
@@ -5,44 +5,147 @@ import (
 	"github.com/DumesnyJeremy/lets-encrypt"
 	"github.com/DumesnyJeremy/lets-encrypt/providers/dns"
 	"github.com/DumesnyJeremy/notification-service"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 	"os"
+	"strings"
 
 	"github.com/DumesnyJeremy/certificate-manager/manager"
+	"github.com/DumesnyJeremy/certificate-manager/manager/acme"
+	"github.com/DumesnyJeremy/certificate-manager/manager/api"
+	"github.com/DumesnyJeremy/certificate-manager/manager/certificates"
+	"github.com/DumesnyJeremy/certificate-manager/manager/discovery"
 	"github.com/DumesnyJeremy/certificate-manager/manager/fetcher"
+	"github.com/DumesnyJeremy/certificate-manager/manager/metrics"
+	"github.com/DumesnyJeremy/certificate-manager/manager/rfc2136"
+	"github.com/DumesnyJeremy/certificate-manager/manager/schedule"
 	updater "github.com/DumesnyJeremy/certificate-manager/manager/updater"
 )
 
+const (
+	DefaultNotificationRetries       = 3
+	DefaultNotificationRetryDelaySec = 10
+)
+
 type Config struct {
 	CertManager     manager.CertManagerConfig             `mapstructure:"certificate_manager"`
-	DNSServers      []dns.DNSServerConfig                 `mapstructure:"dns_servers"`
+	DNSServers      []DNSServerConfig                     `mapstructure:"dns_servers"`
+	Certificates    []certificates.Config                 `mapstructure:"certificates"`
 	Sites           []fetcher.CertificateFetchConfig      `mapstructure:"sites"`
 	Updaters        []updater.CertificateUpdateConfig     `mapstructure:"updaters"`
 	Notifiers       []notification_service.NotifierConfig `mapstructure:"notifiers"`
 	LetsEncryptUser lets_encrypt.LetsEncryptUserConfig    `mapstructure:"lets_encrypt_user"`
+	ACMEAccounts    []acme.AccountConfig                  `mapstructure:"acme_accounts"`
 	CertRootPath    string                                `mapstructure:"certificates_root_path"`
 	RestartMinutes  int64                                 `mapstructure:"loop_restart_min"`
+	Schedule        schedule.Config                       `mapstructure:"schedule"`
+	Metrics         metrics.Config                        `mapstructure:"metrics"`
+	API             api.Config                            `mapstructure:"api"`
+	Discovery       discovery.ScanConfig                  `mapstructure:"discovery"`
+	// Main configuration file, and file of every entry of the lists.
+	File    string  `mapstructure:"-"`
+	Sources Sources `mapstructure:"-"`
 }
 
+// A DNS server, with the fields of the rfc2136 type next to the ones of every type.
+type DNSServerConfig struct {
+	dns.DNSServerConfig `mapstructure:",squash"`
+	rfc2136.Config      `mapstructure:",squash"`
+}
+
+// Parse the main configuration file, then add the lists of the conf.d directory.
 func ParseConfig(configFilePath string) (*Config, error) {
-	fileType, err := findFileType(configFilePath)
-	if err != nil {
-			return nil, err
-	}
-	viper.SetConfigName("config")
-	viper.SetConfigType(fileType)
-	viper.AddConfigPath(configFilePath)
-	err = viper.ReadInConfig()
-	if err != nil {
+	if err := readConfig(configFilePath); err != nil {
 		return nil, err
 	}
 	configInfo, err := unmarshalServer()
 	if err != nil {
 		return nil, err
 	}
+	configInfo.setMainSources(viper.ConfigFileUsed())
+	if errs := configInfo.mergeConfD(configFilePath, false); len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+	configInfo.setSitesURL()
+	configInfo.setSitesCertificate()
 	return &configInfo, nil
 }
 
+// Return the errors as one, so every problem is reported at once.
+func joinErrors(errs []error) error {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// Parse the configuration strictly and return every problem found, prefixed by the file and the key:
+// unknown keys, wrong types, then invalid values and references.
+// The configuration must not be used if there is an error.
+func ValidateConfig(configFilePath string) (*Config, []error) {
+	if err := readConfig(configFilePath); err != nil {
+		return nil, []error{err}
+	}
+	var configInfo Config
+	err := viper.Unmarshal(&configInfo, decodeHooks, strictDecoding)
+	errs := decodeErrors(viper.ConfigFileUsed(), err)
+	configInfo.setMainSources(viper.ConfigFileUsed())
+	errs = append(errs, configInfo.mergeConfD(configFilePath, true)...)
+	configInfo.setSitesURL()
+	configInfo.setSitesCertificate()
+	errs = append(errs, withoutDependentErrors(configInfo.Validate(), errs)...)
+	return &configInfo, errs
+}
+
+func readConfig(configFilePath string) error {
+	fileType, err := findFileType(configFilePath)
+	if err != nil {
+		return err
+	}
+	setDefaults()
+	viper.SetConfigType(fileType)
+	viper.SetConfigFile(configFilePath + "config." + fileType)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	registerSecrets(viper.AllSettings(), "")
+	return nil
+}
+
+// A site declared with names only is identified by its primary name, or its first name.
+func (config *Config) setSitesURL() {
+	for i, site := range config.Sites {
+		if site.URL != "" {
+			continue
+		}
+		if site.Primary != "" {
+			config.Sites[i].URL = site.Primary
+		} else if len(site.Names) > 0 {
+			config.Sites[i].URL = site.Names[0]
+		}
+	}
+}
+
+// Link every site to the definition of the shared certificate it references.
+func (config *Config) setSitesCertificate() {
+	for i, site := range config.Sites {
+		config.Sites[i].Shared = nil
+		for j, certificate := range config.Certificates {
+			if site.Certificate != "" && certificate.Name == site.Certificate {
+				config.Sites[i].Shared = &config.Certificates[j]
+				break
+			}
+		}
+	}
+}
+
+// Values used when they are not given in the configuration file.
+func setDefaults() {
+	viper.SetDefault("certificate_manager.notification.retries", DefaultNotificationRetries)
+	viper.SetDefault("certificate_manager.notification.retry_delay_sec", DefaultNotificationRetryDelaySec)
+}
+
 func findFileType(configFilePath string) (string, error) {
 	filetypes := [3]string{"toml", "json", "yaml"}
 	for _, filetype := range filetypes {
@@ -56,8 +159,17 @@ func findFileType(configFilePath string) (string, error) {
 
 func unmarshalServer() (Config, error) {
 	var configArray Config
-	if err := viper.Unmarshal(&configArray); err != nil {
+	if err := viper.Unmarshal(&configArray, decodeHooks); err != nil {
 		return configArray, err
 	}
 	return configArray, nil
 }
+
+// Resolve the references to the secrets, then apply the default hooks of viper.
+func decodeHooks(decoderConfig *mapstructure.DecoderConfig) {
+	decoderConfig.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+		interpolationHook(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)
+}
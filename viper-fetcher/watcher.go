@@ -0,0 +1,83 @@
+package viper_fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Time without new event before a change of the configuration file is reported,
+// editors often write a file in several steps.
+const WatchDebounce = time.Second
+
+// Watch the configuration file found in the directory, and the files of its conf.d directory,
+// and call onChange after each modification until the context is cancelled.
+// The directories are watched, so a file replaced by an editor is still followed.
+func WatchConfig(ctx context.Context, configFilePath string, onChange func()) error {
+	fileType, err := findFileType(configFilePath)
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Clean(filepath.Join(configFilePath, "config."+fileType))
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	confDDir := filepath.Clean(filepath.Join(configFilePath, ConfDDirName))
+	if info, err := os.Stat(confDDir); err == nil && info.IsDir() {
+		if err := watcher.Add(confDDir); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(WatchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isConfigFile(event.Name, configFile, confDDir) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					debounce.Reset(WatchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error("While watching the configuration: ", err.Error())
+			case <-debounce.C:
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+func isConfigFile(name string, configFile string, confDDir string) bool {
+	name = filepath.Clean(name)
+	if name == configFile {
+		return true
+	}
+	if filepath.Dir(name) != confDDir {
+		return false
+	}
+	for _, fileType := range confDFileTypes {
+		if filepath.Ext(name) == "."+fileType {
+			return true
+		}
+	}
+	return false
+}